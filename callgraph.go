@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func init() {
+	_, err := parser.AddCommand("callgraph",
+		"build a static call graph of Go packages",
+		"Build a static call graph of Go packages, producing the def keys of the callers and callees of each call.",
+		&callgraphCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type CallgraphCmd struct {
+	Algo string `long:"algo" description:"call graph algorithm (cha or rta)" default:"cha"`
+}
+
+var callgraphCmd CallgraphCmd
+
+func (c *CallgraphCmd) Execute(args []string) error {
+	units, err := readSourceUnits()
+	if err != nil {
+		return err
+	}
+
+	out, err := Callgraph(units, c.Algo)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+		return err
+	}
+	return nil
+}
+
+// callgraphOutput is the output of the callgraph command.
+type callgraphOutput struct {
+	Calls []*callgraphCall
+}
+
+// callgraphCall is a call from the func or method Caller to Callee.
+// Their def keys are the same as those of the defs in the output of
+// the graph command.
+type callgraphCall struct {
+	Caller graph.DefKey
+	Callee graph.DefKey
+}
+
+// Callgraph builds a static call graph of units with the given
+// algorithm (gog.CHA or gog.RTA). If there are several build
+// configurations, the calls under each of them are merged.
+func Callgraph(units unit.SourceUnits, algo string) (*callgraphOutput, error) {
+	pkgs := unitsAsBuildPackages(units)
+	configs := config.BuildConfigs
+	if len(configs) == 0 {
+		configs = []gog.BuildConfig{{}}
+	}
+
+	out := &callgraphOutput{Calls: []*callgraphCall{}}
+	seen := make(map[callgraphCall]bool)
+	for _, bc := range configs {
+		loaded, err := loadPackages(pkgs, bc)
+		if err != nil {
+			return nil, fmt.Errorf("build config %s: %s", bc, err)
+		}
+		calls, err := gog.New(loaded).CallGraph(algo)
+		if err != nil {
+			return nil, err
+		}
+		for _, call := range calls {
+			keys, err := convertGoDefKeys([]*gog.DefKey{call.Caller, call.Callee})
+			if err != nil {
+				log.Printf("Ignoring call from %v to %v due to error in converting def keys: %s.", call.Caller, call.Callee, err)
+				continue
+			}
+			if len(keys) != 2 {
+				continue
+			}
+			c := callgraphCall{Caller: keys[0], Callee: keys[1]}
+			if !seen[c] {
+				seen[c] = true
+				out.Calls = append(out.Calls, &c)
+			}
+		}
+	}
+	return out, nil
+}
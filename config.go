@@ -9,18 +9,17 @@ import (
 	"path/filepath"
 	"strings"
 
-	"go/types"
+	"golang.org/x/tools/go/packages"
 
-	"golang.org/x/tools/go/loader"
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
 )
 
 var (
 	buildContext = build.Default
 
-	loaderConfig = loader.Config{
-		TypeChecker: types.Config{FakeImportC: true},
-		Build:       &buildContext,
-		AllowErrors: true,
+	packagesConfig = packages.Config{
+		Mode:  gog.LoadMode,
+		Tests: true,
 	}
 
 	config *srcfileConfig
@@ -90,6 +89,75 @@ type srcfileConfig struct {
 	// sorted by longest path to shortest (ie most specific to least
 	// specific)
 	VendorDirs []string
+
+	// ModuleRoot is the directory, relative to the repository root,
+	// containing the go.mod file of the Go module that a source unit
+	// belongs to. It is set by the scanner and is usually not set by
+	// the user. It is empty for packages that are not in a module.
+	ModuleRoot string
+
+	// ModulePath is the module path declared in ModuleRoot's go.mod
+	// file.
+	ModulePath string
+
+	// ImportPathRules are static rules that map import path prefixes
+	// to clone URL templates. They are used to resolve import paths
+	// that are not on a well-known repository host (like github.com)
+	// without making network requests.
+	ImportPathRules []importPathRule
+
+	// GoImportMetaDir, if specified, is a directory of cached HTML
+	// pages with <meta name="go-import"> tags (as served at
+	// https://IMPORTPATH?go-get=1) that are used to resolve import
+	// paths. If relative, it is made absolute by prefixing the
+	// directory containing the Srcfile.
+	GoImportMetaDir string
+
+	// ModuleProxyDir is a local module cache laid out like a GOPROXY
+	// (such as the go command's module download cache,
+	// $GOMODCACHE/cache/download) that is used to resolve import
+	// paths. It is not used unless it is set, so that resolution
+	// doesn't depend on what the machine has downloaded.
+	ModuleProxyDir string
+
+	// NetworkResolve enables fetching information about import paths
+	// over the network when they can't be resolved in any other way.
+	NetworkResolve bool
+
+	// ResolveCacheDir, if specified, is a directory where the
+	// repositories that import paths resolve to are cached across
+	// runs. If relative, it is made absolute by prefixing the
+	// directory containing the Srcfile.
+	ResolveCacheDir string
+
+	// ResolveCacheTTL is how long the entries of resolved import paths
+	// in ResolveCacheDir are used before the import path is resolved
+	// again, as a Go duration string like "24h" (defaults to 168h).
+	ResolveCacheTTL string
+
+	// ResolveCacheNegativeTTL is how long the entries of import paths
+	// that could not be resolved are used, as a Go duration string
+	// (defaults to 1h).
+	ResolveCacheNegativeTTL string
+
+	// GraphWorkers is the number of packages that are graphed
+	// concurrently. It defaults to GOMAXPROCS.
+	GraphWorkers int
+
+	// BuildConfigs, if specified, are the build configurations (build
+	// tags, GOOS and GOARCH) to graph packages under. Packages are
+	// graphed once under each configuration and the results are
+	// merged. Defs that only exist under some of the configurations
+	// list them in their BuildConfigs data field. If BuildConfigs is
+	// empty, packages are graphed under the default build
+	// configuration only.
+	BuildConfigs []gog.BuildConfig
+
+	// DocFormats are the formats that doc comments are output in
+	// ("text/html", "text/plain", "text/markdown" and
+	// "application/vnd.srclib-go.doc+json"). It defaults to HTML and
+	// plain text.
+	DocFormats []string
 }
 
 // unmarshalTypedConfig parses config from the Config field of the source unit.
@@ -150,7 +218,6 @@ func (c *srcfileConfig) apply() error {
 		}
 
 		buildContext.GOROOT = c.GOROOT
-		loaderConfig.Build = &buildContext
 	}
 
 	if config.GOPATH != "" {
@@ -160,11 +227,29 @@ func (c *srcfileConfig) apply() error {
 
 		dirs = append(dirs, filepath.SplitList(buildContext.GOPATH)...)
 		buildContext.GOPATH = strings.Join(uniq(dirs), string(filepath.ListSeparator))
-		loaderConfig.Build = &buildContext
 	}
 
 	config.VendorDirs = cleanDirs(config.VendorDirs)
 
+	if config.ModuleRoot != "" {
+		config.ModuleRoot = cleanDirs([]string{config.ModuleRoot})[0]
+	}
+	if config.GoImportMetaDir != "" {
+		config.GoImportMetaDir = cleanDirs([]string{config.GoImportMetaDir})[0]
+	}
+	if config.ResolveCacheDir != "" {
+		config.ResolveCacheDir = cleanDirs([]string{config.ResolveCacheDir})[0]
+	}
+	if config.ModuleProxyDir != "" {
+		config.ModuleProxyDir = cleanDirs([]string{strings.TrimPrefix(config.ModuleProxyDir, "file://")})[0]
+	}
+
+	for _, format := range config.DocFormats {
+		if !gog.IsDocFormat(format) {
+			return fmt.Errorf("unknown doc format %q in DocFormats", format)
+		}
+	}
+
 	if config.GOROOTForCmd == "" {
 		config.GOROOTForCmd = buildContext.GOROOT
 	}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"go/build"
 	"log"
-	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/golang/gddo/gosrc"
 
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
 	"sourcegraph.com/sourcegraph/srclib/dep"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
@@ -52,9 +52,9 @@ func (c *DepResolveCmd) Execute(args []string) error {
 
 	res := make([]*dep.Resolution, len(unit.Dependencies))
 	for i, rawDep := range unit.Dependencies {
-		importPath, ok := rawDep.(string)
-		if !ok {
-			return fmt.Errorf("Go raw dep is not a string import path: %v (%T)", rawDep, rawDep)
+		importPath, err := rawDepImportPath(rawDep)
+		if err != nil {
+			return err
 		}
 
 		res[i] = &dep.Resolution{Raw: rawDep}
@@ -78,6 +78,20 @@ func (c *DepResolveCmd) Execute(args []string) error {
 	return nil
 }
 
+// rawDepImportPath returns the import path of a raw dep emitted by the
+// scanner, which is either an import path string or a gog.Dep.
+func rawDepImportPath(rawDep interface{}) (string, error) {
+	switch rawDep := rawDep.(type) {
+	case string:
+		return rawDep, nil
+	case map[string]interface{}:
+		if name, ok := rawDep["Name"].(string); ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Go raw dep is not an import path or a gog.Dep: %v (%T)", rawDep, rawDep)
+}
+
 // targetCache caches (dep).ResolvedTarget's for importPaths
 type targetCache struct {
 	data map[string]*dep.ResolvedTarget
@@ -108,10 +122,13 @@ func ResolveDep(importPath string) (*dep.ResolvedTarget, error) {
 	if target := resolveCache.Get(importPath); target != nil {
 		return target, nil
 	}
-	if strings.HasSuffix(importPath, "_test") {
-		// TODO(sqs): handle xtest packages - these should not be appearing here
-		// as import paths, but they are, so suppress errors
-		return nil, fmt.Errorf("xtest package (%s) is not yet supported", importPath)
+
+	// Check if this import path is in a Go module in this tree, or is
+	// provided by a module that the unit's go.mod replaces with a
+	// directory in this tree.
+	if target := resolveInTreeModuleDep(importPath); target != nil {
+		resolveCache.Put(importPath, target)
+		return target, nil
 	}
 
 	// Check if this import path is in this tree. If refs refer to vendored deps, they are linked to the vendored code
@@ -135,8 +152,20 @@ func ResolveDep(importPath string) (*dep.ResolvedTarget, error) {
 		}
 	}
 
-	// Handle some special (and edge) cases faster for performance and corner-cases.
+	// Packages provided by a module that the unit's go.mod requires are
+	// fetched from the module's replacement (if any), at the version
+	// given in go.mod or go.sum.
 	target := &dep.ResolvedTarget{ToUnit: importPath, ToUnitType: "GoPackage"}
+	fetchPath := importPath
+	if mod := unitGoModule(); mod != nil {
+		if p, version, ok := mod.requirement(importPath); ok {
+			fetchPath = p
+			target.ToVersionString = version
+			target.ToRevSpec = gog.ModuleVersionRev(version)
+		}
+	}
+
+	// Handle some special (and edge) cases faster for performance and corner-cases.
 	switch {
 	// CGO package "C"
 	case importPath == "C":
@@ -149,8 +178,8 @@ func ResolveDep(importPath string) (*dep.ResolvedTarget, error) {
 		target.ToRevSpec = "" // TODO(sqs): fill in when graphing stdlib repo
 
 	// Special-case github.com/... import paths for performance.
-	case strings.HasPrefix(importPath, "github.com/") || strings.HasPrefix(importPath, "sourcegraph.com/"):
-		cloneURL, err := standardRepoHostImportPathToCloneURL(importPath)
+	case strings.HasPrefix(fetchPath, "github.com/") || strings.HasPrefix(fetchPath, "sourcegraph.com/"):
+		cloneURL, err := standardRepoHostImportPathToCloneURL(fetchPath)
 		if err != nil {
 			return nil, err
 		}
@@ -158,42 +187,34 @@ func ResolveDep(importPath string) (*dep.ResolvedTarget, error) {
 
 	// Special-case google.golang.org/... (e.g., /appengine) import
 	// paths for performance and to avoid hitting GitHub rate limit.
-	case strings.HasPrefix(importPath, "google.golang.org/"):
-		target.ToRepoCloneURL = "https://" + strings.Replace(importPath, "google.golang.org/", "github.com/golang/", 1) + ".git"
+	case strings.HasPrefix(fetchPath, "google.golang.org/"):
+		target.ToRepoCloneURL = "https://" + strings.Replace(fetchPath, "google.golang.org/", "github.com/golang/", 1) + ".git"
 
 	// Special-case code.google.com/p/... import paths for performance.
-	case strings.HasPrefix(importPath, "code.google.com/p/"):
-		parts := strings.SplitN(importPath, "/", 4)
+	case strings.HasPrefix(fetchPath, "code.google.com/p/"):
+		parts := strings.SplitN(fetchPath, "/", 4)
 		if len(parts) < 3 {
-			return nil, fmt.Errorf("import path starts with 'code.google.com/p/' but is not valid: %q", importPath)
+			return nil, fmt.Errorf("import path starts with 'code.google.com/p/' but is not valid: %q", fetchPath)
 		}
 		target.ToRepoCloneURL = "https://" + strings.Join(parts[:3], "/")
 
 	// Special-case golang.org/x/... import paths for performance.
-	case strings.HasPrefix(importPath, "golang.org/x/"):
-		parts := strings.SplitN(importPath, "/", 4)
+	case strings.HasPrefix(fetchPath, "golang.org/x/"):
+		parts := strings.SplitN(fetchPath, "/", 4)
 		if len(parts) < 3 {
-			return nil, fmt.Errorf("import path starts with 'golang.org/x/' but is not valid: %q", importPath)
+			return nil, fmt.Errorf("import path starts with 'golang.org/x/' but is not valid: %q", fetchPath)
 		}
 		target.ToRepoCloneURL = "https://" + strings.Replace(strings.Join(parts[:3], "/"), "golang.org/x/", "github.com/golang/", 1)
 
 	// Try to resolve everything else
 	default:
-		log.Printf("Resolving Go dep: %s", importPath)
-		dir, err := gosrc.Get(http.DefaultClient, string(importPath), "")
-		if err == nil {
-			if strings.HasPrefix(dir.ResolvedPath, "github.com/") {
-				cloneURL, err := standardRepoHostImportPathToCloneURL(dir.ResolvedPath)
-				if err != nil {
-					return nil, err
-				}
-				target.ToRepoCloneURL = cloneURL
-			} else {
-				target.ToRepoCloneURL = strings.TrimSuffix(dir.ProjectURL, "/")
-			}
-		} else {
-			log.Printf("warning: unable to fetch information about Go package %q: %s", importPath, err)
-			target.ToRepoCloneURL = importPath
+		ok, err := resolveRepo(fetchPath, target)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("warning: unable to resolve the repository of Go package %q (network lookups are only made if the NetworkResolve config property is set)", fetchPath)
+			target.ToRepoCloneURL = fetchPath
 		}
 	}
 
@@ -203,6 +224,74 @@ func ResolveDep(importPath string) (*dep.ResolvedTarget, error) {
 	return target, nil
 }
 
+var (
+	repoGoModulesOnce sync.Once
+	repoGoModulesList goModules
+)
+
+// repoGoModules returns the Go modules in the repository being
+// analyzed.
+func repoGoModules() goModules {
+	repoGoModulesOnce.Do(func() {
+		mods, err := findGoModules(cwd)
+		if err != nil {
+			log.Printf("warning: unable to find Go modules in %s: %s", cwd, err)
+		}
+		repoGoModulesList = mods
+	})
+	return repoGoModulesList
+}
+
+// unitGoModule returns the Go module containing the source unit being
+// analyzed, or nil if it is not in a module.
+func unitGoModule() *goModule {
+	if config == nil || config.ModuleRoot == "" {
+		return nil
+	}
+	for _, m := range repoGoModules() {
+		if sameDir(m.Dir, config.ModuleRoot) {
+			return m
+		}
+	}
+	return nil
+}
+
+// resolveInTreeModuleDep returns a target in this repository for
+// importPath if it is in one of the repository's Go modules, or if the
+// unit's go.mod replaces the module providing it with a directory in
+// this repository. Otherwise it returns nil.
+func resolveInTreeModuleDep(importPath string) *dep.ResolvedTarget {
+	mods := repoGoModules()
+	var unitName string
+	if mod := unitGoModule(); mod != nil {
+		if dir, ok := mod.localReplacement(importPath); ok {
+			if !pathHasPrefix(dir, cwd) {
+				// Replaced by a directory outside of this repository.
+				return nil
+			}
+			// The scanner names units after the module path in the
+			// replacement directory's go.mod, not after importPath.
+			unitName = importPath
+			if m := mods.forDir(dir); m != nil {
+				if name, err := m.importPath(dir); err == nil {
+					unitName = name
+				}
+			}
+		}
+	}
+	if unitName == "" && mods.forImportPath(importPath) != nil {
+		unitName = importPath
+	}
+	if unitName == "" {
+		return nil
+	}
+	return &dep.ResolvedTarget{
+		ToRepoCloneURL: "", // empty ToRepoCloneURL to indicate it's from this repository
+		ToUnit:         unitName,
+		ToUnitType:     "GoPackage",
+	}
+}
+
 // standardRepoHostImportPathToCloneURL returns the clone URL for an
 // import path that references a standard repo host (e.g.,
 // github.com). It assumes a structure of
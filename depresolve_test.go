@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestUnitGoModule(t *testing.T) {
+	real := evalSymlinks(t.TempDir())
+	writeTestFiles(t, real, map[string]string{
+		"a/go.mod": "module example.com/a\n",
+		"b/go.mod": "module example.com/b\n",
+	})
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Skip(err)
+	}
+	sep := string(filepath.Separator)
+
+	oldCwd, oldConfig := cwd, config
+	defer func() {
+		cwd, config = oldCwd, oldConfig
+		repoGoModulesOnce, repoGoModulesList = sync.Once{}, nil
+	}()
+
+	tests := []struct {
+		name       string
+		cwd        string
+		moduleRoot string
+	}{
+		{"same paths", real, filepath.Join(real, "a")},
+		{"trailing slash", real, filepath.Join(real, "a") + sep},
+		{"symlinked checkout", link + sep, filepath.Join(real, "a")},
+		{"symlinked module root", real, filepath.Join(link, "a")},
+	}
+	for _, test := range tests {
+		cwd = test.cwd
+		config = &srcfileConfig{ModuleRoot: test.moduleRoot}
+		repoGoModulesOnce, repoGoModulesList = sync.Once{}, nil
+
+		m := unitGoModule()
+		if m == nil {
+			t.Errorf("%s: got no module", test.name)
+			continue
+		}
+		if m.Module != "example.com/a" {
+			t.Errorf("%s: got module %q, want %q", test.name, m.Module, "example.com/a")
+		}
+	}
+}
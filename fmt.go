@@ -4,8 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go/doc"
+	"go/doc/comment"
+	"html"
 	"log"
+	"regexp"
+	"strconv"
+	"strings"
 
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	defpkg "sourcegraph.com/sourcegraph/srclib-go/golang_def"
 	"sourcegraph.com/sourcegraph/srclib/graph"
 )
 
@@ -24,6 +32,7 @@ type FmtCmd struct {
 	UnitType   string `short:"u" long:"unit-type" description:"Unit type" required:"yes"`
 	ObjectType string `short:"t" long:"object-type" description:"Object type ('def', 'doc')" required:"yes"`
 	Format     string `short:"f" long:"format" description:"Format to output ('full', 'decl')" default:"full"`
+	Output     string `short:"o" long:"output" description:"Output as plain text or HTML ('text', 'html')" default:"text"`
 
 	Object string `long:"object" description:"Object to format, serialized as JSON" required:"yes"`
 }
@@ -31,18 +40,281 @@ type FmtCmd struct {
 var fmtCmd FmtCmd
 
 func (c *FmtCmd) Execute(args []string) error {
+	if c.Format != "full" && c.Format != "decl" {
+		return fmt.Errorf("Format not recognized: %s", c.Format)
+	}
+	if c.Output != "text" && c.Output != "html" {
+		return fmt.Errorf("Output not recognized: %s", c.Output)
+	}
+
+	var out string
 	switch c.ObjectType {
 	case "def":
 		var d *graph.Def
 		if err := json.Unmarshal([]byte(c.Object), &d); err != nil {
 			return err
 		}
-		f := d.Fmt()
-		fmt.Printf("%s %s%s%s", f.Kind(), f.Name(graph.Unqualified), f.NameAndTypeSeparator(), f.Type(graph.Unqualified))
-		return nil
+		if d == nil {
+			return errors.New("no def to format")
+		}
+		out = fmtDef(d, c.Format, c.Output)
 	case "doc":
-		return errors.New("Doc formatting yet to be implemented")
+		var d *graph.Doc
+		if err := json.Unmarshal([]byte(c.Object), &d); err != nil {
+			return err
+		}
+		if d == nil {
+			return errors.New("no doc to format")
+		}
+		var err error
+		if out, err = fmtDoc(d.Format, d.Data, c.Format, c.Output); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Object type not recognized: %s", c.ObjectType)
+	}
+	fmt.Print(out)
+	return nil
+}
+
+// fmtDef formats def as its declaration (in the "decl" format) or as
+// its declaration followed by its doc, if it has one (in the "full"
+// format), as plain text or HTML (if output is "html").
+func fmtDef(def *graph.Def, format, output string) string {
+	decl := fmtDecl(def.Fmt())
+	if output == "html" {
+		decl = "<pre><code>" + html.EscapeString(decl) + "</code></pre>\n"
+	}
+	if format == "decl" || len(def.Docs) == 0 {
+		return decl
+	}
+
+	d := preferredDoc(def.Docs, output)
+	docText, err := fmtDoc(d.Format, d.Data, "full", output)
+	if err != nil {
+		log.Printf("Omitting doc of def %v: %s.", def.DefKey, err)
+		return decl
+	}
+	if output == "html" {
+		return decl + docText
+	}
+	return decl + "\n\n" + docText
+}
+
+// preferredDoc returns the doc in docs whose format is closest to the
+// output: the doc in the output's own format, or else one that is
+// formatted from its structure rather than from HTML.
+func preferredDoc(docs []*graph.DefDoc, output string) *graph.DefDoc {
+	prefs := []string{gog.DocText, gog.DocStructured, gog.DocMarkdown}
+	if output == "html" {
+		prefs = []string{gog.DocHTML, gog.DocStructured, gog.DocMarkdown, gog.DocText}
+	}
+	for _, format := range prefs {
+		for _, d := range docs {
+			if d.Format == format {
+				return d
+			}
+		}
+	}
+	return docs[0]
+}
+
+// fmtDecl returns the declaration of a def, such as
+// "func (t *T) M(x int)", as f formats it.
+func fmtDecl(f graph.DefFormatter) string {
+	if df, ok := f.(interface {
+		Decl() string
+	}); ok {
+		return df.Decl()
+	}
+	// The formatted type starts with the separator that it needs.
+	return strings.TrimSpace(f.DefKeyword() + " " + f.Name(graph.ScopeQualified) + f.Type(graph.ScopeQualified))
+}
+
+// fmtDoc formats a doc whose format (one of the gog doc formats) is
+// docFormat and whose data is data, in full or (in the "decl" format)
+// as its first sentence, as plain text or HTML (if output is "html").
+// HTML docs can only be output in full as HTML; the other doc formats
+// of the same comment are formatted instead of parsing HTML.
+func fmtDoc(docFormat, data, format, output string) (string, error) {
+	if format == "full" && ((output == "html" && docFormat == gog.DocHTML) || (output == "text" && docFormat == gog.DocText)) {
+		return data, nil
+	}
+
+	d, err := parseDoc(docFormat, data)
+	if err != nil {
+		return "", err
+	}
+	var printer comment.Printer
+	if format == "decl" {
+		synopsis := doc.Synopsis(string(printer.Text(d)))
+		if output == "html" {
+			return html.EscapeString(synopsis), nil
+		}
+		return synopsis, nil
+	}
+	if output == "html" {
+		return string(printer.HTML(d)), nil
+	}
+	return string(printer.Text(d)), nil
+}
+
+// parseDoc parses a doc whose format is docFormat and whose data is
+// data.
+func parseDoc(docFormat, data string) (*comment.Doc, error) {
+	switch docFormat {
+	case gog.DocText:
+		var p comment.Parser
+		return p.Parse(data), nil
+	case gog.DocMarkdown:
+		return markdownDoc(data), nil
+	case gog.DocStructured:
+		var sd *defpkg.StructuredDoc
+		if err := json.Unmarshal([]byte(data), &sd); err != nil {
+			return nil, err
+		}
+		if sd == nil {
+			return nil, errors.New("no structured doc")
+		}
+		return structuredDoc(sd), nil
+	case gog.DocHTML:
+		return nil, fmt.Errorf("%s docs can only be output in full as HTML (format the %s, %s or %s doc of the same comment instead)", gog.DocHTML, gog.DocText, gog.DocMarkdown, gog.DocStructured)
 	default:
-		return errors.New("Object type not recognized: %s")
+		return nil, fmt.Errorf("doc format not recognized: %s", docFormat)
+	}
+}
+
+// structuredDoc returns the comment.Doc of the structured doc sd.
+func structuredDoc(sd *defpkg.StructuredDoc) *comment.Doc {
+	d := &comment.Doc{}
+	for _, b := range sd.Blocks {
+		switch b.Kind {
+		case defpkg.DocHeading:
+			d.Content = append(d.Content, &comment.Heading{Text: []comment.Text{comment.Plain(b.Text)}})
+		case defpkg.DocCode:
+			d.Content = append(d.Content, &comment.Code{Text: b.Text})
+		case defpkg.DocList:
+			list := &comment.List{ForceBlankBefore: true}
+			for i, item := range b.Items {
+				li := &comment.ListItem{Content: []comment.Block{&comment.Paragraph{Text: []comment.Text{comment.Plain(item)}}}}
+				if b.Ordered {
+					li.Number = strconv.Itoa(i + 1)
+				}
+				list.Items = append(list.Items, li)
+			}
+			d.Content = append(d.Content, list)
+		default:
+			d.Content = append(d.Content, &comment.Paragraph{Text: []comment.Text{comment.Plain(b.Text)}})
+		}
+	}
+	return d
+}
+
+var (
+	markdownHeadingID = regexp.MustCompile(`\s*\{#[^}]*\}$`)
+	markdownListItem  = regexp.MustCompile(`^ {0,3}(?:([0-9]+)\.|-) (.*)$`)
+	markdownLink      = regexp.MustCompile(`\[((?:[^\]\\]|\\.)*)\]\(([^)]*)\)`)
+	markdownEscape    = regexp.MustCompile(`\\(.)`)
+)
+
+// markdownDoc parses a doc in the Markdown that go/doc/comment prints
+// (see comment.Printer.Markdown): paragraphs, "#" headings,
+// tab-indented code blocks and "-" or numbered lists.
+func markdownDoc(data string) *comment.Doc {
+	d := &comment.Doc{}
+	last := func() comment.Block {
+		if len(d.Content) == 0 {
+			return nil
+		}
+		return d.Content[len(d.Content)-1]
+	}
+	for _, chunk := range strings.Split(data, "\n\n") {
+		chunk = strings.Trim(chunk, "\n")
+		if strings.TrimSpace(chunk) == "" {
+			continue
+		}
+		lines := strings.Split(chunk, "\n")
+
+		switch {
+		case strings.HasPrefix(chunk, "#"):
+			text := markdownHeadingID.ReplaceAllString(strings.TrimSpace(strings.TrimLeft(chunk, "#")), "")
+			d.Content = append(d.Content, &comment.Heading{Text: markdownText(text)})
+
+		case isMarkdownCode(lines):
+			for i, line := range lines {
+				lines[i] = strings.TrimPrefix(line, "\t")
+			}
+			text := strings.Join(lines, "\n") + "\n"
+			if code, ok := last().(*comment.Code); ok {
+				// A code block with blank lines in it.
+				code.Text += "\n" + text
+			} else {
+				d.Content = append(d.Content, &comment.Code{Text: text})
+			}
+
+		case markdownListItem.MatchString(lines[0]) || (strings.HasPrefix(chunk, "    ") && isList(last())):
+			list, ok := last().(*comment.List)
+			if !ok {
+				list = &comment.List{ForceBlankBefore: true}
+				d.Content = append(d.Content, list)
+			}
+			for _, line := range lines {
+				if m := markdownListItem.FindStringSubmatch(line); m != nil {
+					list.Items = append(list.Items, &comment.ListItem{Number: m[1], Content: []comment.Block{&comment.Paragraph{}}})
+					line = m[2]
+				}
+				if len(list.Items) == 0 {
+					continue
+				}
+				item := list.Items[len(list.Items)-1]
+				p := item.Content[0].(*comment.Paragraph)
+				if len(p.Text) > 0 {
+					p.Text = append(p.Text, comment.Plain("\n"))
+				}
+				p.Text = append(p.Text, markdownText(strings.TrimSpace(line))...)
+			}
+
+		default:
+			d.Content = append(d.Content, &comment.Paragraph{Text: markdownText(chunk)})
+		}
+	}
+	return d
+}
+
+func isMarkdownCode(lines []string) bool {
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "\t") {
+			return false
+		}
+	}
+	return true
+}
+
+func isList(b comment.Block) bool {
+	_, ok := b.(*comment.List)
+	return ok
+}
+
+// markdownText returns the text of the Markdown inline text s, in which
+// links are [text](url) and punctuation is escaped with backslashes.
+func markdownText(s string) []comment.Text {
+	var ts []comment.Text
+	plain := func(s string) {
+		if s != "" {
+			ts = append(ts, comment.Plain(markdownEscape.ReplaceAllString(s, "$1")))
+		}
+	}
+	for {
+		m := markdownLink.FindStringSubmatchIndex(s)
+		if m == nil {
+			plain(s)
+			return ts
+		}
+		plain(s[:m[0]])
+		ts = append(ts, &comment.Link{
+			Text: []comment.Text{comment.Plain(markdownEscape.ReplaceAllString(s[m[2]:m[3]], "$1"))},
+			URL:  s[m[4]:m[5]],
+		})
+		s = s[m[1]:]
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestFmtDoc(t *testing.T) {
+	// The same doc comment in each doc format, as the grapher outputs
+	// it. The "<" in the code block must not be taken for an HTML
+	// tag.
+	const (
+		text       = "F returns a [T] if a < b && c.\n\n# Usage\n\nCall it:\n\n\tif a < b {\n\n\t\tF()\n\t}\n\nThen:\n  1. First\n  2. Second\n"
+		htmlDoc    = "<p>F returns a [T] if a &lt; b &amp;&amp; c.\n<h3 id=\"hdr-Usage\">Usage</h3>\n<p>Call it:\n<pre>if a &lt; b {\n\n\tF()\n}\n</pre>\n<p>Then:\n<ol>\n<li>First\n<li>Second\n</ol>\n"
+		markdown   = "F returns a [T](#T) if a \\< b && c.\n\n### Usage {#hdr-Usage}\n\nCall it:\n\n\tif a < b {\n\n\t\tF()\n\t}\n\nThen:\n\n 1. First\n 2. Second\n"
+		structured = `{"Summary":"F returns a T if a < b && c.","Blocks":[{"Kind":"paragraph","Text":"F returns a T if a < b && c."},{"Kind":"heading","Text":"Usage"},{"Kind":"paragraph","Text":"Call it:"},{"Kind":"code","Text":"if a < b {\n\n\tF()\n}\n"},{"Kind":"paragraph","Text":"Then:"},{"Kind":"list","Items":["First","Second"],"Ordered":true}],"Links":[{"Text":"T","ImportPath":"p","Name":"T"}]}`
+
+		// What the docs are formatted as. Links appear as their text,
+		// except in the HTML of the Markdown doc.
+		fullText  = "F returns a T if a < b && c.\n\n# Usage\n\nCall it:\n\n\tif a < b {\n\n\t\tF()\n\t}\n\nThen:\n\n 1. First\n 2. Second\n"
+		fullHTML  = "<p>F returns a T if a &lt; b &amp;&amp; c.\n<h3 id=\"hdr-Usage\">Usage</h3>\n<p>Call it:\n<pre>if a &lt; b {\n\n\tF()\n}\n</pre>\n<p>Then:\n<ol>\n<li>First\n<li>Second\n</ol>\n"
+		declText  = "F returns a T if a < b && c."
+		declHTML  = "F returns a T if a &lt; b &amp;&amp; c."
+		textLinks = "F returns a [T] if a < b && c."
+	)
+
+	tests := []struct {
+		docFormat, data string
+		format, output  string
+		want            string
+		wantErr         bool
+	}{
+		{gog.DocText, text, "full", "text", text, false},
+		{gog.DocText, text, "full", "html", htmlDoc, false},
+		{gog.DocText, text, "decl", "text", textLinks, false},
+		{gog.DocText, text, "decl", "html", "F returns a [T] if a &lt; b &amp;&amp; c.", false},
+
+		{gog.DocHTML, htmlDoc, "full", "html", htmlDoc, false},
+		{gog.DocHTML, htmlDoc, "full", "text", "", true},
+		{gog.DocHTML, htmlDoc, "decl", "text", "", true},
+		{gog.DocHTML, htmlDoc, "decl", "html", "", true},
+
+		{gog.DocMarkdown, markdown, "full", "text", fullText, false},
+		{gog.DocMarkdown, markdown, "full", "html", "<p>F returns a <a href=\"#T\">T</a> if a &lt; b &amp;&amp; c.\n<h3 id=\"hdr-Usage\">Usage</h3>\n<p>Call it:\n<pre>if a &lt; b {\n\n\tF()\n}\n</pre>\n<p>Then:\n<ol>\n<li>First\n<li>Second\n</ol>\n", false},
+		{gog.DocMarkdown, markdown, "decl", "text", declText, false},
+		{gog.DocMarkdown, markdown, "decl", "html", declHTML, false},
+
+		{gog.DocStructured, structured, "full", "text", fullText, false},
+		{gog.DocStructured, structured, "full", "html", fullHTML, false},
+		{gog.DocStructured, structured, "decl", "text", declText, false},
+		{gog.DocStructured, structured, "decl", "html", declHTML, false},
+
+		{gog.DocStructured, "{", "full", "text", "", true},
+		{"text/rtf", "", "full", "text", "", true},
+	}
+	for _, test := range tests {
+		got, err := fmtDoc(test.docFormat, test.data, test.format, test.output)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s as %s %s: got error %v, want error: %v", test.docFormat, test.format, test.output, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s as %s %s: got %q, want %q", test.docFormat, test.format, test.output, got, test.want)
+		}
+	}
+}
+
+func TestMarkdownDoc(t *testing.T) {
+	tests := map[string]string{
+		"Items:\n\n  - a\n    more a\n  - b\n\nNext.\n": "Items:\n\n  - a more a\n  - b\n\nNext.\n",
+		"Loose:\n\n 1. One\n\n 2. Two\n":                "Loose:\n\n 1. One\n 2. Two\n",
+		"See [the site](https://go.dev) and \\*x\\*.\n": "See the site and *x*.\n",
+	}
+	for markdown, want := range tests {
+		if got, _ := fmtDoc(gog.DocMarkdown, markdown, "full", "text"); got != want {
+			t.Errorf("%q: got %q, want %q", markdown, got, want)
+		}
+	}
+}
+
+func TestPreferredDoc(t *testing.T) {
+	all := []*graph.DefDoc{
+		{Format: gog.DocHTML},
+		{Format: gog.DocMarkdown},
+		{Format: gog.DocStructured},
+		{Format: gog.DocText},
+	}
+	tests := []struct {
+		docs   []*graph.DefDoc
+		output string
+		want   string
+	}{
+		{all, "text", gog.DocText},
+		{all, "html", gog.DocHTML},
+		{all[:3], "text", gog.DocStructured},
+		{all[:2], "text", gog.DocMarkdown},
+		{all[1:], "html", gog.DocStructured},
+		{all[:1], "text", gog.DocHTML},
+	}
+	for _, test := range tests {
+		if got := preferredDoc(test.docs, test.output).Format; got != test.want {
+			t.Errorf("%d docs as %s: got %s doc, want %s", len(test.docs), test.output, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package gog
+
+import (
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// An AsmBody is the assembly implementation of a func that is declared
+// in Go without a body: the func's TEXT symbol in a .s file.
+type AsmBody struct {
+	File string
+
+	// Span is the span of the func's name in the TEXT symbol.
+	Span [2]uint32
+
+	// Arch is the GOARCH that the name of File restricts it to (as
+	// the name sum_amd64.s does), if any.
+	Arch string `json:",omitempty"`
+}
+
+// asmText matches the TEXT symbols of funcs, such as "TEXT ·add(SB)",
+// "TEXT ·(*T).M(SB)" and "TEXT math∕bits·Add<ABIInternal>(SB)".
+// Submatch 1 is the package path (in which "∕" replaces "/"), if any,
+// and submatch 2 is the name.
+var asmText = regexp.MustCompile(`(?m)^[ \t]*TEXT[ \t]+([^\s(·]*)·(\(\*?\w+\)\.\w+|[^\s(<]+)(?:<[^>]*>)?\(SB\)`)
+
+// asmBodies returns the assembly implementations of the funcs of pkg
+// that are declared without a body, and the refs from their TEXT
+// symbols to them. They are found in the .s files among pkg's
+// OtherFiles and its IgnoredFiles, which are the .s files for the
+// other architectures (and build constraints).
+func (g *Grapher) asmBodies(pkg *packages.Package, unit string) (map[types.Object][]*AsmBody, []*Ref, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, file := range append(append([]string(nil), pkg.OtherFiles...), pkg.IgnoredFiles...) {
+		if filepath.Ext(file) == ".s" && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil, nil
+	}
+
+	bodies := make(map[types.Object][]*AsmBody)
+	var refs []*Ref
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		text := blankCComments(src)
+		for _, m := range asmText.FindAllSubmatchIndex(text, -1) {
+			if pkgPath := strings.Replace(string(text[m[2]:m[3]]), "∕", "/", -1); pkgPath != "" && pkgPath != pkg.Types.Path() {
+				// A func of another package.
+				continue
+			}
+			start, name := m[4], string(text[m[4]:m[5]])
+			var recv string
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				// A method, such as T.M or (*T).M.
+				recv = strings.Trim(name[:i], "(*)")
+				start, name = start+i+1, name[i+1:]
+			}
+			fn, ok := lookupDocLink(pkg.Types, recv, name).(*types.Func)
+			if !ok || fn.Pkg() != pkg.Types || g.hasBody(fn) {
+				continue
+			}
+			key, err := g.defKey(fn)
+			if err != nil {
+				return nil, nil, err
+			}
+			span := [2]uint32{uint32(start), uint32(start + len(name))}
+			bodies[fn] = append(bodies[fn], &AsmBody{File: file, Span: span, Arch: fileArch(file)})
+			refs = append(refs, &Ref{Unit: unit, File: file, Span: span, Def: key, Kind: RefAsm})
+		}
+	}
+	return bodies, refs, nil
+}
+
+// hasBody reports whether the func fn is declared with a body (or is
+// not declared in a package that has syntax).
+func (g *Grapher) hasBody(fn *types.Func) bool {
+	_, path, _ := g.pathEnclosingInterval(fn.Pos(), fn.Pos())
+	for _, node := range path {
+		if decl, ok := node.(*ast.FuncDecl); ok {
+			return decl.Body != nil
+		}
+	}
+	return true
+}
+
+// fileArch returns the GOARCH that the name of file restricts it to
+// (as in sum_amd64.s or sum_linux_arm64.s), or "" if there is none.
+func fileArch(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if i := strings.LastIndex(name, "_"); i > 0 && knownArchs[name[i+1:]] {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// knownArchs are the GOARCH values that go/build recognizes in file
+// names.
+var knownArchs = map[string]bool{
+	"386": true, "amd64": true, "amd64p32": true, "arm": true,
+	"armbe": true, "arm64": true, "arm64be": true, "loong64": true,
+	"mips": true, "mipsle": true, "mips64": true, "mips64le": true,
+	"mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+	"ppc64le": true, "riscv": true, "riscv64": true, "s390": true,
+	"s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+}
+
+// mergeAsmBodies returns the union of the asm bodies a and b.
+func mergeAsmBodies(a, b []*AsmBody) []*AsmBody {
+	for _, body := range b {
+		found := false
+		for _, body2 := range a {
+			if body.File == body2.File && body.Span == body2.Span {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, body)
+		}
+	}
+	return a
+}
@@ -0,0 +1,105 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestAsmBodies(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	goFile := write("p.go", `package p
+
+func add(x, y int) int
+
+type T struct{}
+
+func (t *T) M()
+
+func withBody() {}
+`)
+	amd64Src := `#include "textflag.h"
+
+// func add(x, y int) int
+TEXT ·add(SB), NOSPLIT, $0-24
+	MOVQ x+0(FP), AX
+	ADDQ y+8(FP), AX
+	MOVQ AX, ret+16(FP)
+	RET
+
+TEXT ·(*T).M<ABIInternal>(SB), NOSPLIT, $0
+	RET
+
+/* TEXT ·withBody(SB), NOSPLIT, $0 */
+TEXT ·withBody(SB), NOSPLIT, $0
+	RET
+
+TEXT ·helper(SB), NOSPLIT, $0
+	RET
+
+TEXT other·add(SB), NOSPLIT, $0
+	RET
+`
+	arm64Src := `TEXT p·add(SB), NOSPLIT, $0-24
+	RET
+`
+	amd64File := write("add_amd64.s", amd64Src)
+	arm64File := write("add_arm64.s", arm64Src)
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, goFile, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := checkPkg(t, fset, "p", []*ast.File{f})
+	pkg.OtherFiles = []string{amd64File}
+	pkg.IgnoredFiles = []string{arm64File}
+
+	g := New([]*packages.Package{pkg})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	srcs := map[string]string{amd64File: amd64Src, arm64File: arm64Src}
+	type body struct {
+		file, name, arch string
+	}
+	got := make(map[defPath][]body)
+	for _, def := range g.Defs {
+		for _, b := range def.AsmBodies {
+			got[def.DefKey.defPath()] = append(got[def.DefKey.defPath()], body{filepath.Base(b.File), srcs[b.File][b.Span[0]:b.Span[1]], b.Arch})
+		}
+	}
+	want := map[defPath][]body{
+		{"p", "add"}: {{"add_amd64.s", "add", "amd64"}, {"add_arm64.s", "add", "arm64"}},
+		{"p", "T/M"}: {{"add_amd64.s", "M", "amd64"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got asm bodies %v, want %v", got, want)
+	}
+
+	var refs []defPath
+	for _, ref := range g.Refs {
+		if ref.Kind == RefAsm {
+			refs = append(refs, ref.Def.defPath())
+		}
+	}
+	wantRefs := []defPath{{"p", "add"}, {"p", "T/M"}, {"p", "add"}}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("got asm refs to %v, want %v", refs, wantRefs)
+	}
+}
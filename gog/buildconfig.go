@@ -0,0 +1,178 @@
+package gog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// A BuildConfig is a set of build constraints (build tags, GOOS and
+// GOARCH) to load and graph packages under. Files that are excluded
+// by the default build constraints (such as foo_windows.go on Linux,
+// or files with a //go:build integration line) are only graphed under
+// a BuildConfig that satisfies their constraints.
+type BuildConfig struct {
+	// Name identifies the build configuration in the output. It
+	// defaults to a name derived from the other fields (see String).
+	Name string `json:",omitempty"`
+
+	// Tags are the build tags to consider satisfied.
+	Tags []string `json:",omitempty"`
+
+	// GOOS and GOARCH, if set, are the target operating system and
+	// architecture (they default to the host's).
+	GOOS   string `json:",omitempty"`
+	GOARCH string `json:",omitempty"`
+}
+
+// String returns c's name. If c has no Name, it is derived from c's
+// other fields, as in "windows/amd64,integration" (or "default" if no
+// field is set).
+func (c BuildConfig) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	var parts []string
+	if c.GOOS != "" || c.GOARCH != "" {
+		parts = append(parts, strings.TrimSuffix(c.GOOS+"/"+c.GOARCH, "/"))
+	}
+	parts = append(parts, c.Tags...)
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, ",")
+}
+
+// Apply returns a copy of config that loads packages under c's build
+// constraints.
+func (c BuildConfig) Apply(config *packages.Config) *packages.Config {
+	cfg := *config
+	if c.GOOS != "" || c.GOARCH != "" {
+		cfg.Env = append([]string(nil), cfg.Env...)
+		if cfg.Env == nil {
+			cfg.Env = os.Environ()
+		}
+		if c.GOOS != "" {
+			cfg.Env = append(cfg.Env, "GOOS="+c.GOOS)
+		}
+		if c.GOARCH != "" {
+			cfg.Env = append(cfg.Env, "GOARCH="+c.GOARCH)
+		}
+	}
+	if len(c.Tags) > 0 {
+		cfg.BuildFlags = append(append([]string(nil), cfg.BuildFlags...), "-tags="+strings.Join(c.Tags, ","))
+	}
+	return &cfg
+}
+
+// MergeOutputs merges the outputs of graphing the same packages under
+// each of configs (outputs[i] is the output for configs[i]) into a
+// single sorted output.
+//
+// Defs (and their docs) are identified by their def keys, and refs by
+// their position and target. If a def or ref is only in some of the
+// outputs, its BuildConfigs field lists the names of the
+// configurations whose outputs it is in. If the same def key is
+// defined under several configurations in different places (such as
+// a func F in both f_linux.go and f_windows.go), the first
+// configuration's def is kept, with the AsmBodies of all of them.
+func MergeOutputs(configs []BuildConfig, outputs []*Output) *Output {
+	var merged Output
+	defs := map[string]*Def{}
+	defConfigs := map[string][]int{}
+	refs := map[string]*Ref{}
+	refConfigs := map[string][]int{}
+	docs := map[string]struct{}{}
+	for i, o := range outputs {
+		for _, d := range o.Defs {
+			k := d.DefKey.key()
+			if prev, seen := defs[k]; !seen {
+				defs[k] = d
+				merged.Defs = append(merged.Defs, d)
+			} else {
+				// A func may be declared without a body (and so
+				// have asm bodies) under only some configurations.
+				prev.AsmBodies = mergeAsmBodies(prev.AsmBodies, d.AsmBodies)
+			}
+			defConfigs[k] = appendIndex(defConfigs[k], i)
+		}
+		for _, r := range o.Refs {
+			k := r.key()
+			if _, seen := refs[k]; !seen {
+				refs[k] = r
+				merged.Refs = append(merged.Refs, r)
+			}
+			refConfigs[k] = appendIndex(refConfigs[k], i)
+		}
+		for _, d := range o.Docs {
+			k := d.File + "\x00" + d.Format + "\x00" + spanKey(d.Span)
+			if d.DefKey != nil {
+				// Only keep the docs of the def that was kept.
+				if def := defs[d.DefKey.key()]; def != nil && def.File != d.File {
+					continue
+				}
+				k = d.DefKey.key() + "\x00" + d.Format
+			}
+			if _, seen := docs[k]; seen {
+				continue
+			}
+			docs[k] = struct{}{}
+			merged.Docs = append(merged.Docs, d)
+		}
+	}
+
+	for k, d := range defs {
+		d.BuildConfigs = configNames(configs, defConfigs[k])
+	}
+	for k, r := range refs {
+		r.BuildConfigs = configNames(configs, refConfigs[k])
+	}
+	merged.Sort()
+	return &merged
+}
+
+// appendIndex appends i to the sorted list of indexes is, unless it is
+// already the last element.
+func appendIndex(is []int, i int) []int {
+	if len(is) > 0 && is[len(is)-1] == i {
+		return is
+	}
+	return append(is, i)
+}
+
+// configNames returns the names of the configs at indexes is, or nil
+// if is refers to all of configs.
+func configNames(configs []BuildConfig, is []int) []string {
+	if len(is) == len(configs) {
+		return nil
+	}
+	names := make([]string, len(is))
+	for j, i := range is {
+		names[j] = configs[i].String()
+	}
+	return names
+}
+
+func spanKey(span [2]uint32) string {
+	return fmt.Sprintf("%d-%d", span[0], span[1])
+}
+
+// key returns a string that uniquely identifies k.
+func (k *DefKey) key() string {
+	if k == nil {
+		return ""
+	}
+	return k.UnitType + "\x00" + k.PackageImportPath + "\x00" + strings.Join(k.Path, "\x00")
+}
+
+// key returns a string that uniquely identifies r (disregarding which
+// build configurations it is in).
+func (r *Ref) key() string {
+	isDef := "0"
+	if r.IsDef {
+		isDef = "1"
+	}
+	return strings.Join([]string{r.Unit, r.File, spanKey(r.Span), isDef, r.Def.key()}, "\x00")
+}
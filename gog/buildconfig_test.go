@@ -0,0 +1,81 @@
+package gog
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBuildConfigString(t *testing.T) {
+	tests := []struct {
+		config BuildConfig
+		want   string
+	}{
+		{BuildConfig{}, "default"},
+		{BuildConfig{Name: "win"}, "win"},
+		{BuildConfig{GOOS: "windows"}, "windows"},
+		{BuildConfig{GOOS: "windows", GOARCH: "386"}, "windows/386"},
+		{BuildConfig{GOOS: "linux", Tags: []string{"integration", "foo"}}, "linux,integration,foo"},
+		{BuildConfig{Tags: []string{"integration"}}, "integration"},
+	}
+	for _, test := range tests {
+		if got := test.config.String(); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.config, got, test.want)
+		}
+	}
+}
+
+func TestMergeOutputs(t *testing.T) {
+	def := func(file, name string) *Def {
+		return &Def{Name: name, DefKey: &DefKey{PackageImportPath: "p", Path: []string{name}}, File: file}
+	}
+	ref := func(file string, start uint32, name string) *Ref {
+		return &Ref{Unit: "p", File: file, Span: [2]uint32{start, start + 1}, Def: &DefKey{PackageImportPath: "p", Path: []string{name}}}
+	}
+	doc := func(file, name string) *Doc {
+		return &Doc{DefKey: &DefKey{PackageImportPath: "p", Path: []string{name}}, Unit: "p", Format: "text/plain", Data: name + " in " + file, File: file}
+	}
+
+	configs := []BuildConfig{{GOOS: "linux"}, {GOOS: "windows"}}
+	outputs := []*Output{
+		{
+			Defs: []*Def{def("p.go", "A"), def("p_linux.go", "F")},
+			Refs: []*Ref{ref("p.go", 1, "A"), ref("p_linux.go", 1, "F")},
+			Docs: []*Doc{doc("p.go", "A"), doc("p_linux.go", "F")},
+		},
+		{
+			Defs: []*Def{def("p.go", "A"), def("p_windows.go", "F"), def("p_windows.go", "W")},
+			Refs: []*Ref{ref("p.go", 1, "A"), ref("p_windows.go", 1, "F"), ref("p_windows.go", 5, "W")},
+			Docs: []*Doc{doc("p.go", "A"), doc("p_windows.go", "F"), doc("p_windows.go", "W")},
+		},
+	}
+
+	got := MergeOutputs(configs, outputs)
+
+	wantDefs := []*Def{def("p.go", "A"), def("p_linux.go", "F"), def("p_windows.go", "W")}
+	wantDefs[2].BuildConfigs = []string{"windows"}
+	if !reflect.DeepEqual(got.Defs, wantDefs) {
+		t.Errorf("got defs %s, want %s", toJSON(got.Defs), toJSON(wantDefs))
+	}
+
+	wantRefs := []*Ref{ref("p.go", 1, "A"), ref("p_linux.go", 1, "F"), ref("p_windows.go", 1, "F"), ref("p_windows.go", 5, "W")}
+	wantRefs[1].BuildConfigs = []string{"linux"}
+	wantRefs[2].BuildConfigs = []string{"windows"}
+	wantRefs[3].BuildConfigs = []string{"windows"}
+	if !reflect.DeepEqual(got.Refs, wantRefs) {
+		t.Errorf("got refs %s, want %s", toJSON(got.Refs), toJSON(wantRefs))
+	}
+
+	wantDocs := []*Doc{doc("p.go", "A"), doc("p_linux.go", "F"), doc("p_windows.go", "W")}
+	if !reflect.DeepEqual(got.Docs, wantDocs) {
+		t.Errorf("got docs %s, want %s", toJSON(got.Docs), toJSON(wantDocs))
+	}
+}
+
+func toJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
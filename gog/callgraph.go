@@ -0,0 +1,183 @@
+package gog
+
+import (
+	"fmt"
+	"go/types"
+	"log"
+	"sort"
+
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/callgraph/cha"
+	"golang.org/x/tools/go/callgraph/rta"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+)
+
+// Call graph algorithms (see CallGraph).
+const (
+	// CHA (class hierarchy analysis) assumes that a dynamic call
+	// through an interface or func value may call any method or func
+	// with a matching signature.
+	CHA = "cha"
+
+	// RTA (rapid type analysis) only considers the types and funcs
+	// that are reachable from the funcs in the packages passed to New
+	// (all of which are treated as roots). It is more precise than
+	// CHA but slower.
+	RTA = "rta"
+)
+
+// A Call is an edge in a static call graph: a func or method (Caller)
+// that calls another (Callee).
+type Call struct {
+	Caller *DefKey
+	Callee *DefKey
+}
+
+// CallGraph builds a static call graph of the packages passed to New
+// with the given algorithm (CHA or RTA), and returns the calls whose
+// callers are in those packages, sorted by caller and callee. Each
+// call is only returned once, no matter how many call sites it has.
+//
+// Calls made by a func literal are attributed to the func or method
+// it is declared in. Calls made from package initializers are
+// omitted, as are calls to func literals. Packages that use cgo or
+// have type errors are not analyzed.
+func (g *Grapher) CallGraph(algo string) ([]*Call, error) {
+	prog := ssa.NewProgram(g.fset, 0)
+
+	// Create SSA packages for the packages with syntax (and code),
+	// and then for all of their dependencies (without code).
+	analyzed := make(map[*types.Package]bool)
+	created := make(map[*types.Package]bool)
+	for _, pkg := range g.allPkgs {
+		if !canBuildSSA(pkg.Types) || len(pkg.Errors) > 0 || pkg.IllTyped {
+			log.Printf("warning: not building the call graph of package %s", pkg.ID)
+			continue
+		}
+		prog.CreatePackage(pkg.Types, pkg.Syntax, pkg.TypesInfo, true)
+		created[pkg.Types] = true
+		analyzed[pkg.Types] = true
+	}
+	var createDeps func(pkg *types.Package)
+	createDeps = func(pkg *types.Package) {
+		for _, imp := range pkg.Imports() {
+			if !created[imp] {
+				created[imp] = true
+				prog.CreatePackage(imp, nil, nil, true)
+				createDeps(imp)
+			}
+		}
+	}
+	for _, pkg := range g.allPkgs {
+		if created[pkg.Types] {
+			createDeps(pkg.Types)
+		}
+	}
+	prog.Build()
+
+	inPkgs := make(map[*types.Package]bool, len(g.pkgs))
+	for _, pkg := range g.pkgs {
+		inPkgs[pkg.Types] = analyzed[pkg.Types]
+	}
+
+	var cg *callgraph.Graph
+	switch algo {
+	case CHA:
+		cg = cha.CallGraph(prog)
+	case RTA:
+		var roots []*ssa.Function
+		for fn := range ssautil.AllFunctions(prog) {
+			if fn.Pkg != nil && inPkgs[fn.Pkg.Pkg] && len(fn.Blocks) > 0 {
+				roots = append(roots, fn)
+			}
+		}
+		sort.Sort(functionsByName(roots))
+		cg = rta.Analyze(roots, true).CallGraph
+	default:
+		return nil, fmt.Errorf("unknown call graph algorithm %q (want %q or %q)", algo, CHA, RTA)
+	}
+
+	var calls []*Call
+	seen := make(map[string]bool)
+	err := callgraph.GraphVisitEdges(cg, func(edge *callgraph.Edge) error {
+		caller := sourceFunc(edge.Caller.Func)
+		if caller == nil || caller.Pkg == nil || !inPkgs[caller.Pkg.Pkg] {
+			return nil
+		}
+		callee := edge.Callee.Func
+		if callee.Origin() != nil {
+			callee = callee.Origin()
+		}
+		if callee.Object() == nil {
+			return nil
+		}
+
+		callerKey, _, err := g.defInfo(caller.Object())
+		if err != nil {
+			return err
+		}
+		calleeKey, _, err := g.defInfo(callee.Object())
+		if err != nil {
+			return err
+		}
+		if k := callerKey.key() + "\x00\x00" + calleeKey.key(); !seen[k] {
+			seen[k] = true
+			calls = append(calls, &Call{Caller: callerKey, Callee: calleeKey})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(callsByKey(calls))
+	return calls, nil
+}
+
+// canBuildSSA reports whether SSA code can be built for pkg, which
+// type-checked successfully. Cgo packages are type-checked with fake
+// "C" imports, for which there is no code.
+func canBuildSSA(pkg *types.Package) bool {
+	if pkg.Path() == "unsafe" {
+		return false
+	}
+	for _, imp := range pkg.Imports() {
+		if imp.Path() == "C" {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceFunc returns the func or method declared in source that fn is
+// (or that declares fn, if fn is a func literal), or nil if there is
+// none (for example, if fn is synthetic).
+func sourceFunc(fn *ssa.Function) *ssa.Function {
+	if fn.Origin() != nil {
+		fn = fn.Origin()
+	}
+	for fn.Parent() != nil {
+		fn = fn.Parent()
+	}
+	if fn.Synthetic != "" || fn.Object() == nil {
+		return nil
+	}
+	return fn
+}
+
+type functionsByName []*ssa.Function
+
+func (f functionsByName) Len() int           { return len(f) }
+func (f functionsByName) Less(i, j int) bool { return f[i].String() < f[j].String() }
+func (f functionsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+type callsByKey []*Call
+
+func (c callsByKey) Len() int      { return len(c) }
+func (c callsByKey) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c callsByKey) Less(i, j int) bool {
+	if c[i].Caller.less(c[j].Caller) || c[j].Caller.less(c[i].Caller) {
+		return c[i].Caller.less(c[j].Caller)
+	}
+	return c[i].Callee.less(c[j].Callee)
+}
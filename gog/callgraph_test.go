@@ -0,0 +1,60 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestCallGraph(t *testing.T) {
+	fset := token.NewFileSet()
+	parse := func(name, src string) []*ast.File {
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*ast.File{f}
+	}
+	a := checkPkg(t, fset, "a", parse("a.go", `package a
+type I interface{ M() }
+type T struct{}
+func (T) M() { helper() }
+func helper() {}
+func Call(i I) { i.M() }
+func Lit() { f := func() { helper() }; f() }
+var x = Lit
+`))
+	b := checkPkg(t, fset, "b", parse("b.go", `package b
+import "a"
+func Main() { a.Call(a.T{}) }
+`), a)
+
+	want := []struct{ caller, callee defPath }{
+		{defPath{"a", "Call"}, defPath{"a", "T/M"}},
+		{defPath{"a", "Lit"}, defPath{"a", "helper"}},
+		{defPath{"a", "T/M"}, defPath{"a", "helper"}},
+		{defPath{"b", "Main"}, defPath{"a", "Call"}},
+	}
+	for _, algo := range []string{CHA, RTA} {
+		g := New([]*packages.Package{a, b})
+		calls, err := g.CallGraph(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []struct{ caller, callee defPath }
+		for _, call := range calls {
+			got = append(got, struct{ caller, callee defPath }{call.Caller.defPath(), call.Callee.defPath()})
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got calls %+v, want %+v", algo, got, want)
+		}
+	}
+
+	if _, err := New([]*packages.Package{a}).CallGraph("foo"); err == nil {
+		t.Error("got no error for unknown algorithm")
+	}
+}
@@ -0,0 +1,482 @@
+package gog
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+)
+
+// A cDecl is a top-level declaration in C source (a cgo preamble or a
+// .c or .h file) that Go code in a cgo package can refer to as C.name.
+type cDecl struct {
+	// name is the name that Go code refers to the declaration by:
+	// "struct_T", "union_T" and "enum_T" for the tags of structs,
+	// unions and enums, and the declared name otherwise.
+	name string
+
+	kind string // definfo.Func, Type, Var or Const
+
+	// nameStart and nameEnd are the offsets of the declared name in
+	// the source, and start and end are those of the declaration.
+	nameStart, nameEnd int
+	start, end         int
+
+	// decl is the text of the declaration (without a function's body
+	// or a trailing semicolon), with its whitespace collapsed.
+	decl string
+
+	// definition is whether the declaration defines (rather than just
+	// declares) the name, as a function with a body does and a
+	// prototype does not.
+	definition bool
+}
+
+// scanCDecls returns the top-level declarations in the C source src,
+// in order. It is not a C parser: it blanks out comments, string and
+// character literals and preprocessor directives (recording the
+// object-like macros that they define as consts), and finds the names
+// that the remaining statements declare by their shape. This is
+// enough for the declarations that cgo packages refer to.
+func scanCDecls(src []byte) []*cDecl {
+	text := blankCComments(src)
+	decls := scanCDirectives(text)
+
+	toks := cTokens(text)
+	start := 0  // index of the first token of the current statement
+	depth := 0  // nesting of parentheses, brackets and braces
+	body := -1  // index of the '{' of the function body being scanned
+	extern := 0 // number of open extern "C" { ... } blocks
+	for i := 0; i < len(toks); i++ {
+		switch toks[i].text {
+		case "(", "[", "{":
+			if depth == 0 && toks[i].text == "{" {
+				if i == start+1 && toks[start].text == "extern" {
+					// extern "C" { (the string was blanked out).
+					extern++
+					start = i + 1
+					continue
+				}
+				if i > start && toks[i-1].text == ")" {
+					body = i
+				}
+			}
+			depth++
+		case ")", "]", "}":
+			if depth == 0 {
+				if toks[i].text == "}" && extern > 0 {
+					extern--
+				}
+				start = i + 1
+				continue
+			}
+			depth--
+			if depth == 0 && body >= 0 && toks[i].text == "}" {
+				decls = append(decls, cStatementDecls(text, toks[start:i+1], toks[i].pos+1, body-start)...)
+				start, body = i+1, -1
+			}
+		case ";":
+			if depth == 0 {
+				decls = append(decls, cStatementDecls(text, toks[start:i], toks[i].pos+1, -1)...)
+				start = i + 1
+			}
+		}
+	}
+
+	// The directives were scanned before the statements.
+	sort.Stable(cDeclsByPos(decls))
+	return decls
+}
+
+type cDeclsByPos []*cDecl
+
+func (d cDeclsByPos) Len() int           { return len(d) }
+func (d cDeclsByPos) Less(i, j int) bool { return d[i].start < d[j].start }
+func (d cDeclsByPos) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// blankCComments returns a copy of src in which the comments and the
+// string and character literals are replaced by spaces, except for
+// their newlines, so that offsets in the copy are offsets in src.
+func blankCComments(src []byte) []byte {
+	text := make([]byte, len(src))
+	copy(text, src)
+	blank := func(from, to int) {
+		for i := from; i < to && i < len(text); i++ {
+			if text[i] != '\n' {
+				text[i] = ' '
+			}
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '/' && i+1 < len(text) && text[i+1] == '/':
+			end := bytes.IndexByte(text[i:], '\n')
+			if end < 0 {
+				end = len(text) - i
+			}
+			blank(i, i+end)
+			i += end
+		case text[i] == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := bytes.Index(text[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(text) - i - 4 // unterminated
+			}
+			blank(i, i+end+4)
+			i += end + 3
+		case text[i] == '"' || text[i] == '\'':
+			j := i + 1
+			for j < len(text) && text[j] != text[i] && text[j] != '\n' {
+				if text[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			blank(i, j+1)
+			i = j
+		}
+	}
+	return text
+}
+
+// scanCDirectives returns the consts that the object-like macros
+// defined by the preprocessor directives in text declare, and blanks
+// out the directives.
+func scanCDirectives(text []byte) []*cDecl {
+	var decls []*cDecl
+	lineEnd := func(i int) int {
+		if nl := bytes.IndexByte(text[i:], '\n'); nl >= 0 {
+			return i + nl
+		}
+		return len(text)
+	}
+	for lineStart := 0; lineStart < len(text); {
+		end := lineEnd(lineStart)
+		i := lineStart
+		for i < end && (text[i] == ' ' || text[i] == '\t') {
+			i++
+		}
+		if i < end && text[i] == '#' {
+			// A directive continues on the next line if its line ends
+			// with a backslash.
+			for end < len(text) && bytes.HasSuffix(bytes.TrimRight(text[i:end], " \t\r"), []byte(`\`)) {
+				end = lineEnd(end + 1)
+			}
+			if d := cMacroDecl(text, i, end); d != nil {
+				decls = append(decls, d)
+			}
+			for j := i; j < end; j++ {
+				if text[j] != '\n' {
+					text[j] = ' '
+				}
+			}
+		}
+		lineStart = end + 1
+	}
+	return decls
+}
+
+// cMacroDecl returns the const declared by the directive text[start:end]
+// if it defines an object-like macro, or nil.
+func cMacroDecl(text []byte, start, end int) *cDecl {
+	toks := cTokens(text[start:end])
+	if len(toks) < 3 || toks[1].text != "define" || !isCIdent(toks[2].text) {
+		return nil
+	}
+	name := toks[2]
+	if len(toks) > 3 && toks[3].text == "(" && toks[3].pos == name.pos+len(name.text) {
+		// A function-like macro, which Go code can't refer to.
+		return nil
+	}
+	return &cDecl{
+		name:       name.text,
+		kind:       definfo.Const,
+		nameStart:  start + name.pos,
+		nameEnd:    start + name.pos + len(name.text),
+		start:      start,
+		end:        end,
+		decl:       collapseCSpace(strings.Replace(string(text[start:end]), "\\\n", " ", -1)),
+		definition: true,
+	}
+}
+
+// A cToken is an identifier, number or punctuation character in C
+// source, at the offset pos.
+type cToken struct {
+	text string
+	pos  int
+}
+
+// cTokens splits text, which has no comments or literals, into tokens.
+func cTokens(text []byte) []cToken {
+	var toks []cToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v' || c == '\\':
+			i++
+		case isCIdentByte(c):
+			j := i + 1
+			for j < len(text) && (isCIdentByte(text[j]) || text[j] == '.' && c >= '0' && c <= '9') {
+				j++
+			}
+			toks = append(toks, cToken{string(text[i:j]), i})
+			i = j
+		default:
+			toks = append(toks, cToken{string(c), i})
+			i++
+		}
+	}
+	return toks
+}
+
+func isCIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// isCIdent reports whether s is an identifier that is not a keyword.
+func isCIdent(s string) bool {
+	return s != "" && isCIdentByte(s[0]) && (s[0] < '0' || s[0] > '9') && !cKeywords[s]
+}
+
+// cKeywords are the C keywords (and common compiler extensions) that
+// may appear in the declarations that cgo packages use.
+var cKeywords = map[string]bool{
+	"auto": true, "char": true, "const": true, "double": true, "enum": true,
+	"extern": true, "float": true, "inline": true, "int": true, "long": true,
+	"register": true, "restrict": true, "short": true, "signed": true,
+	"static": true, "struct": true, "typedef": true, "union": true,
+	"unsigned": true, "void": true, "volatile": true, "_Bool": true,
+	"_Complex": true, "_Noreturn": true, "_Thread_local": true,
+	"__inline": true, "__inline__": true, "__restrict": true,
+	"__restrict__": true, "__const": true, "__volatile__": true,
+	"__extension__": true,
+}
+
+// cAttributes are the compiler extensions that are followed by a
+// parenthesized argument list that is not part of a declarator.
+var cAttributes = map[string]bool{
+	"__attribute__": true, "__attribute": true, "__declspec": true,
+	"__asm__": true, "__asm": true, "asm": true, "_Alignas": true,
+}
+
+// cStatementDecls returns the declarations in the top-level statement
+// toks (without its semicolon), which ends at the offset end. If the
+// statement is a function definition, body is the index in toks of
+// the '{' of the function's body; otherwise it is -1.
+func cStatementDecls(text []byte, toks []cToken, end, body int) []*cDecl {
+	if len(toks) == 0 {
+		return nil
+	}
+	start := toks[0].pos
+	declEnd := end
+	if body >= 0 {
+		declEnd = toks[body].pos
+		toks = toks[:body]
+	}
+	decl := collapseCSpace(strings.TrimSuffix(strings.TrimSpace(string(text[start:declEnd])), ";"))
+
+	var decls []*cDecl
+	add := func(name string, tok cToken, kind string, definition bool) {
+		decls = append(decls, &cDecl{
+			name:       name,
+			kind:       kind,
+			nameStart:  tok.pos,
+			nameEnd:    tok.pos + len(tok.text),
+			start:      start,
+			end:        end,
+			decl:       decl,
+			definition: definition,
+		})
+	}
+
+	// The tags of structs, unions and enums, and the constants of
+	// enums.
+	for i := 0; i+1 < len(toks); i++ {
+		kw := toks[i].text
+		if kw != "struct" && kw != "union" && kw != "enum" {
+			continue
+		}
+		tag, open := toks[i+1], i+1
+		if isCIdent(tag.text) {
+			open = i + 2
+			hasBody := open < len(toks) && toks[open].text == "{"
+			if hasBody || len(toks) == 2 {
+				// A definition, or a forward declaration.
+				add(kw+"_"+tag.text, tag, definfo.Type, hasBody)
+			}
+		}
+		if kw == "enum" && open < len(toks) && toks[open].text == "{" {
+			depth := 0
+			for j := open; j < len(toks); j++ {
+				switch toks[j].text {
+				case "(", "[", "{":
+					depth++
+				case ")", "]", "}":
+					depth--
+				}
+				if depth == 0 {
+					break
+				}
+				if depth == 1 && (toks[j].text == "{" || toks[j].text == ",") && j+1 < len(toks) && isCIdent(toks[j+1].text) {
+					add(toks[j+1].text, toks[j+1], definfo.Const, true)
+				}
+			}
+		}
+	}
+
+	// The declarators, outside of the bodies of structs, unions and
+	// enums and of attributes.
+	var flat []cToken
+	braces := 0
+	for i := 0; i < len(toks); i++ {
+		switch t := toks[i].text; {
+		case t == "{":
+			braces++
+		case t == "}":
+			braces--
+		case braces > 0:
+		case cAttributes[t]:
+			if i+1 < len(toks) && toks[i+1].text == "(" {
+				i = matchingCParen(toks, i+1)
+			}
+		default:
+			flat = append(flat, toks[i])
+		}
+	}
+	if len(flat) == 0 {
+		return decls
+	}
+	typedef := flat[0].text == "typedef"
+	extern := flat[0].text == "extern"
+
+	for first, seg := true, flat; len(seg) > 0; first = false {
+		// Split off the next declarator (which ends at a comma that
+		// is not in parentheses or brackets).
+		next, depth := len(seg), 0
+		for i, t := range seg {
+			switch t.text {
+			case "(", "[":
+				depth++
+			case ")", "]":
+				depth--
+			case ",":
+				if depth == 0 && next == len(seg) {
+					next = i
+				}
+			}
+		}
+		decl := seg[:next]
+		if next < len(seg) {
+			seg = seg[next+1:]
+		} else {
+			seg = nil
+		}
+
+		name, isFunc, ok := cDeclaratorName(decl, first)
+		if !ok {
+			continue
+		}
+		switch {
+		case typedef:
+			add(name.text, name, definfo.Type, true)
+		case isFunc:
+			add(name.text, name, definfo.Func, body >= 0)
+		default:
+			add(name.text, name, definfo.Var, !extern)
+		}
+	}
+	return decls
+}
+
+// cDeclaratorName returns the name that the declarator toks declares,
+// and whether it declares a function. If first is true, toks is the
+// first declarator of its statement and so begins with the type.
+func cDeclaratorName(toks []cToken, first bool) (name cToken, isFunc bool, ok bool) {
+	// Omit the initializer.
+	depth := 0
+	for i, t := range toks {
+		if t.text == "=" && depth == 0 {
+			toks = toks[:i]
+			break
+		}
+		switch t.text {
+		case "(", "[":
+			depth++
+		case ")", "]":
+			depth--
+		}
+	}
+
+	for i, t := range toks {
+		if t.text != "(" {
+			continue
+		}
+		if i+1 < len(toks) && (toks[i+1].text == "*" || toks[i+1].text == "^") {
+			// A pointer to a function (or array), such as (*name)(int).
+			for _, t := range toks[i+1:] {
+				if isCIdent(t.text) {
+					return t, false, true
+				}
+				if t.text != "*" && t.text != "^" {
+					break
+				}
+			}
+			return cToken{}, false, false
+		}
+		if i > 0 && isCIdent(toks[i-1].text) && (!first || i > 1) && !isCTag(toks, i-1) {
+			return toks[i-1], true, true
+		}
+		return cToken{}, false, false
+	}
+
+	// The name is the last identifier, outside of array brackets.
+	depth = 0
+	for i, t := range toks {
+		switch t.text {
+		case "[":
+			depth++
+		case "]":
+			depth--
+		default:
+			if depth == 0 && isCIdent(t.text) && (!first || i > 0) && !isCTag(toks, i) {
+				name, ok = t, true
+			}
+		}
+	}
+	return name, false, ok
+}
+
+// isCTag reports whether toks[i] is the tag of a struct, union or enum.
+func isCTag(toks []cToken, i int) bool {
+	if i == 0 {
+		return false
+	}
+	switch toks[i-1].text {
+	case "struct", "union", "enum":
+		return true
+	}
+	return false
+}
+
+// matchingCParen returns the index of the parenthesis in toks that
+// closes the one at open (or the last index, if it is not closed).
+func matchingCParen(toks []cToken, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		switch toks[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(toks) - 1
+}
+
+func collapseCSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
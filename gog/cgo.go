@@ -1,7 +1,18 @@
 package gog
 
 import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+
+	"golang.org/x/tools/go/packages"
 )
 
 // isCgoUnsafePointerConversionError checks if this is an error like the kind
@@ -23,3 +34,185 @@ func isCgoConversionToInvalidTypeError(err error) bool {
 	s := err.Error()
 	return strings.Contains(s, "cannot convert ") && strings.HasSuffix(s, " to invalid type")
 }
+
+// CUnitType is the unit type of the C declarations of a cgo package
+// (see DefKey.UnitType).
+const CUnitType = "C"
+
+// cgoDefsAndRefs returns the defs of the C declarations of pkg, if it
+// is a cgo package, and the refs to them: the refs to their
+// definitions and those from the C.name selectors in pkg's files. The
+// C declarations are those in the cgo preambles (the comments that
+// precede import "C") and in the .c and .h files among pkg's
+// OtherFiles. If a name is declared more than once (such as a
+// function that is declared in a .h file and defined in a .c file),
+// its def is its first definition, or its first declaration if it has
+// no definition.
+func (g *Grapher) cgoDefsAndRefs(pkg *packages.Package, unit string) ([]*Def, []*Ref, error) {
+	type cSymbol struct {
+		*cDecl
+		file string
+	}
+	symbols := make(map[string]*cSymbol)
+	var names []string
+	addDecls := func(file string, decls []*cDecl, offset int) {
+		for _, d := range decls {
+			d.nameStart += offset
+			d.nameEnd += offset
+			d.start += offset
+			d.end += offset
+			prev, seen := symbols[d.name]
+			if !seen {
+				names = append(names, d.name)
+			}
+			if !seen || (d.definition && !prev.definition) {
+				symbols[d.name] = &cSymbol{d, file}
+			}
+		}
+	}
+
+	isCgo := false
+	for _, f := range pkg.Syntax {
+		preamble, importsC := cgoPreamble(f)
+		if !importsC {
+			continue
+		}
+		isCgo = true
+		if preamble == nil {
+			continue
+		}
+		tf := g.fset.File(f.Pos())
+		src, err := ioutil.ReadFile(tf.Name())
+		if err != nil {
+			return nil, nil, err
+		}
+		start, end := tf.Offset(preamble.Pos()), tf.Offset(preamble.End())
+		if end > len(src) {
+			return nil, nil, fmt.Errorf("cgo preamble of %s is past the end of the file", tf.Name())
+		}
+		addDecls(tf.Name(), scanCDecls(preambleText(src[start:end], preamble, start, tf)), start)
+	}
+	if !isCgo {
+		return nil, nil, nil
+	}
+	for _, file := range pkg.OtherFiles {
+		if ext := filepath.Ext(file); ext != ".c" && ext != ".h" {
+			continue
+		}
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		addDecls(file, scanCDecls(src), 0)
+	}
+
+	var defs []*Def
+	var refs []*Ref
+	keys := make(map[string]*DefKey, len(names))
+	for _, name := range names {
+		s := symbols[name]
+		key := &DefKey{PackageImportPath: unit, Path: []string{name}, UnitType: CUnitType}
+		keys[name] = key
+		defs = append(defs, &Def{
+			Name:      name,
+			DefKey:    key,
+			File:      s.file,
+			IdentSpan: [2]uint32{uint32(s.nameStart), uint32(s.nameEnd)},
+			DeclSpan:  [2]uint32{uint32(s.start), uint32(s.end)},
+			DefInfo: definfo.DefInfo{
+				PkgScope: true,
+				PkgName:  "C",
+				Kind:     s.kind,
+				Decl:     s.decl,
+			},
+		})
+		refs = append(refs, &Ref{
+			Unit:  unit,
+			File:  s.file,
+			Span:  [2]uint32{uint32(s.nameStart), uint32(s.nameEnd)},
+			Def:   key,
+			IsDef: true,
+		})
+	}
+
+	for _, f := range pkg.Syntax {
+		called := make(map[*ast.Ident]bool)
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if ident := targetIdent(pkg.TypesInfo, n.Fun); ident != nil {
+					called[ident] = true
+				}
+			case *ast.SelectorExpr:
+				x, ok := n.X.(*ast.Ident)
+				if !ok {
+					break
+				}
+				if pkgName, ok := pkg.TypesInfo.Uses[x].(*types.PkgName); !ok || pkgName.Imported().Path() != "C" {
+					break
+				}
+				key, ok := keys[n.Sel.Name]
+				if !ok {
+					// A C type (such as C.int) or a function (such as
+					// C.CString) that cgo provides, or a declaration
+					// in a header outside of the package.
+					break
+				}
+				kind := RefRead
+				if symbols[n.Sel.Name].kind == definfo.Type {
+					kind = RefType
+				} else if called[n.Sel] {
+					kind = RefCall
+				}
+				refs = append(refs, &Ref{
+					Unit: unit,
+					File: g.fset.Position(n.Sel.Pos()).Filename,
+					Span: makeSpan(g.fset, n.Sel),
+					Def:  key,
+					Kind: kind,
+				})
+			}
+			return true
+		})
+	}
+	return defs, refs, nil
+}
+
+// cgoPreamble returns the cgo preamble of f (the doc comment of its
+// import "C"), if it has one, and whether f imports "C".
+func cgoPreamble(f *ast.File) (*ast.CommentGroup, bool) {
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ImportSpec)
+			if path, err := strconv.Unquote(spec.Path.Value); err != nil || path != "C" {
+				continue
+			}
+			if spec.Doc == nil && !gen.Lparen.IsValid() {
+				return gen.Doc, true
+			}
+			return spec.Doc, true
+		}
+	}
+	return nil, false
+}
+
+// preambleText returns a copy of src, the source of the cgo preamble
+// comments, that starts at the offset start in the file tf, with the
+// comment markers replaced by spaces, so that it can be scanned as C
+// source.
+func preambleText(src []byte, preamble *ast.CommentGroup, start int, tf *token.File) []byte {
+	text := make([]byte, len(src))
+	copy(text, src)
+	for _, c := range preamble.List {
+		i := tf.Offset(c.Slash) - start
+		copy(text[i:], "  ")
+		if strings.HasPrefix(c.Text, "/*") {
+			copy(text[i+len(c.Text)-2:], "  ")
+		}
+	}
+	return text
+}
@@ -0,0 +1,228 @@
+package gog
+
+import (
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestScanCDecls(t *testing.T) {
+	src := `#include <stdio.h>
+#define MAX 10 /* the max */
+#define SQUARE(x) ((x)*(x))
+#define LONG \
+	20
+
+// add adds.
+int add(int a, int b);
+static int twice(int x) { return 2*x; }
+extern int counter;
+const char *name = "a; b {";
+int xs[MAX], *p;
+
+struct point { int x, y; };
+struct opaque;
+typedef struct point point_t;
+typedef int (*callback)(void *data);
+typedef enum color { RED, GREEN = 2, BLUE } color_t;
+union value { int i; double d; };
+void __attribute__((noreturn)) die(const char *msg);
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+unsigned long hash(const char *s);
+#ifdef __cplusplus
+}
+#endif
+`
+	type decl struct {
+		name, kind string
+		definition bool
+	}
+	want := []decl{
+		{"MAX", definfo.Const, true},
+		{"LONG", definfo.Const, true},
+		{"add", definfo.Func, false},
+		{"twice", definfo.Func, true},
+		{"counter", definfo.Var, false},
+		{"name", definfo.Var, true},
+		{"xs", definfo.Var, true},
+		{"p", definfo.Var, true},
+		{"struct_point", definfo.Type, true},
+		{"struct_opaque", definfo.Type, false},
+		{"point_t", definfo.Type, true},
+		{"callback", definfo.Type, true},
+		{"enum_color", definfo.Type, true},
+		{"RED", definfo.Const, true},
+		{"GREEN", definfo.Const, true},
+		{"BLUE", definfo.Const, true},
+		{"color_t", definfo.Type, true},
+		{"union_value", definfo.Type, true},
+		{"die", definfo.Func, false},
+		{"hash", definfo.Func, false},
+	}
+
+	decls := scanCDecls([]byte(src))
+	var got []decl
+	for _, d := range decls {
+		got = append(got, decl{d.name, d.kind, d.definition})
+		if name := src[d.nameStart:d.nameEnd]; !strings.HasSuffix(d.name, name) {
+			t.Errorf("%s: name span is %q", d.name, name)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got decls %v, want %v", got, want)
+	}
+
+	wantDecl := map[string]string{
+		"MAX":      "#define MAX 10",
+		"LONG":     "#define LONG 20",
+		"twice":    "static int twice(int x)",
+		"callback": "typedef int (*callback)(void *data)",
+	}
+	for _, d := range decls {
+		if w, ok := wantDecl[d.name]; ok && d.decl != w {
+			t.Errorf("%s: got decl %q, want %q", d.name, d.decl, w)
+		}
+	}
+}
+
+func TestCgo(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	goSrc := `package c
+
+// #include "c.h"
+// static int twice(int x) { return 2*x; }
+import "C"
+
+func F(p *C.struct_point) int {
+	var n C.int = C.twice(C.add(p.x, C.MAX))
+	return int(n)
+}
+`
+	hSrc := `#define MAX 10
+struct point { int x, y; };
+int add(int a, int b);
+`
+	cSrc := `#include "c.h"
+int add(int a, int b) { return a + b; }
+`
+	goFile := write("c.go", goSrc)
+	hFile := write("c.h", hSrc)
+	cFile := write("c.c", cSrc)
+
+	pkg := &packages.Package{ID: "c", PkgPath: "c", Fset: token.NewFileSet(), OtherFiles: []string{cFile, hFile}}
+	if err := CheckFiles(nil, pkg, []string{goFile}); err != nil {
+		t.Fatal(err)
+	}
+	g := New([]*packages.Package{pkg})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	type def struct {
+		file, ident, kind string
+	}
+	srcs := map[string]string{goFile: goSrc, hFile: hSrc, cFile: cSrc}
+	want := map[string]def{
+		"twice":        {goFile, "twice", definfo.Func},
+		"MAX":          {hFile, "MAX", definfo.Const},
+		"struct_point": {hFile, "point", definfo.Type},
+		"add":          {cFile, "add", definfo.Func}, // the definition
+	}
+	got := make(map[string]def)
+	for _, d := range g.Defs {
+		if d.UnitType != CUnitType {
+			continue
+		}
+		if d.PackageImportPath != "c" {
+			t.Errorf("%s: got package %q, want %q", d.Name, d.PackageImportPath, "c")
+		}
+		got[d.Name] = def{d.File, srcs[d.File][d.IdentSpan[0]:d.IdentSpan[1]], d.Kind}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got C defs %v, want %v", got, want)
+	}
+
+	refs := make(map[string]string)
+	for _, ref := range g.Refs {
+		if ref.Def.UnitType == CUnitType && !ref.IsDef {
+			if ref.File != goFile {
+				t.Errorf("ref to %v in %s, want in %s", ref.Def, ref.File, goFile)
+				continue
+			}
+			refs[goSrc[ref.Span[0]:ref.Span[1]]] = ref.Kind
+		}
+	}
+	wantRefs := map[string]string{
+		"struct_point": RefType,
+		"twice":        RefCall,
+		"add":          RefCall,
+		"MAX":          RefRead,
+	}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("got refs to C defs %v, want %v", refs, wantRefs)
+	}
+}
+
+// TestCheckFilesImports tests that CheckFiles resolves the imports of
+// cgo files that go/packages omits (when cgo is disabled), and that it
+// records type errors.
+func TestCheckFilesImports(t *testing.T) {
+	dir := t.TempDir()
+	goFile := filepath.Join(dir, "c.go")
+	const src = `package c
+
+// int add(int a, int b) { return a + b; }
+import "C"
+
+import "fmt"
+
+func Add(a, b int) int { return int(C.add(C.int(a), C.int(b))) }
+
+func Print() { fmt.Println(Add(1, 2), undefined) }
+`
+	if err := ioutil.WriteFile(goFile, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := &packages.Package{ID: "c", PkgPath: "c", Fset: token.NewFileSet()}
+	if err := CheckFiles(&packages.Config{Dir: dir}, pkg, []string{goFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	uses := make(map[string]string)
+	for ident, obj := range pkg.TypesInfo.Uses {
+		if obj.Pkg() != nil {
+			uses[ident.Name] = obj.Pkg().Path()
+		}
+	}
+	for name, want := range map[string]string{"fmt": "c", "Println": "fmt", "Add": "c"} {
+		if got := uses[name]; got != want {
+			t.Errorf("got %s used from package %q, want %q", name, got, want)
+		}
+	}
+
+	if len(pkg.TypeErrors) != 1 || pkg.TypeErrors[0].Msg != "undefined: undefined" {
+		t.Errorf("got type errors %v, want only undefined: undefined", pkg.TypeErrors)
+	}
+	if len(pkg.Errors) != 1 || pkg.Errors[0].Kind != packages.TypeError {
+		t.Errorf("got errors %v, want 1 type error", pkg.Errors)
+	}
+}
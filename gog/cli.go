@@ -1,56 +1,39 @@
 package gog
 
 import (
-	"fmt"
 	"log"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 // Main is like calling the 'gog' program.
-func Main(config *loader.Config, args []string) (*Output, error) {
-	var importUnsafe bool
-	for _, a := range args {
-		if a == "unsafe" {
-			importUnsafe = true
-			break
-		}
-	}
-
-	extraArgs, err := config.FromArgs(args, true)
+func Main(config *packages.Config, args []string) (*Output, error) {
+	pkgs, err := packages.Load(config, args...)
 	if err != nil {
-		log.Fatal(err)
-	}
-	if len(extraArgs) > 0 {
-		return nil, fmt.Errorf("extra args after pkgs list")
+		return nil, err
 	}
 
-	if importUnsafe {
-		// Special-case "unsafe" because go/loader does not let you load it
-		// directly.
-		if config.ImportPkgs == nil {
-			config.ImportPkgs = make(map[string]bool)
+	graphPkgs := PackagesToGraph(pkgs)
+	for _, pkg := range graphPkgs {
+		if pkg.PkgPath == "unsafe" {
+			// Special-case "unsafe" because go/packages does not
+			// type-check its source.
+			if err := CheckFiles(config, pkg, pkg.GoFiles); err != nil {
+				return nil, err
+			}
 		}
-		config.ImportPkgs["unsafe"] = true
 	}
 
-	prog, err := config.Load()
-	if err != nil {
-		return nil, err
-	}
-
-	g := New(prog)
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, err := range pkg.Errors {
+			log.Printf("warning: %s", err)
+		}
+	})
 
-	var pkgs []*loader.PackageInfo
-	pkgs = append(pkgs, prog.Created...)
-	for _, pkg := range prog.Imported {
-		pkgs = append(pkgs, pkg)
-	}
+	g := New(graphPkgs)
 
-	for _, pkg := range pkgs {
-		if err := g.Graph(pkg); err != nil {
-			return nil, err
-		}
+	if err := g.GraphAll(); err != nil {
+		return nil, err
 	}
 
 	return &g.Output, nil
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"go/build"
 	"log"
 	"os"
 	"strings"
@@ -31,8 +30,7 @@ func main() {
 	config := &gog.Default
 
 	if tags := strings.Split(*buildTags, ","); *buildTags != "" {
-		build.Default.BuildTags = tags
-		config.Build.BuildTags = tags
+		config.BuildFlags = append(config.BuildFlags, "-tags="+strings.Join(tags, ","))
 		log.Printf("Using build tags: %q", tags)
 	}
 
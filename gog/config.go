@@ -1,15 +1,11 @@
 package gog
 
-import (
-	"go/build"
+import "golang.org/x/tools/go/packages"
 
-	"go/types"
+// LoadMode is the go/packages load mode that the grapher needs.
+const LoadMode = packages.NeedName | packages.NeedFiles | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
 
-	"golang.org/x/tools/go/loader"
-)
-
-var Default = loader.Config{
-	TypeChecker: types.Config{FakeImportC: true},
-	Build:       &build.Default,
-	AllowErrors: true,
+var Default = packages.Config{
+	Mode:  LoadMode,
+	Tests: true,
 }
@@ -9,7 +9,7 @@ import (
 	"strings"
 	"testing"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 var identFile = flag.String("test.idents", "", "print out all idents in files whose name contains this substring")
@@ -22,18 +22,21 @@ func TestIdentCoverage(t *testing.T) {
 	}
 	sort.Strings(files)
 
-	g, prog := graphPkgFromFiles(t, "testdata", files)
+	g, pkgs := graphPkgFromFiles(t, "testdata", files)
 
-	checkAllIdents(t, g, prog)
+	checkAllIdents(t, g, pkgs)
 }
 
 func (s *DefKey) defPath() defPath {
+	if s.UnitType != "" {
+		return defPath{s.UnitType + ":" + s.PackageImportPath, strings.Join(s.Path, "/")}
+	}
 	return defPath{s.PackageImportPath, strings.Join(s.Path, "/")}
 }
 
 // checkAllIdents checks that every *ast.Ident has a corresponding Def or
 // Ref.
-func checkAllIdents(t *testing.T, g *Grapher, prog *loader.Program) {
+func checkAllIdents(t *testing.T, g *Grapher, pkgs []*packages.Package) {
 	defs := make(map[defPath]struct{}, len(g.Defs))
 	byIdentPos := make(map[identPos]interface{}, len(g.Defs)+len(g.Refs))
 	for _, s := range g.Defs {
@@ -43,11 +46,11 @@ func checkAllIdents(t *testing.T, g *Grapher, prog *loader.Program) {
 	for _, r := range g.Refs {
 		byIdentPos[identPos{r.File, r.Span[0], r.Span[1]}] = r
 	}
-	for _, pkg := range prog.Created {
-		for _, f := range pkg.Files {
-			printAll := *identFile != "" && strings.Contains(prog.Fset.Position(f.Name.Pos()).Filename, *identFile)
-			checkIdents(t, prog.Fset, f, byIdentPos, defs, g, printAll)
-			checkUnique(t, g, prog)
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Syntax {
+			printAll := *identFile != "" && strings.Contains(pkg.Fset.Position(f.Name.Pos()).Filename, *identFile)
+			checkIdents(t, pkg.Fset, f, byIdentPos, defs, g, printAll)
+			checkUnique(t, g)
 		}
 	}
 }
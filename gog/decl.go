@@ -0,0 +1,159 @@
+package gog
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// declString returns the Go source declaration of obj, whose
+// declaration node (found by NewDef) is declNode, pretty-printed like
+// gofmt prints it. Doc comments, comments and func bodies are omitted.
+//
+// Funcs, methods and types are printed from their source, so the
+// declaration includes parameter names, struct fields and interface
+// methods. Other defs (such as consts in iota blocks or vars that are
+// declared by assignments) are printed from their types.
+func (g *Grapher) declString(obj types.Object, declNode ast.Node) string {
+	switch node := declNode.(type) {
+	case *ast.FuncDecl:
+		return g.printNode(&ast.FuncDecl{
+			Recv: uncommentedFields(node.Recv),
+			Name: node.Name,
+			Type: uncommentedExpr(node.Type).(*ast.FuncType),
+		})
+	case *ast.TypeSpec:
+		spec := &ast.TypeSpec{
+			Name:       node.Name,
+			TypeParams: uncommentedFields(node.TypeParams),
+			Assign:     node.Assign,
+			Type:       uncommentedExpr(node.Type),
+		}
+		return g.printNode(&ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{spec}})
+	case *ast.Field:
+		if v, ok := obj.(*types.Var); ok && v.IsField() {
+			// A struct field, printed as it is in the struct (with
+			// only its own name, if the field declares several).
+			decl := g.printNode(uncommentedExpr(node.Type))
+			if len(node.Names) > 0 {
+				decl = obj.Name() + " " + decl
+			}
+			if node.Tag != nil {
+				decl += " " + node.Tag.Value
+			}
+			return decl
+		}
+		if ft, ok := node.Type.(*ast.FuncType); ok {
+			if iface, ok := recvType(obj); ok {
+				// An interface method.
+				return "func (" + iface + ") " + obj.Name() + strings.TrimPrefix(g.printNode(uncommentedExpr(ft)), "func")
+			}
+		}
+	}
+
+	qualifier := nameQualifier(obj.Pkg())
+	typ := func() string { return types.TypeString(obj.Type(), qualifier) }
+
+	switch obj := obj.(type) {
+	case *types.Const:
+		decl := "const " + obj.Name()
+		if basic, ok := obj.Type().(*types.Basic); !ok || basic.Info()&types.IsUntyped == 0 {
+			decl += " " + typ()
+		}
+		return decl + " = " + obj.Val().String()
+	case *types.Var:
+		if obj.IsField() {
+			if obj.Embedded() {
+				return typ()
+			}
+			return obj.Name() + " " + typ()
+		}
+		return "var " + obj.Name() + " " + typ()
+	case *types.Func:
+		// A method of an interface that is not named.
+		return "func " + obj.Name() + strings.TrimPrefix(typ(), "func")
+	case *types.TypeName:
+		if tp, ok := obj.Type().(*types.TypeParam); ok {
+			return "type " + obj.Name() + " " + types.TypeString(tp.Constraint(), qualifier)
+		}
+		return "type " + obj.Name() + " " + types.TypeString(obj.Type().Underlying(), qualifier)
+	}
+	return ""
+}
+
+// nameQualifier returns a types.Qualifier that qualifies the packages
+// other than pkg by their names.
+func nameQualifier(pkg *types.Package) types.Qualifier {
+	return func(other *types.Package) string {
+		if other == pkg {
+			return ""
+		}
+		return other.Name()
+	}
+}
+
+// recvType returns the name of the named type that obj, if it is a
+// method, is declared on.
+func recvType(obj types.Object) (string, bool) {
+	f, ok := obj.(*types.Func)
+	if !ok {
+		return "", false
+	}
+	recv := f.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return "", false
+	}
+	named, ok := recv.Type().(*types.Named)
+	if !ok {
+		return "", false
+	}
+	return named.Obj().Name(), true
+}
+
+// printNode pretty-prints node, which was copied from (and so has the
+// positions of) the source.
+func (g *Grapher) printNode(node ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, g.fset, node); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// uncommentedExpr returns a copy of the type expression x without the
+// comments of its fields (which go/printer prints), recursively.
+func uncommentedExpr(x ast.Expr) ast.Expr {
+	switch x := x.(type) {
+	case *ast.StructType:
+		return &ast.StructType{Struct: x.Struct, Fields: uncommentedFields(x.Fields)}
+	case *ast.InterfaceType:
+		return &ast.InterfaceType{Interface: x.Interface, Methods: uncommentedFields(x.Methods)}
+	case *ast.FuncType:
+		return &ast.FuncType{Func: x.Func, TypeParams: uncommentedFields(x.TypeParams), Params: uncommentedFields(x.Params), Results: uncommentedFields(x.Results)}
+	case *ast.StarExpr:
+		return &ast.StarExpr{Star: x.Star, X: uncommentedExpr(x.X)}
+	case *ast.ArrayType:
+		return &ast.ArrayType{Lbrack: x.Lbrack, Len: x.Len, Elt: uncommentedExpr(x.Elt)}
+	case *ast.MapType:
+		return &ast.MapType{Map: x.Map, Key: uncommentedExpr(x.Key), Value: uncommentedExpr(x.Value)}
+	case *ast.ChanType:
+		return &ast.ChanType{Begin: x.Begin, Arrow: x.Arrow, Dir: x.Dir, Value: uncommentedExpr(x.Value)}
+	case *ast.ParenExpr:
+		return &ast.ParenExpr{Lparen: x.Lparen, X: uncommentedExpr(x.X), Rparen: x.Rparen}
+	}
+	return x
+}
+
+func uncommentedFields(fields *ast.FieldList) *ast.FieldList {
+	if fields == nil {
+		return nil
+	}
+	fields2 := &ast.FieldList{Opening: fields.Opening, Closing: fields.Closing}
+	for _, f := range fields.List {
+		fields2.List = append(fields2.List, &ast.Field{Names: f.Names, Type: uncommentedExpr(f.Type), Tag: f.Tag})
+	}
+	return fields2
+}
@@ -0,0 +1,94 @@
+package gog
+
+import (
+	"testing"
+)
+
+func TestDecl(t *testing.T) {
+	src := `package p
+
+type Reader interface {
+	Read(p []byte) (n int, err error)
+}
+
+// S is a struct.
+type S struct {
+	// A is a field.
+	A int
+	r Reader // r is a reader.
+	Reader
+	B, C string ` + "`json:\"b\"`" + `
+	F    func(x int) error
+}
+
+// I is an interface.
+type I interface {
+	Reader
+	M(x, y int) (n int, err error)
+}
+
+// M is a method.
+func (s *S) M(x, y int) (n int, err error) {
+	var local []S
+	_ = local
+	return 0, nil
+}
+
+type E int
+
+const (
+	A E = iota
+	B
+)
+
+const C = "c"
+
+var V, W = 1, "w"
+`
+	pkgs := createPkg(t, "p", []string{src}, nil)
+	g := New(pkgs)
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[defPath]string{
+		{"p", ""}: "package p",
+		{"p", "S"}: `type S struct {
+	A int
+	r Reader
+	Reader
+	B, C string ` + "`json:\"b\"`" + `
+	F    func(x int) error
+}`,
+		{"p", "S/A"}:      "A int",
+		{"p", "S/r"}:      "r Reader",
+		{"p", "S/Reader"}: "Reader",
+		{"p", "S/C"}:      "C string `json:\"b\"`",
+		{"p", "S/F"}:      "F func(x int) error",
+		{"p", "I"}: `type I interface {
+	Reader
+	M(x, y int) (n int, err error)
+}`,
+		{"p", "I/M"}:   "func (I) M(x, y int) (n int, err error)",
+		{"p", "S/M"}:   "func (s *S) M(x, y int) (n int, err error)",
+		{"p", "S/M/x"}: "var x int",
+		{"p", "E"}:     "type E int",
+		{"p", "A"}:     "const A E = 0",
+		{"p", "B"}:     "const B E = 1",
+		{"p", "C"}:     `const C = "c"`,
+		{"p", "V"}:     "var V int",
+		{"p", "W"}:     "var W string",
+	}
+	got := make(map[defPath]string)
+	for _, def := range g.Defs {
+		got[def.DefKey.defPath()] = def.Decl
+	}
+	for path, wantDecl := range want {
+		if gotDecl, ok := got[path]; !ok {
+			t.Errorf("%v: no def", path)
+		} else if gotDecl != wantDecl {
+			t.Errorf("%v: got decl %q, want %q", path, gotDecl, wantDecl)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package gog
 import (
 	"fmt"
 	"go/ast"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -10,15 +11,23 @@ import (
 
 	"go/types"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 type DefKey struct {
 	PackageImportPath string
 	Path              []string
+
+	// UnitType is the type of the source unit that the def is in, if
+	// it is not a Go package: CUnitType for the C declarations of a
+	// cgo package, whose PackageImportPath is the cgo package's.
+	UnitType string `json:",omitempty"`
 }
 
 func (s *DefKey) String() string {
+	if s.UnitType != "" {
+		return s.UnitType + ":" + s.PackageImportPath + "#" + strings.Join(s.Path, ".")
+	}
 	return s.PackageImportPath + "#" + strings.Join(s.Path, ".")
 }
 
@@ -32,13 +41,38 @@ type Def struct {
 	DeclSpan  [2]uint32
 
 	definfo.DefInfo
+
+	// BuildConfigs are the names of the build configurations that
+	// this def exists under, if it doesn't exist under all of them
+	// (see MergeOutputs).
+	BuildConfigs []string `json:",omitempty"`
+
+	// Implements are the interfaces that this def implements (if it
+	// is a concrete type), and ImplementedBy are the concrete types
+	// that implement this def (if it is an interface). Either the
+	// type or a pointer to it implements the interface.
+	Implements    []*DefKey `json:",omitempty"`
+	ImplementedBy []*DefKey `json:",omitempty"`
+
+	// Promotions are the methods and fields that are promoted to this
+	// def through embedding (if it is a type).
+	Promotions []*Promotion `json:",omitempty"`
+
+	// AsmBodies are the assembly implementations of this def (if it is
+	// a func that is declared without a body), for each architecture
+	// that implements it.
+	AsmBodies []*AsmBody `json:",omitempty"`
+
+	// GoFile is the summary of the file (if this def is a Go file of
+	// its package).
+	GoFile *GoFile `json:",omitempty"`
 }
 
 // NewDef creates a new Def.
 func (g *Grapher) NewDef(obj types.Object, declIdent *ast.Ident) (*Def, error) {
 	// Find the AST node that declares this def.
 	var declNode ast.Node
-	_, astPath, _ := g.program.PathEnclosingInterval(declIdent.Pos(), declIdent.End())
+	_, astPath, _ := g.pathEnclosingInterval(declIdent.Pos(), declIdent.End())
 	for _, node := range astPath {
 		switch node.(type) {
 		case *ast.FuncDecl, *ast.GenDecl, *ast.ValueSpec, *ast.TypeSpec, *ast.Field, *ast.DeclStmt, *ast.AssignStmt:
@@ -48,7 +82,7 @@ func (g *Grapher) NewDef(obj types.Object, declIdent *ast.Ident) (*Def, error) {
 	}
 found:
 	if declNode == nil {
-		return nil, fmt.Errorf("On ident %s at %s: no DeclNode found (using PathEnclosingInterval)", declIdent.Name, g.program.Fset.Position(declIdent.Pos()))
+		return nil, fmt.Errorf("On ident %s at %s: no DeclNode found (using PathEnclosingInterval)", declIdent.Name, g.fset.Position(declIdent.Pos()))
 	}
 
 	key, info, err := g.defInfo(obj)
@@ -61,6 +95,7 @@ found:
 		PkgScope: info.pkgscope,
 		PkgName:  obj.Pkg().Name(),
 		Kind:     defKind(obj),
+		Decl:     g.declString(obj, declNode),
 	}
 
 	if typ := obj.Type(); typ != nil {
@@ -85,6 +120,24 @@ found:
 			// omit package path; just get receiver type name
 			si.Receiver = strings.Replace(recv.Type().String(), obj.Pkg().Path()+".", "", 1)
 		}
+		si.TypeParams = typeParamStrings(sig.TypeParams(), obj.Pkg())
+	case *types.TypeName:
+		switch typ := obj.Type().(type) {
+		case *types.Named:
+			si.TypeParams = typeParamStrings(typ.TypeParams(), obj.Pkg())
+		case *types.TypeParam:
+			si.Constraint = types.TypeString(typ.Constraint(), nameQualifier(obj.Pkg()))
+		}
+	}
+
+	implements, implementedBy, err := g.implementsKeys(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	promotions, err := g.promotions(obj)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Def{
@@ -92,36 +145,80 @@ found:
 
 		DefKey: key,
 
-		File:      g.program.Fset.Position(declIdent.Pos()).Filename,
-		IdentSpan: makeSpan(g.program.Fset, declIdent),
-		DeclSpan:  makeSpan(g.program.Fset, declNode),
+		File:      g.fset.Position(declIdent.Pos()).Filename,
+		IdentSpan: makeSpan(g.fset, declIdent),
+		DeclSpan:  makeSpan(g.fset, declNode),
 
 		DefInfo: si,
+
+		Implements:    implements,
+		ImplementedBy: implementedBy,
+		Promotions:    promotions,
 	}, nil
 }
 
 // NewPackageDef creates a new Def that represents a Go package.
-func (g *Grapher) NewPackageDef(pkgInfo *loader.PackageInfo, pkg *types.Package) (*Def, error) {
+func (g *Grapher) NewPackageDef(pkg *packages.Package) (*Def, error) {
 	var pkgDir string
-	if len(pkgInfo.Files) > 0 {
-		pkgDir = filepath.Dir(g.program.Fset.Position(pkgInfo.Files[0].Package).Filename)
+	if len(pkg.Syntax) > 0 {
+		pkgDir = filepath.Dir(g.fset.Position(pkg.Syntax[0].Package).Filename)
 	}
 
 	return &Def{
-		Name: pkg.Name(),
+		Name: pkg.Types.Name(),
 
-		DefKey: &DefKey{PackageImportPath: pkg.Path(), Path: []string{}},
+		DefKey: pkgDefKey(pkg.Types, []string{}),
 
 		File: pkgDir,
 
 		DefInfo: definfo.DefInfo{
 			Exported: true,
-			PkgName:  pkg.Name(),
+			PkgName:  pkg.Types.Name(),
 			Kind:     definfo.Package,
+			Decl:     "package " + pkg.Types.Name(),
 		},
 	}, nil
 }
 
+// fileDefKey returns the def key of the file of the unit unit (the
+// import path of a package) that is named name, relative to the
+// package's directory.
+func fileDefKey(unit, name string) *DefKey {
+	return &DefKey{PackageImportPath: unit, Path: []string{name}}
+}
+
+// newFileDef creates the def, whose key is key, of the file of pkg
+// that is named name (relative to pkg's directory) and whose path is
+// file.
+func newFileDef(pkg *packages.Package, key *DefKey, name, file string) *Def {
+	def := &Def{
+		Name:   name,
+		DefKey: key,
+		File:   file,
+		DefInfo: definfo.DefInfo{
+			PkgScope: true,
+			PkgName:  pkg.Types.Name(),
+			Kind:     definfo.File,
+		},
+	}
+	if fi, err := os.Stat(file); err == nil {
+		def.DeclSpan = [2]uint32{0, uint32(fi.Size())}
+	}
+	return def
+}
+
+// typeParamStrings returns the type parameters in tparams, with their
+// constraints, such as "T any". Packages other than pkg are qualified
+// by their names.
+func typeParamStrings(tparams *types.TypeParamList, pkg *types.Package) []string {
+	var strs []string
+	for i := 0; i < tparams.Len(); i++ {
+		tp := tparams.At(i)
+		strs = append(strs, tp.Obj().Name()+" "+types.TypeString(tp.Constraint(), nameQualifier(pkg)))
+	}
+	return strs
+}
+
 func defKind(obj types.Object) string {
 	switch obj := obj.(type) {
 	case *types.PkgName:
@@ -129,6 +226,9 @@ func defKind(obj types.Object) string {
 	case *types.Const:
 		return definfo.Const
 	case *types.TypeName:
+		if _, ok := obj.Type().(*types.TypeParam); ok {
+			return definfo.TypeParam
+		}
 		return definfo.Type
 	case *types.Var:
 		if obj.IsField() {
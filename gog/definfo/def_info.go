@@ -28,4 +28,16 @@ type DefInfo struct {
 	// Kind is the kind of Go thing this def is: struct, interface, func,
 	// package, etc.
 	Kind string `json:",omitempty"`
+
+	// TypeParams are the type parameters of this def, with their
+	// constraints (such as "T any"), if it is a generic func or type.
+	TypeParams []string `json:",omitempty"`
+
+	// Constraint is the constraint of this def, if it is a type
+	// parameter.
+	Constraint string `json:",omitempty"`
+
+	// Decl is the Go source declaration of this def (without its doc
+	// comment or body), pretty-printed like gofmt prints it.
+	Decl string `json:",omitempty"`
 }
@@ -9,6 +9,8 @@ const (
 	Type      = "type"
 	Interface = "interface"
 	Const     = "const"
+	TypeParam = "typeparam"
+	File      = "file"
 )
 
 var GeneralKindMap = map[string]string{
@@ -20,4 +22,6 @@ var GeneralKindMap = map[string]string{
 	Var:       Var,
 	Const:     Const,
 	Interface: Type,
+	TypeParam: Type,
+	File:      File,
 }
@@ -0,0 +1,236 @@
+package gog
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go/types"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// directiveRefs returns the refs in the //go:linkname, //go:generate
+// and //go:embed directives in pkg's files, and the defs of the files
+// that the //go:embed directives embed:
+//
+//   - //go:linkname local importpath.name refers to the local def and
+//     to the def that it is linked to;
+//   - //go:generate go run ./path refers to the package that is run
+//     (as do import paths instead of ./path);
+//   - //go:embed patterns refer to the files that they match.
+func (g *Grapher) directiveRefs(pkg *packages.Package, unit string) ([]*Def, []*Ref, error) {
+	var defs []*Def
+	var refs []*Ref
+	// The Go files of pkg that are embedded already have defs (see
+	// fileDefs).
+	embedded := make(map[string]bool)
+	for _, f := range pkg.Syntax {
+		embedded[filepath.Base(g.fset.Position(f.Pos()).Filename)] = true
+	}
+	for _, f := range pkg.Syntax {
+		tf := g.fset.File(f.Pos())
+		for _, cg := range f.Comments {
+			for _, c := range cg.List {
+				if !strings.HasPrefix(c.Text, "//go:") {
+					continue
+				}
+				fields := directiveFields(c.Text)
+				offset := tf.Offset(c.Slash)
+				addRef := func(field directiveField, key *DefKey, kind string) {
+					refs = append(refs, &Ref{
+						Unit: unit,
+						File: tf.Name(),
+						Span: [2]uint32{uint32(offset + field.start), uint32(offset + field.end)},
+						Def:  key,
+						Kind: kind,
+					})
+				}
+
+				switch fields[0].text {
+				case "//go:linkname":
+					if len(fields) < 2 {
+						continue
+					}
+					if obj := pkg.Types.Scope().Lookup(fields[1].text); obj != nil {
+						key, err := g.defKey(obj)
+						if err != nil {
+							return nil, nil, err
+						}
+						addRef(fields[1], key, RefLinkname)
+					}
+					if len(fields) >= 3 {
+						key, err := g.linknameKey(pkg.Types, fields[2].text)
+						if err != nil {
+							return nil, nil, err
+						}
+						if key != nil {
+							addRef(fields[2], key, RefLinkname)
+						}
+					}
+
+				case "//go:generate":
+					if len(fields) < 4 || fields[1].text != "go" || fields[2].text != "run" {
+						continue
+					}
+					for _, arg := range fields[3:] {
+						if strings.HasPrefix(arg.text, "-") {
+							continue // a flag of go run
+						}
+						if strings.HasSuffix(arg.text, ".go") {
+							break // go run of files, not of a package
+						}
+						importPath := arg.text
+						if strings.HasPrefix(importPath, ".") {
+							importPath = path.Join(unit, importPath)
+						} else if i := strings.Index(importPath, "@"); i >= 0 {
+							importPath = importPath[:i]
+						}
+						addRef(arg, &DefKey{PackageImportPath: importPath, Path: []string{}}, RefGenerate)
+						break
+					}
+
+				case "//go:embed":
+					dir := filepath.Dir(tf.Name())
+					for _, pattern := range fields[1:] {
+						files, err := embeddedFiles(dir, pattern.text)
+						if err != nil {
+							return nil, nil, err
+						}
+						for _, file := range files {
+							name, err := filepath.Rel(dir, file)
+							if err != nil {
+								return nil, nil, err
+							}
+							name = filepath.ToSlash(name)
+							key := fileDefKey(unit, name)
+							if !embedded[name] {
+								embedded[name] = true
+								defs = append(defs, newFileDef(pkg, key, name, file))
+							}
+							addRef(pattern, key, RefEmbedFile)
+						}
+					}
+				}
+			}
+		}
+	}
+	return defs, refs, nil
+}
+
+// A directiveField is a field of a directive comment, such as a
+// //go:embed pattern. Quoted fields are unquoted. start and end are the
+// offsets of the field (including any quotes) in the comment.
+type directiveField struct {
+	text       string
+	start, end int
+}
+
+// directiveFields splits the directive comment text into its fields,
+// which are separated by spaces and may be quoted (as //go:embed
+// patterns and //go:generate arguments may be).
+func directiveFields(text string) []directiveField {
+	var fields []directiveField
+	for i := 0; i < len(text); {
+		if text[i] == ' ' || text[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		if text[i] == '"' || text[i] == '`' {
+			// A quoted field, which ends at the closing quote.
+			for i++; i < len(text) && text[i] != text[start]; i++ {
+				if text[i] == '\\' && text[start] == '"' {
+					i++
+				}
+			}
+			if i < len(text) {
+				i++
+			}
+			if s, err := strconv.Unquote(text[start:i]); err == nil {
+				fields = append(fields, directiveField{s, start, i})
+				continue
+			}
+		}
+		for i < len(text) && text[i] != ' ' && text[i] != '\t' {
+			i++
+		}
+		fields = append(fields, directiveField{text[start:i], start, i})
+	}
+	return fields
+}
+
+// linknameKey returns the def key of target, the importpath.name (or
+// importpath.T.name or importpath.(*T).name, for a method) that a
+// //go:linkname directive in pkg links to, or nil if target is not
+// such a name. If the def is in pkg or in a package that pkg imports,
+// its key is looked up; otherwise it is derived from target.
+func (g *Grapher) linknameKey(pkg *types.Package, target string) (*DefKey, error) {
+	slash := strings.LastIndex(target, "/")
+	dot := strings.Index(target[slash+1:], ".")
+	if dot < 0 {
+		return nil, nil
+	}
+	importPath, name := target[:slash+1+dot], target[slash+1+dot+1:]
+	var recv string
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		recv, name = strings.Trim(name[:i], "(*)"), name[i+1:]
+	}
+
+	targetPkg := pkg
+	if importPath != pkg.Path() {
+		targetPkg = nil
+		for _, imp := range pkg.Imports() {
+			if imp.Path() == importPath {
+				targetPkg = imp
+				break
+			}
+		}
+	}
+	if targetPkg != nil {
+		if obj := lookupDocLink(targetPkg, recv, name); obj != nil {
+			return g.defKey(obj)
+		}
+	}
+	if recv != "" {
+		return &DefKey{PackageImportPath: importPath, Path: []string{recv, name}}, nil
+	}
+	return &DefKey{PackageImportPath: importPath, Path: []string{name}}, nil
+}
+
+// embeddedFiles returns the files in dir that the //go:embed pattern
+// matches. Directories that the pattern matches are embedded
+// recursively, except for files whose names begin with "." or "_"
+// (unless the pattern begins with "all:").
+func embeddedFiles(dir, pattern string) ([]string, error) {
+	all := strings.HasPrefix(pattern, "all:")
+	pattern = strings.TrimPrefix(pattern, "all:")
+	matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, match := range matches {
+		err := filepath.Walk(match, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if name := info.Name(); file != match && !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,124 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestDirectiveRefs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	src := `package p
+
+import (
+	_ "embed"
+	_ "unsafe"
+)
+
+//go:generate go run ./cmd/gen -out gen.go
+//go:generate go run -mod=mod example.com/tool@v1.0.0
+//go:generate go run gen.go
+//go:generate stringer -type T
+
+//go:linkname now runtime.nanotime
+func now() int64
+
+//go:linkname local p.target
+func local()
+
+func target() {}
+
+//go:linkname method p.(*T).m
+func method()
+
+type T struct{}
+
+func (*T) m() {}
+
+//go:embed hello.txt "static/*.html"
+var content string
+
+//go:embed static
+var static string
+`
+	goFile := write("p.go", src)
+	write("hello.txt", "hello")
+	write("static/index.html", "<p>")
+	write("static/_hidden.html", "<p>")
+	write("static/img/logo.svg", "<svg>")
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, goFile, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := checkPkg(t, fset, "p", []*ast.File{f})
+	g := New([]*packages.Package{pkg})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	type ref struct {
+		text, kind string
+		def        defPath
+	}
+	var got []ref
+	for _, r := range g.Refs {
+		switch r.Kind {
+		case RefLinkname, RefGenerate, RefEmbedFile:
+			got = append(got, ref{src[r.Span[0]:r.Span[1]], r.Kind, r.Def.defPath()})
+		}
+	}
+	want := []ref{
+		{"./cmd/gen", RefGenerate, defPath{"p/cmd/gen", ""}},
+		{"example.com/tool@v1.0.0", RefGenerate, defPath{"example.com/tool", ""}},
+		{"now", RefLinkname, defPath{"p", "now"}},
+		{"runtime.nanotime", RefLinkname, defPath{"runtime", "nanotime"}},
+		{"local", RefLinkname, defPath{"p", "local"}},
+		{"p.target", RefLinkname, defPath{"p", "target"}},
+		{"method", RefLinkname, defPath{"p", "method"}},
+		{"p.(*T).m", RefLinkname, defPath{"p", "T/m"}},
+		{"hello.txt", RefEmbedFile, defPath{"p", "hello.txt"}},
+		// Files that a pattern matches are embedded even if their names
+		// begin with "_", unlike the files in directories that it matches.
+		{`"static/*.html"`, RefEmbedFile, defPath{"p", "static/_hidden.html"}},
+		{`"static/*.html"`, RefEmbedFile, defPath{"p", "static/index.html"}},
+		{"static", RefEmbedFile, defPath{"p", "static/img/logo.svg"}},
+		{"static", RefEmbedFile, defPath{"p", "static/index.html"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got directive refs\n%v\nwant\n%v", got, want)
+	}
+
+	var files []string
+	for _, def := range g.Defs {
+		if def.Kind == definfo.File && def.GoFile == nil {
+			files = append(files, def.Name)
+		}
+	}
+	sort.Strings(files)
+	if want := []string{"hello.txt", "static/_hidden.html", "static/img/logo.svg", "static/index.html"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got file defs %v, want %v", files, want)
+	}
+}
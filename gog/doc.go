@@ -1,10 +1,8 @@
 package gog
 
 import (
-	"bytes"
 	"go/ast"
 	"go/build"
-	"go/doc"
 	"go/parser"
 	"go/token"
 	"io"
@@ -16,7 +14,7 @@ import (
 
 	"go/types"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 type Doc struct {
@@ -60,16 +58,16 @@ func parseFiles(fset *token.FileSet, filenames []string) (map[string]*ast.File,
 	return files, nil
 }
 
-func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
+func (g *Grapher) emitDocs(pkg *packages.Package) ([]*Doc, error) {
 	var pkgDocs []*Doc
-	objOf := make(map[token.Position]types.Object, len(pkgInfo.Defs))
-	for ident, obj := range pkgInfo.Defs {
-		objOf[g.program.Fset.Position(ident.Pos())] = obj
+	objOf := make(map[token.Position]types.Object, len(pkg.TypesInfo.Defs))
+	for ident, obj := range pkg.TypesInfo.Defs {
+		objOf[g.fset.Position(ident.Pos())] = obj
 	}
 
 	var filenames []string
-	for _, f := range pkgInfo.Files {
-		name := g.program.Fset.Position(f.Name.Pos()).Filename
+	for _, f := range pkg.Syntax {
+		name := g.fset.Position(f.Name.Pos()).Filename
 		if filepath.Base(name) == "C" {
 			// skip cgo-generated file
 			continue
@@ -79,7 +77,7 @@ func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
 		}
 	}
 	sort.Strings(filenames)
-	files, err := parseFiles(g.program.Fset, filenames)
+	files, err := parseFiles(g.fset, filenames)
 	if err != nil {
 		return nil, err
 	}
@@ -100,10 +98,31 @@ func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
 		pkgDoc += "\n" + f.Doc.Text()
 	}
 
-	pkgPath := pkgInfo.Pkg.Path()
-	fileDocs := g.emitDoc(types.NewPkgName(0, pkgInfo.Pkg, pkgPath, pkgInfo.Pkg), nil, pkgDoc, "", pkgPath)
+	pkgPath := unitImportPath(pkg.Types)
+	dctx := g.newDocContext(pkg.Types, files)
+	fileDocs, err := g.emitDoc(dctx, types.NewPkgName(0, pkg.Types, pkgPath, pkg.Types), nil, pkgDoc, "", pkgPath)
+	if err != nil {
+		return nil, err
+	}
 	pkgDocs = append(pkgDocs, fileDocs...)
 
+	// emit emits the doc c of obj (whose text is docstring), and
+	// reports whether a doc was emitted. It records the first error
+	// in emitErr.
+	var emitErr error
+	emit := func(obj types.Object, c *ast.CommentGroup, docstring, filename string) bool {
+		if emitErr != nil {
+			return false
+		}
+		docs, err := g.emitDoc(dctx, obj, c, docstring, filename, pkgPath)
+		if err != nil {
+			emitErr = err
+			return false
+		}
+		pkgDocs = append(pkgDocs, docs...)
+		return len(docs) > 0
+	}
+
 	// We walk the AST for comments attached to nodes.
 	for filename, f := range files {
 		// docSeen is a map from the starting byte of a doc to
@@ -116,18 +135,16 @@ func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
 					return true
 				}
 				for _, i := range n.Names {
-					if docs := g.emitDoc(objOf[g.program.Fset.Position(i.Pos())], n.Doc, n.Doc.Text(), filename, pkgPath); len(docs) > 0 {
+					if emit(objOf[g.fset.Position(i.Pos())], n.Doc, n.Doc.Text(), filename) {
 						docSeen[n.Doc.Pos()] = struct{}{}
-						pkgDocs = append(pkgDocs, docs...)
 					}
 				}
 			case *ast.FuncDecl:
 				if n.Doc == nil || n.Name == nil {
 					return true
 				}
-				if docs := g.emitDoc(objOf[g.program.Fset.Position(n.Name.Pos())], n.Doc, n.Doc.Text(), filename, pkgPath); len(docs) > 0 {
+				if emit(objOf[g.fset.Position(n.Name.Pos())], n.Doc, n.Doc.Text(), filename) {
 					docSeen[n.Doc.Pos()] = struct{}{}
-					pkgDocs = append(pkgDocs, docs...)
 				}
 			case *ast.GenDecl:
 				for _, spec := range n.Specs {
@@ -135,16 +152,14 @@ func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
 					case *ast.ValueSpec:
 						for _, name := range spec.Names {
 							c := firstNonNil(spec.Doc, spec.Comment, n.Doc)
-							if docs := g.emitDoc(objOf[g.program.Fset.Position(name.Pos())], c, c.Text(), filename, pkgPath); len(docs) > 0 {
+							if emit(objOf[g.fset.Position(name.Pos())], c, c.Text(), filename) {
 								docSeen[c.Pos()] = struct{}{}
-								pkgDocs = append(pkgDocs, docs...)
 							}
 						}
 					case *ast.TypeSpec:
 						c := firstNonNil(spec.Doc, spec.Comment, n.Doc)
-						if docs := g.emitDoc(objOf[g.program.Fset.Position(spec.Name.Pos())], c, c.Text(), filename, pkgPath); len(docs) > 0 {
+						if emit(objOf[g.fset.Position(spec.Name.Pos())], c, c.Text(), filename) {
 							docSeen[c.Pos()] = struct{}{}
-							pkgDocs = append(pkgDocs, docs...)
 						}
 					}
 				}
@@ -152,26 +167,23 @@ func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
 				if n.Doc == nil || n.Name == nil {
 					return true
 				}
-				if docs := g.emitDoc(objOf[g.program.Fset.Position(n.Name.Pos())], n.Doc, n.Doc.Text(), filename, pkgPath); len(docs) > 0 {
+				if emit(objOf[g.fset.Position(n.Name.Pos())], n.Doc, n.Doc.Text(), filename) {
 					docSeen[n.Doc.Pos()] = struct{}{}
-					pkgDocs = append(pkgDocs, docs...)
 				}
 			case *ast.TypeSpec:
 				if n.Doc == nil || n.Name == nil {
 					return true
 				}
-				if docs := g.emitDoc(objOf[g.program.Fset.Position(n.Name.Pos())], n.Doc, n.Doc.Text(), filename, pkgPath); len(docs) > 0 {
+				if emit(objOf[g.fset.Position(n.Name.Pos())], n.Doc, n.Doc.Text(), filename) {
 					docSeen[n.Doc.Pos()] = struct{}{}
-					pkgDocs = append(pkgDocs, docs...)
 				}
 			case *ast.ValueSpec:
 				if n.Doc == nil {
 					return true
 				}
 				for _, i := range n.Names {
-					if docs := g.emitDoc(objOf[g.program.Fset.Position(i.Pos())], n.Doc, n.Doc.Text(), filename, pkgPath); len(docs) > 0 {
+					if emit(objOf[g.fset.Position(i.Pos())], n.Doc, n.Doc.Text(), filename) {
 						docSeen[n.Doc.Pos()] = struct{}{}
-						pkgDocs = append(pkgDocs, docs...)
 					}
 				}
 			}
@@ -180,10 +192,12 @@ func (g *Grapher) emitDocs(pkgInfo *loader.PackageInfo) ([]*Doc, error) {
 		// Add comments that haven't already been seen.
 		for _, c := range f.Comments {
 			if _, seen := docSeen[c.Pos()]; !seen {
-				commentDocs := g.emitDoc(nil, c, c.Text(), filename, pkgPath)
-				pkgDocs = append(pkgDocs, commentDocs...)
+				emit(nil, c, c.Text(), filename)
 			}
 		}
+		if emitErr != nil {
+			return nil, emitErr
+		}
 	}
 	return pkgDocs, nil
 }
@@ -197,80 +211,64 @@ func firstNonNil(comments ...*ast.CommentGroup) *ast.CommentGroup {
 	return nil
 }
 
-func (g *Grapher) emitDoc(obj types.Object, dc *ast.CommentGroup, docstring, filename, pkgPath string) (docs []*Doc) {
+func (g *Grapher) emitDoc(dctx *docContext, obj types.Object, dc *ast.CommentGroup, docstring, filename, pkgPath string) (docs []*Doc, err error) {
 	if docstring == "" {
-		return
+		return nil, nil
 	}
-	if obj == nil {
-		var htmlBuf bytes.Buffer
-		doc.ToHTML(&htmlBuf, docstring, nil)
-		var span [2]uint32
-		if dc != nil {
-			span = makeSpan(g.program.Fset, dc)
+	var key *DefKey
+	if obj != nil {
+		// Objects that have no def key have no doc.
+		if key, _, err = g.defInfo(obj); err != nil {
+			return nil, nil
 		}
+		if !g.markDocSeen(obj, key) {
+			return nil, nil
+		}
+	}
+
+	var span [2]uint32
+	if dc != nil {
+		span = makeSpan(g.fset, dc)
+	}
+
+	formats, err := dctx.formats(docstring, g.DocFormats)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range formats {
 		docs = append(docs, &Doc{
-			DefKey: nil,
-			Unit:   pkgPath,
-			Format: "text/html",
-			Data:   htmlBuf.String(),
-			File:   filename,
-			Span:   span,
-		})
-		docs = append(docs, &Doc{
-			DefKey: nil,
+			DefKey: key,
 			Unit:   pkgPath,
-			Format: "text/plain",
-			Data:   docstring,
+			Format: f.format,
+			Data:   f.data,
 			File:   filename,
 			Span:   span,
 		})
-		return
 	}
+	return docs, nil
+}
+
+// markDocSeen records that the doc for obj (whose def key is key) has
+// been emitted. It returns false if a doc for obj or key was already
+// emitted.
+func (g *Grapher) markDocSeen(obj types.Object, key *DefKey) bool {
+	g.outputLock.Lock()
+	defer g.outputLock.Unlock()
 
 	if g.seenDocObjs == nil {
 		g.seenDocObjs = make(map[types.Object]struct{})
 	}
 	if _, seen := g.seenDocObjs[obj]; seen {
-		return
+		return false
 	}
 	g.seenDocObjs[obj] = struct{}{}
 
-	key, _, err := g.defInfo(obj)
-	if err != nil {
-		return
-	}
-
 	if g.seenDocKeys == nil {
 		g.seenDocKeys = make(map[string]struct{})
 	}
 	if _, seen := g.seenDocKeys[key.String()]; seen {
-		return
+		return false
 	}
 	g.seenDocKeys[key.String()] = struct{}{}
-
-	var htmlBuf bytes.Buffer
-	doc.ToHTML(&htmlBuf, docstring, nil)
-
-	var span [2]uint32
-	if dc != nil {
-		span = makeSpan(g.program.Fset, dc)
-	}
-
-	docs = append(docs, &Doc{
-		DefKey: key,
-		Unit:   pkgPath,
-		Format: "text/html",
-		Data:   htmlBuf.String(),
-		File:   filename,
-		Span:   span,
-	})
-	docs = append(docs, &Doc{
-		DefKey: key,
-		Unit:   pkgPath,
-		Format: "text/plain",
-		Data:   docstring,
-		File:   filename,
-		Span:   span,
-	})
-	return
+	return true
 }
@@ -0,0 +1,293 @@
+package gog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/doc/comment"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// Doc formats. Each doc comment is emitted in the formats listed in
+// the grapher's DocFormats.
+const (
+	DocHTML     = "text/html"
+	DocText     = "text/plain"
+	DocMarkdown = "text/markdown"
+
+	// DocStructured is the format of docs whose Data is a
+	// JSON-encoded StructuredDoc.
+	DocStructured = "application/vnd.srclib-go.doc+json"
+)
+
+// DefaultDocFormats are the formats that doc comments are emitted in if
+// the grapher's DocFormats is empty.
+var DefaultDocFormats = []string{DocHTML, DocText}
+
+// IsDocFormat reports whether format is one of the doc formats.
+func IsDocFormat(format string) bool {
+	switch format {
+	case DocHTML, DocText, DocMarkdown, DocStructured:
+		return true
+	}
+	return false
+}
+
+// A StructuredDoc is a doc comment split into its parts, so that it can
+// be rendered without parsing HTML.
+type StructuredDoc struct {
+	// Summary is the first sentence of the doc, as plain text.
+	Summary string `json:",omitempty"`
+
+	// Deprecated is the text of the doc's "Deprecated:" paragraph
+	// (without the "Deprecated:" prefix), if it has one.
+	Deprecated string `json:",omitempty"`
+
+	// Blocks are the paragraphs, headings, code blocks and lists of
+	// the doc, in order.
+	Blocks []*DocBlock
+
+	// Links are the doc links (such as [pkg.Name]) in the doc, in
+	// order.
+	Links []*DocLink `json:",omitempty"`
+}
+
+// Kinds of DocBlocks.
+const (
+	DocParagraph = "paragraph"
+	DocHeading   = "heading"
+	DocCode      = "code"
+	DocList      = "list"
+)
+
+// A DocBlock is a paragraph, heading, code block or list in a doc.
+type DocBlock struct {
+	Kind string
+
+	// Text is the plain text of a paragraph, heading or code block.
+	// Links appear as their text.
+	Text string `json:",omitempty"`
+
+	// Items are the plain text of the items of a list, and Ordered
+	// is whether the list is numbered.
+	Items   []string `json:",omitempty"`
+	Ordered bool     `json:",omitempty"`
+}
+
+// A DocLink is a link in a doc to a package or to a package-level
+// identifier (or a method or field of one), such as [pkg.Name].
+type DocLink struct {
+	// Text is the text of the link, such as "pkg.Name".
+	Text string
+
+	// ImportPath is the import path of the package that is linked to
+	// (or whose identifier is), and Recv and Name are the receiver
+	// type and name of the identifier (if any).
+	ImportPath string
+	Recv       string `json:",omitempty"`
+	Name       string `json:",omitempty"`
+
+	// Def is the def key of the package or identifier, or nil if it is
+	// not in the package or in one of the packages it imports. (The
+	// graph command converts it to a srclib def key, see
+	// golang_def.DocLink.)
+	Def *DefKey `json:",omitempty"`
+}
+
+// docContext is what is needed to parse the doc comments of a package
+// and to resolve their doc links.
+type docContext struct {
+	g      *Grapher
+	pkg    *types.Package
+	parser comment.Parser
+}
+
+// newDocContext returns the docContext of pkg, whose files (parsed
+// with comments) are files.
+func (g *Grapher) newDocContext(pkg *types.Package, files map[string]*ast.File) *docContext {
+	// Doc links may refer to imported packages by their names or by
+	// the names that they are imported as.
+	imports := make(map[string]string)
+	for _, imp := range pkg.Imports() {
+		imports[imp.Name()] = imp.Path()
+	}
+	for _, f := range files {
+		for _, spec := range f.Imports {
+			if spec.Name == nil || spec.Name.Name == "_" || spec.Name.Name == "." {
+				continue
+			}
+			if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports[spec.Name.Name] = path
+			}
+		}
+	}
+
+	c := &docContext{g: g, pkg: pkg}
+	c.parser.LookupPackage = func(name string) (string, bool) {
+		path, ok := imports[name]
+		return path, ok
+	}
+	c.parser.LookupSym = func(recv, name string) bool {
+		return lookupDocLink(pkg, recv, name) != nil
+	}
+	return c
+}
+
+// docFormat is a doc comment in a doc format.
+type docFormat struct {
+	format, data string
+}
+
+// formats returns the doc comment text in each of the doc formats in
+// formats (or DefaultDocFormats, if it is empty).
+func (c *docContext) formats(text string, formats []string) ([]docFormat, error) {
+	if len(formats) == 0 {
+		formats = DefaultDocFormats
+	}
+	var parsed *comment.Doc
+	parse := func() *comment.Doc {
+		if parsed == nil {
+			parsed = c.parser.Parse(text)
+		}
+		return parsed
+	}
+
+	docs := make([]docFormat, 0, len(formats))
+	for _, format := range formats {
+		var data string
+		switch format {
+		case DocHTML:
+			var buf bytes.Buffer
+			doc.ToHTML(&buf, text, nil)
+			data = buf.String()
+		case DocText:
+			data = text
+		case DocMarkdown:
+			var printer comment.Printer
+			data = string(printer.Markdown(parse()))
+		case DocStructured:
+			structured, err := json.Marshal(c.structured(parse()))
+			if err != nil {
+				return nil, fmt.Errorf("marshaling structured doc: %s", err)
+			}
+			data = string(structured)
+		default:
+			return nil, fmt.Errorf("unknown doc format %q", format)
+		}
+		docs = append(docs, docFormat{format, data})
+	}
+	return docs, nil
+}
+
+// structured returns the StructuredDoc of the parsed doc comment d.
+func (c *docContext) structured(d *comment.Doc) *StructuredDoc {
+	// The summary is computed from the text that the doc is printed
+	// as, in which doc links appear without their brackets.
+	var printer comment.Printer
+	sd := &StructuredDoc{
+		Summary: new(doc.Package).Synopsis(string(printer.Text(d))),
+		Blocks:  []*DocBlock{},
+	}
+	for _, block := range d.Content {
+		switch block := block.(type) {
+		case *comment.Paragraph:
+			t := c.text(sd, block.Text)
+			if strings.HasPrefix(t, "Deprecated: ") && sd.Deprecated == "" {
+				sd.Deprecated = strings.TrimSpace(strings.TrimPrefix(t, "Deprecated: "))
+			}
+			sd.Blocks = append(sd.Blocks, &DocBlock{Kind: DocParagraph, Text: t})
+		case *comment.Heading:
+			sd.Blocks = append(sd.Blocks, &DocBlock{Kind: DocHeading, Text: c.text(sd, block.Text)})
+		case *comment.Code:
+			sd.Blocks = append(sd.Blocks, &DocBlock{Kind: DocCode, Text: block.Text})
+		case *comment.List:
+			list := &DocBlock{Kind: DocList}
+			for _, item := range block.Items {
+				if item.Number != "" {
+					list.Ordered = true
+				}
+				var paras []string
+				for _, b := range item.Content {
+					if p, ok := b.(*comment.Paragraph); ok {
+						paras = append(paras, c.text(sd, p.Text))
+					}
+				}
+				list.Items = append(list.Items, strings.Join(paras, "\n"))
+			}
+			sd.Blocks = append(sd.Blocks, list)
+		}
+	}
+	return sd
+}
+
+// text returns the plain text of ts, adding the doc links in it to
+// sd.Links.
+func (c *docContext) text(sd *StructuredDoc, ts []comment.Text) string {
+	var buf strings.Builder
+	for _, t := range ts {
+		switch t := t.(type) {
+		case comment.Plain:
+			buf.WriteString(string(t))
+		case comment.Italic:
+			buf.WriteString(string(t))
+		case *comment.Link:
+			buf.WriteString(c.text(sd, t.Text))
+		case *comment.DocLink:
+			text := c.text(sd, t.Text)
+			buf.WriteString(text)
+			sd.Links = append(sd.Links, c.docLink(t, text))
+		}
+	}
+	return buf.String()
+}
+
+// docLink returns the DocLink of l, whose text is text.
+func (c *docContext) docLink(l *comment.DocLink, text string) *DocLink {
+	link := &DocLink{Text: text, ImportPath: l.ImportPath, Recv: l.Recv, Name: l.Name}
+
+	var pkg *types.Package
+	if l.ImportPath == "" {
+		pkg = c.pkg
+		link.ImportPath = c.pkg.Path()
+	} else {
+		for _, imp := range c.pkg.Imports() {
+			if imp.Path() == l.ImportPath {
+				pkg = imp
+				break
+			}
+		}
+	}
+	if pkg == nil {
+		return link
+	}
+
+	if l.Name == "" {
+		link.Def = pkgDefKey(pkg, []string{})
+		return link
+	}
+	if obj := lookupDocLink(pkg, l.Recv, l.Name); obj != nil {
+		if key, _, err := c.g.defInfo(obj); err == nil {
+			link.Def = key
+		}
+	}
+	return link
+}
+
+// lookupDocLink returns the package-level object named name in pkg (or,
+// if recv is not empty, the method or field named name of the type
+// named recv), or nil if there is none.
+func lookupDocLink(pkg *types.Package, recv, name string) types.Object {
+	if recv == "" {
+		return pkg.Scope().Lookup(name)
+	}
+	tn, ok := pkg.Scope().Lookup(recv).(*types.TypeName)
+	if !ok {
+		return nil
+	}
+	obj, _, _ := types.LookupFieldOrMethod(tn.Type(), true, pkg, name)
+	return obj
+}
@@ -0,0 +1,160 @@
+package gog
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestStructuredDoc(t *testing.T) {
+	dir := t.TempDir()
+	fset := token.NewFileSet()
+	parse := func(name, src string) []*ast.File {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*ast.File{f}
+	}
+	a := checkPkg(t, fset, "a", parse("a.go", `package a
+func NewReader() {}
+`))
+	b := checkPkg(t, fset, "b", parse("b.go", `package b
+
+import "a"
+
+// F returns a [T], like [a.NewReader] and [T.M].
+//
+// # Usage
+//
+// Call it:
+//
+//	t := F()
+//
+// Then:
+//  1. First
+//  2. Second
+//
+// Deprecated: Use [New] instead.
+func F() T { return T{} }
+
+func New() T { return T{} }
+
+type T struct{}
+
+func (T) M() {}
+
+var _ = a.NewReader
+`), a)
+
+	g := New([]*packages.Package{a, b})
+	g.DocFormats = []string{DocMarkdown, DocStructured}
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	var markdown string
+	var sd *StructuredDoc
+	for _, doc := range g.Docs {
+		if doc.DefKey == nil || doc.DefKey.defPath() != (defPath{"b", "F"}) {
+			continue
+		}
+		switch doc.Format {
+		case DocMarkdown:
+			markdown = doc.Data
+		case DocStructured:
+			if err := json.Unmarshal([]byte(doc.Data), &sd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if want := "F returns a [T](#T), like [a.NewReader](/a#NewReader) and [T.M](#T.M).\n"; !strings.HasPrefix(markdown, want) {
+		t.Errorf("got markdown %q, want it to start with %q", markdown, want)
+	}
+
+	if sd == nil {
+		t.Fatal("no structured doc for F")
+	}
+	want := &StructuredDoc{
+		Summary:    "F returns a T, like a.NewReader and T.M.",
+		Deprecated: "Use New instead.",
+		Blocks: []*DocBlock{
+			{Kind: DocParagraph, Text: "F returns a T, like a.NewReader and T.M."},
+			{Kind: DocHeading, Text: "Usage"},
+			{Kind: DocParagraph, Text: "Call it:"},
+			{Kind: DocCode, Text: "t := F()\n"},
+			{Kind: DocParagraph, Text: "Then:"},
+			{Kind: DocList, Items: []string{"First", "Second"}, Ordered: true},
+			{Kind: DocParagraph, Text: "Deprecated: Use New instead."},
+		},
+		Links: []*DocLink{
+			{Text: "T", ImportPath: "b", Name: "T", Def: &DefKey{PackageImportPath: "b", Path: []string{"T"}}},
+			{Text: "a.NewReader", ImportPath: "a", Name: "NewReader", Def: &DefKey{PackageImportPath: "a", Path: []string{"NewReader"}}},
+			{Text: "T.M", ImportPath: "b", Recv: "T", Name: "M", Def: &DefKey{PackageImportPath: "b", Path: []string{"T", "M"}}},
+			{Text: "New", ImportPath: "b", Name: "New", Def: &DefKey{PackageImportPath: "b", Path: []string{"New"}}},
+		},
+	}
+	if !reflect.DeepEqual(sd, want) {
+		got, _ := json.MarshalIndent(sd, "", "  ")
+		wantJSON, _ := json.MarshalIndent(want, "", "  ")
+		t.Errorf("got structured doc\n%s\nwant\n%s", got, wantJSON)
+	}
+}
+
+func TestDocFormats(t *testing.T) {
+	formatsOf := func(formats []string) (map[string]int, error) {
+		name := filepath.Join(t.TempDir(), "foo.go")
+		if err := ioutil.WriteFile(name, []byte("// Package foo is foo.\npackage foo\n\n// F is F.\nfunc F() {}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pkgs := createPkgFromFiles(t, "foo", []string{name})
+		g := New(pkgs)
+		g.DocFormats = formats
+		if err := g.Graph(pkgs[0]); err != nil {
+			return nil, err
+		}
+		counts := make(map[string]int)
+		for _, doc := range g.Docs {
+			counts[doc.Format]++
+		}
+		return counts, nil
+	}
+
+	// There are 3 docs: the package's, F's and the package comment
+	// as a comment of the file.
+	tests := []struct {
+		formats []string
+		want    map[string]int
+	}{
+		{nil, map[string]int{DocHTML: 3, DocText: 3}},
+		{[]string{DocStructured}, map[string]int{DocStructured: 3}},
+		{[]string{DocText, DocMarkdown}, map[string]int{DocText: 3, DocMarkdown: 3}},
+	}
+	for _, test := range tests {
+		got, err := formatsOf(test.formats)
+		if err != nil {
+			t.Errorf("%v: %s", test.formats, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got docs %v, want %v", test.formats, got, test.want)
+		}
+	}
+
+	if _, err := formatsOf([]string{"text/rtf"}); err == nil {
+		t.Error("got no error for an unknown doc format")
+	}
+}
@@ -0,0 +1,107 @@
+package gog
+
+import (
+	"go/ast"
+	"go/build/constraint"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// A GoFile is the summary of a Go file of a package, which is the data
+// of the file's def.
+type GoFile struct {
+	// Imports are the file's import specs, in the order that they are
+	// declared.
+	Imports []*FileImport `json:",omitempty"`
+
+	// BuildConstraint is the build constraint expression of the file's
+	// //go:build line (or of its // +build lines, which are combined
+	// with &&), if it has one. The constraints implied by the file's
+	// name (such as f_linux.go) are not included.
+	BuildConstraint string `json:",omitempty"`
+
+	// PackageSpan is the span of the file's package clause.
+	PackageSpan [2]uint32
+}
+
+// A FileImport is an import spec of a Go file.
+type FileImport struct {
+	// Path is the import path, and Name is the name that the import
+	// spec gives the package (such as "_" or "."), if any.
+	Path string
+	Name string `json:",omitempty"`
+
+	// Span is the span of the import spec.
+	Span [2]uint32
+}
+
+// fileDefs returns the defs of pkg's Go files, whose paths are their
+// names (such as "a.go"), and the keys of those defs by the files'
+// paths.
+func (g *Grapher) fileDefs(pkg *packages.Package, unit string) ([]*Def, map[string]*DefKey) {
+	var defs []*Def
+	keys := make(map[string]*DefKey)
+	for _, f := range pkg.Syntax {
+		file := g.fset.Position(f.Pos()).Filename
+		name := filepath.Base(file)
+		if keys[file] != nil {
+			continue
+		}
+		keys[file] = fileDefKey(unit, name)
+
+		def := newFileDef(pkg, keys[file], name, file)
+		def.DeclSpan = [2]uint32{0, uint32(g.fset.File(f.Pos()).Size())}
+		def.Decl = "package " + f.Name.Name
+		def.GoFile = &GoFile{
+			BuildConstraint: buildConstraint(f),
+			PackageSpan:     [2]uint32{uint32(g.fset.Position(f.Package).Offset), uint32(g.fset.Position(f.Name.End()).Offset)},
+		}
+		for _, spec := range f.Imports {
+			imp := &FileImport{Span: makeSpan(g.fset, spec)}
+			imp.Path, _ = strconv.Unquote(spec.Path.Value)
+			if spec.Name != nil {
+				imp.Name = spec.Name.Name
+			}
+			def.GoFile.Imports = append(def.GoFile.Imports, imp)
+		}
+		defs = append(defs, def)
+	}
+	return defs, keys
+}
+
+// buildConstraint returns the build constraint expression of the
+// //go:build line of f (or of its // +build lines), or "" if it has
+// none. Build constraints must appear before the package clause.
+func buildConstraint(f *ast.File) string {
+	var plusBuild []constraint.Expr
+	for _, cg := range f.Comments {
+		if cg.Pos() >= f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if !constraint.IsGoBuild(c.Text) && !constraint.IsPlusBuild(c.Text) {
+				continue
+			}
+			x, err := constraint.Parse(c.Text)
+			if err != nil {
+				continue
+			}
+			if constraint.IsGoBuild(c.Text) {
+				// A //go:build line takes precedence over // +build
+				// lines.
+				return x.String()
+			}
+			plusBuild = append(plusBuild, x)
+		}
+	}
+	if len(plusBuild) == 0 {
+		return ""
+	}
+	x := plusBuild[0]
+	for _, y := range plusBuild[1:] {
+		x = &constraint.AndExpr{X: x, Y: y}
+	}
+	return x.String()
+}
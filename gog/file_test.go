@@ -0,0 +1,129 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestFileDefs(t *testing.T) {
+	srcs := map[string]string{
+		"a.go": `// Copyright notice.
+
+//go:build linux && !cgo
+// +build linux,!cgo
+
+// Package p is a package.
+package p
+
+import (
+	"fmt"
+	str "strings"
+	_ "embed"
+)
+
+var _ = fmt.Sprint
+var _ = str.ToUpper
+`,
+		"b.go": `// +build ignore_me
+// +build linux
+
+package p
+
+import . "os"
+
+var _ = Getpid
+`,
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range []string{"a.go", "b.go"} {
+		f, err := parser.ParseFile(fset, name, srcs[name], parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	pkg := checkPkg(t, fset, "p", files)
+	g := New([]*packages.Package{pkg})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	type fileImport struct{ path, name, text string }
+	type goFile struct {
+		imports         []fileImport
+		buildConstraint string
+		pkgClause       string
+		declEnd         uint32
+	}
+	want := map[defPath]goFile{
+		{"p", "a.go"}: {
+			imports: []fileImport{
+				{"fmt", "", `"fmt"`},
+				{"strings", "str", `str "strings"`},
+				{"embed", "_", `_ "embed"`},
+			},
+			buildConstraint: "linux && !cgo",
+			pkgClause:       "package p",
+			declEnd:         uint32(len(srcs["a.go"])),
+		},
+		{"p", "b.go"}: {
+			imports:         []fileImport{{"os", ".", `. "os"`}},
+			buildConstraint: "ignore_me && linux",
+			pkgClause:       "package p",
+			declEnd:         uint32(len(srcs["b.go"])),
+		},
+	}
+	got := make(map[defPath]goFile)
+	for _, def := range g.Defs {
+		if def.Kind != definfo.File {
+			continue
+		}
+		if def.GoFile == nil {
+			t.Errorf("file def %s has no GoFile", def.Name)
+			continue
+		}
+		src := srcs[def.Name]
+		f := goFile{
+			buildConstraint: def.GoFile.BuildConstraint,
+			pkgClause:       src[def.GoFile.PackageSpan[0]:def.GoFile.PackageSpan[1]],
+			declEnd:         def.DeclSpan[1],
+		}
+		for _, imp := range def.GoFile.Imports {
+			f.imports = append(f.imports, fileImport{imp.Path, imp.Name, src[imp.Span[0]:imp.Span[1]]})
+		}
+		got[def.DefKey.defPath()] = f
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got file defs\n%+v\nwant\n%+v", got, want)
+	}
+
+	// The refs of the import specs are made from the defs of their
+	// files.
+	type ref struct {
+		file, text string
+		from       defPath
+	}
+	var gotRefs []ref
+	for _, r := range g.Refs {
+		if r.From != nil {
+			gotRefs = append(gotRefs, ref{r.File, srcs[r.File][r.Span[0]:r.Span[1]], r.From.defPath()})
+		}
+	}
+	wantRefs := []ref{
+		{"a.go", `"fmt"`, defPath{"p", "a.go"}},
+		{"a.go", "str", defPath{"p", "a.go"}},
+		{"b.go", ".", defPath{"p", "b.go"}},
+	}
+	if !reflect.DeepEqual(gotRefs, wantRefs) {
+		t.Errorf("got refs from file defs %v, want %v", gotRefs, wantRefs)
+	}
+}
@@ -0,0 +1,111 @@
+package gog
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+)
+
+func TestGenerics(t *testing.T) {
+	src := `package p
+
+type List[T any] struct {
+	head *node[T]
+}
+
+type node[T any] struct {
+	v    T
+	next *node[T]
+}
+
+func (l *List[T]) Push(v T) {
+	l.head = &node[T]{v: v, next: l.head}
+}
+
+func Values[K comparable, V any](m map[K]V) []V {
+	var vs []V
+	for _, v := range m {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func use() {
+	var l List[int]
+	l.Push(1)
+	_ = l.head.v
+	_ = Values[string, int](nil)
+}
+`
+	pkgs := createPkg(t, "p", []string{src}, nil)
+	g := New(pkgs)
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+	checkAllIdents(t, g, pkgs)
+
+	type defInfo struct {
+		kind       string
+		typeParams []string
+		constraint string
+	}
+	want := map[defPath]defInfo{
+		{"p", ""}:            {kind: definfo.Package},
+		{"p", "List"}:        {kind: definfo.Type, typeParams: []string{"T any"}},
+		{"p", "List/T"}:      {kind: definfo.TypeParam, constraint: "any"},
+		{"p", "List/head"}:   {kind: definfo.Field},
+		{"p", "List/Push"}:   {kind: definfo.Method},
+		{"p", "List/Push/T"}: {kind: definfo.TypeParam, constraint: "any"},
+		{"p", "List/Push/l"}: {kind: definfo.Var},
+		{"p", "List/Push/v"}: {kind: definfo.Var},
+		{"p", "node"}:        {kind: definfo.Type, typeParams: []string{"T any"}},
+		{"p", "node/T"}:      {kind: definfo.TypeParam, constraint: "any"},
+		{"p", "node/v"}:      {kind: definfo.Field},
+		{"p", "node/next"}:   {kind: definfo.Field},
+		{"p", "Values"}:      {kind: definfo.Func, typeParams: []string{"K comparable", "V any"}},
+		{"p", "Values/K"}:    {kind: definfo.TypeParam, constraint: "comparable"},
+		{"p", "Values/V"}:    {kind: definfo.TypeParam, constraint: "any"},
+		{"p", "Values/m"}:    {kind: definfo.Var},
+		{"p", "Values/vs"}:   {kind: definfo.Var},
+		{"p", "Values/v"}:    {kind: definfo.Var},
+		{"p", "use"}:         {kind: definfo.Func},
+		{"p", "use/l"}:       {kind: definfo.Var},
+	}
+	got := make(map[defPath]defInfo)
+	for _, def := range g.Defs {
+		if def.Kind == definfo.File {
+			continue // see TestFileDefs
+		}
+		got[def.DefKey.defPath()] = defInfo{kind: def.Kind, typeParams: def.TypeParams, constraint: def.Constraint}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got defs %+v, want %+v", got, want)
+	}
+
+	// Refs through instantiations refer to the generic origins.
+	refs := make(map[string]defPath)
+	for _, ref := range g.Refs {
+		if !ref.IsDef {
+			refs[src[ref.Span[0]:ref.Span[1]]+"@"+strconv.Itoa(int(ref.Span[0]))] = ref.Def.defPath()
+		}
+	}
+	for _, want := range []struct {
+		ident string
+		def   defPath
+	}{
+		{"Push", defPath{"p", "List/Push"}},
+		{"head", defPath{"p", "List/head"}},
+		{"v", defPath{"p", "node/v"}},
+		{"Values", defPath{"p", "Values"}},
+	} {
+		i := strings.LastIndex(src, want.ident)
+		key := want.ident + "@" + strconv.Itoa(i)
+		if got := refs[key]; got != want.def {
+			t.Errorf("ref %s: got def %v, want %v", key, got, want.def)
+		}
+	}
+}
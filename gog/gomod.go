@@ -0,0 +1,382 @@
+package gog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// GoModModule is a module path and (possibly empty) version, as it
+// appears in go.mod require, replace and exclude directives.
+type GoModModule struct {
+	Path    string
+	Version string `json:",omitempty"`
+}
+
+// GoModReplace is a go.mod replace directive. If New.Version is empty,
+// New.Path is a filesystem path (relative to the directory containing
+// the go.mod file, or absolute).
+type GoModReplace struct {
+	Old GoModModule
+	New GoModModule
+}
+
+// IsLocal is true if the replacement is a directory on disk rather
+// than another module version.
+func (r GoModReplace) IsLocal() bool {
+	return r.New.Version == ""
+}
+
+type GoMod struct {
+	Module    string
+	GoVersion string
+	Require   []GoModModule
+	Replace   []GoModReplace
+	Exclude   []GoModModule
+}
+
+// LoadGoModFile reads and parses the go.mod file at path.
+func LoadGoModFile(path string) (GoMod, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return GoMod{}, err
+	}
+	m, err := ParseGoMod(data)
+	if err != nil {
+		err = fmt.Errorf("Unable to parse %s: %s", path, err.Error())
+	}
+	return m, err
+}
+
+// ParseGoMod parses the contents of a go.mod file. Only the directives
+// that srclib-go cares about (module, go, require, replace, exclude)
+// are recorded; others are skipped.
+func ParseGoMod(data []byte) (GoMod, error) {
+	var m GoMod
+	var block string // verb of the enclosing "verb (" block, if any
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; s.Scan(); lineno++ {
+		fields, err := goModFields(s.Text())
+		if err != nil {
+			return m, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		if block != "" {
+			if fields[0] == ")" {
+				block = ""
+				continue
+			}
+			if err := m.addDirective(block, fields); err != nil {
+				return m, fmt.Errorf("line %d: %s", lineno, err)
+			}
+			continue
+		}
+
+		if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		}
+		if err := m.addDirective(fields[0], fields[1:]); err != nil {
+			return m, fmt.Errorf("line %d: %s", lineno, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return m, err
+	}
+	if block != "" {
+		return m, fmt.Errorf("unterminated %s block", block)
+	}
+	return m, nil
+}
+
+func (m *GoMod) addDirective(verb string, args []string) error {
+	switch verb {
+	case "module":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: module module/path")
+		}
+		m.Module = args[0]
+	case "go":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: go 1.23")
+		}
+		m.GoVersion = args[0]
+	case "require", "exclude":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s module/path v1.2.3", verb)
+		}
+		mod := GoModModule{Path: args[0], Version: args[1]}
+		if verb == "require" {
+			m.Require = append(m.Require, mod)
+		} else {
+			m.Exclude = append(m.Exclude, mod)
+		}
+	case "replace":
+		arrow := -1
+		for i, a := range args {
+			if a == "=>" {
+				arrow = i
+				break
+			}
+		}
+		if arrow < 1 || arrow > 2 || len(args)-arrow-1 < 1 || len(args)-arrow-1 > 2 {
+			return fmt.Errorf("usage: replace module/path [v1.2.3] => other/module v1.4 or replace module/path [v1.2.3] => ../local/directory")
+		}
+		var r GoModReplace
+		r.Old.Path = args[0]
+		if arrow == 2 {
+			r.Old.Version = args[1]
+		}
+		r.New.Path = args[arrow+1]
+		if len(args) == arrow+3 {
+			r.New.Version = args[arrow+2]
+		}
+		m.Replace = append(m.Replace, r)
+	}
+	return nil
+}
+
+// RequiredVersion returns the version of the module that provides
+// importPath, taking replace and exclude directives into account. The
+// returned module path is the path of the requirement that matched
+// (not of its replacement). If no requirement provides importPath, ok
+// is false.
+func (m *GoMod) RequiredVersion(importPath string) (mod GoModModule, replace *GoModReplace, ok bool) {
+	for _, req := range m.Require {
+		if !ImportPathInModule(importPath, req.Path) || len(req.Path) <= len(mod.Path) {
+			continue
+		}
+		if m.isExcluded(req) {
+			continue
+		}
+		mod, ok = req, true
+	}
+	if !ok {
+		return mod, nil, false
+	}
+	for i, r := range m.Replace {
+		if r.Old.Path == mod.Path && (r.Old.Version == "" || r.Old.Version == mod.Version) {
+			replace = &m.Replace[i]
+			if r.Old.Version != "" {
+				// A version-specific replacement takes precedence.
+				break
+			}
+		}
+	}
+	return mod, replace, true
+}
+
+func (m *GoMod) isExcluded(mod GoModModule) bool {
+	for _, e := range m.Exclude {
+		if e == mod {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportPathInModule is true if importPath is the module path or a
+// package path inside the module.
+func ImportPathInModule(importPath, modulePath string) bool {
+	return importPath == modulePath || strings.HasPrefix(importPath, modulePath+"/")
+}
+
+// goModFields splits a go.mod line into its fields, removing
+// comments and unquoting quoted strings.
+func goModFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" || strings.HasPrefix(line, "//") {
+			return fields, nil
+		}
+		switch line[0] {
+		case '"', '`':
+			end := -1
+			for i := 1; i < len(line); i++ {
+				if line[0] == '"' && line[i] == '\\' {
+					i++
+					continue
+				}
+				if line[i] == line[0] {
+					end = i
+					break
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			s, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, s)
+			line = line[end+1:]
+		default:
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if i := strings.Index(line, "//"); i >= 0 && (end < 0 || i < end) {
+				end = i
+			}
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+		}
+	}
+}
+
+// GoSum maps module paths to the versions whose contents (not just
+// go.mod files) are recorded in a go.sum file.
+type GoSum map[string][]string
+
+// LoadGoSumFile reads and parses the go.sum file at path.
+func LoadGoSumFile(path string) (GoSum, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseGoSum(data)
+	if err != nil {
+		err = fmt.Errorf("Unable to parse %s: %s", path, err.Error())
+	}
+	return s, err
+}
+
+// ParseGoSum parses the contents of a go.sum file.
+func ParseGoSum(data []byte) (GoSum, error) {
+	sum := GoSum{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; s.Scan(); lineno++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 3 fields, got %d", lineno, len(fields))
+		}
+		if strings.HasSuffix(fields[1], "/go.mod") {
+			// Only the module's go.mod file was downloaded, so this
+			// version's packages are not in the build.
+			continue
+		}
+		sum[fields[0]] = append(sum[fields[0]], fields[1])
+	}
+	return sum, s.Err()
+}
+
+// ModuleVersion returns the module that provides importPath, at the
+// highest version recorded in the go.sum file that is not excluded. It
+// is a fallback for go.mod files that do not list all of the modules
+// in the build (which was the case before Go 1.17).
+func (s GoSum) ModuleVersion(importPath string, exclude []GoModModule) (mod GoModModule, ok bool) {
+	for path, versions := range s {
+		if !ImportPathInModule(importPath, path) || len(path) < len(mod.Path) {
+			continue
+		}
+	versions:
+		for _, v := range versions {
+			for _, e := range exclude {
+				if e.Path == path && e.Version == v {
+					continue versions
+				}
+			}
+			if path != mod.Path || CompareModuleVersions(v, mod.Version) > 0 {
+				mod, ok = GoModModule{Path: path, Version: v}, true
+			}
+		}
+	}
+	return mod, ok
+}
+
+// CompareModuleVersions compares two semantic versions (like "v1.2.3"
+// or "v0.0.0-20190101000000-abcdefabcdef") and returns -1, 0 or +1.
+// Build metadata (like "+incompatible") is ignored.
+func CompareModuleVersions(a, b string) int {
+	a, b = stripBuildMetadata(a), stripBuildMetadata(b)
+	aCore, aPre := splitPrerelease(a)
+	bCore, bPre := splitPrerelease(b)
+	if c := compareDotted(aCore, bCore); c != 0 {
+		return c
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return compareDotted(aPre, bPre)
+}
+
+// ModuleVersionRev returns the VCS revision that a module version
+// refers to: the commit hash prefix of a pseudo-version, or the tag
+// otherwise.
+func ModuleVersionRev(version string) string {
+	version = stripBuildMetadata(version)
+	if m := pseudoVersionRev.FindStringSubmatch(version); m != nil {
+		return m[1]
+	}
+	return version
+}
+
+var pseudoVersionRev = regexp.MustCompile(`[-.][0-9]{14}-([0-9a-f]{12})$`)
+
+func stripBuildMetadata(v string) string {
+	if i := strings.Index(v, "+"); i >= 0 {
+		return v[:i]
+	}
+	return v
+}
+
+func splitPrerelease(v string) (core, pre string) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.Index(v, "-"); i >= 0 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+// compareDotted compares dot-separated identifiers, numerically if
+// both are numbers and lexically otherwise.
+func compareDotted(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1 // numeric identifiers have lower precedence
+		case bErr == nil:
+			return 1
+		case as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package gog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGoMod(t *testing.T) {
+	src := `// comment
+module example.com/a // trailing comment
+
+go 1.21
+
+require example.com/b v1.2.3
+require (
+	example.com/c v0.0.0-20190101000000-abcdefabcdef // indirect
+	"example.com/c/sub" v1.0.0
+)
+
+replace example.com/b => ../b
+replace example.com/c v0.0.0-20190101000000-abcdefabcdef => example.com/fork/c v0.1.0
+
+exclude example.com/d v1.0.0
+`
+	m, err := ParseGoMod([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GoMod{
+		Module:    "example.com/a",
+		GoVersion: "1.21",
+		Require: []GoModModule{
+			{"example.com/b", "v1.2.3"},
+			{"example.com/c", "v0.0.0-20190101000000-abcdefabcdef"},
+			{"example.com/c/sub", "v1.0.0"},
+		},
+		Replace: []GoModReplace{
+			{Old: GoModModule{Path: "example.com/b"}, New: GoModModule{Path: "../b"}},
+			{Old: GoModModule{"example.com/c", "v0.0.0-20190101000000-abcdefabcdef"}, New: GoModModule{"example.com/fork/c", "v0.1.0"}},
+		},
+		Exclude: []GoModModule{{"example.com/d", "v1.0.0"}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %+v, want %+v", m, want)
+	}
+
+	tests := []struct {
+		importPath  string
+		wantModule  string
+		wantReplace string
+		wantOK      bool
+	}{
+		{"example.com/b/pkg", "example.com/b", "../b", true},
+		{"example.com/c/x", "example.com/c", "example.com/fork/c", true},
+		{"example.com/c/sub/y", "example.com/c/sub", "", true},
+		{"example.com/cc", "", "", false},
+		{"fmt", "", "", false},
+	}
+	for _, test := range tests {
+		mod, replace, ok := m.RequiredVersion(test.importPath)
+		if ok != test.wantOK || mod.Path != test.wantModule {
+			t.Errorf("%s: got module %q (ok=%v), want %q (ok=%v)", test.importPath, mod.Path, ok, test.wantModule, test.wantOK)
+		}
+		var gotReplace string
+		if replace != nil {
+			gotReplace = replace.New.Path
+		}
+		if gotReplace != test.wantReplace {
+			t.Errorf("%s: got replacement %q, want %q", test.importPath, gotReplace, test.wantReplace)
+		}
+	}
+}
+
+func TestGoSumModuleVersion(t *testing.T) {
+	src := `example.com/b v1.2.3 h1:abc=
+example.com/b v1.2.3/go.mod h1:def=
+example.com/b v1.10.0 h1:abc=
+example.com/b v1.11.0/go.mod h1:def=
+example.com/b/sub v0.0.0-20190101000000-abcdefabcdef h1:abc=
+`
+	sum, err := ParseGoSum([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		importPath string
+		exclude    []GoModModule
+		want       GoModModule
+		wantOK     bool
+	}{
+		{"example.com/b/x", nil, GoModModule{"example.com/b", "v1.10.0"}, true},
+		{"example.com/b/x", []GoModModule{{"example.com/b", "v1.10.0"}}, GoModModule{"example.com/b", "v1.2.3"}, true},
+		{"example.com/b/sub/y", nil, GoModModule{"example.com/b/sub", "v0.0.0-20190101000000-abcdefabcdef"}, true},
+		{"example.com/c", nil, GoModModule{}, false},
+	}
+	for _, test := range tests {
+		mod, ok := sum.ModuleVersion(test.importPath, test.exclude)
+		if mod != test.want || ok != test.wantOK {
+			t.Errorf("%s (exclude %v): got %v (ok=%v), want %v (ok=%v)", test.importPath, test.exclude, mod, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestCompareModuleVersions(t *testing.T) {
+	ordered := []string{
+		"v0.0.0-20180101000000-abcdefabcdef",
+		"v0.0.0-20190101000000-abcdefabcdef",
+		"v0.1.0",
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-beta",
+		"v1.0.0",
+		"v1.2.0",
+		"v1.10.0",
+		"v2.0.0+incompatible",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := CompareModuleVersions(ordered[i], ordered[j]); got != want {
+				t.Errorf("CompareModuleVersions(%q, %q) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+}
+
+func TestModuleVersionRev(t *testing.T) {
+	tests := map[string]string{
+		"v1.2.3":                                                "v1.2.3",
+		"v2.0.0+incompatible":                                   "v2.0.0",
+		"v0.0.0-20190101000000-abcdefabcdef":                    "abcdefabcdef",
+		"v1.2.4-0.20190101000000-abcdefabcdef":                  "abcdefabcdef",
+		"v1.2.3-pre.0.20190101000000-abcdefabcdef+incompatible": "abcdefabcdef",
+	}
+	for version, want := range tests {
+		if got := ModuleVersionRev(version); got != want {
+			t.Errorf("ModuleVersionRev(%q) = %q, want %q", version, got, want)
+		}
+	}
+}
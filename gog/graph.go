@@ -1,17 +1,20 @@
 package gog
 
 import (
+	"fmt"
 	"go/ast"
 	"go/constant"
+	"go/token"
 	"log"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"sync"
 
 	"go/types"
 
-	_ "golang.org/x/tools/go/gcimporter15"
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
 )
 
 type Output struct {
@@ -23,14 +26,50 @@ type Output struct {
 type Grapher struct {
 	SkipDocs bool
 
-	program *loader.Program
+	// DocFormats are the formats that doc comments are emitted in
+	// (DocHTML, DocText, DocMarkdown or DocStructured). If empty,
+	// DefaultDocFormats are used.
+	DocFormats []string
+
+	// Sink, if set, receives the graph data of each package instead
+	// of Output. This avoids keeping the graph data of all packages
+	// in memory.
+	Sink Sink
+
+	fset *token.FileSet
+
+	// files maps the files of the packages that have syntax to their
+	// packages (see pathEnclosingInterval).
+	files map[*token.File]*packageFile
+
+	// pkgs are the packages passed to New. allPkgs are pkgs and their
+	// dependencies that have syntax and type information, and can
+	// therefore be graphed.
+	pkgs    []*packages.Package
+	allPkgs []*packages.Package
 
 	defCacheLock sync.Mutex
 	defInfoCache map[types.Object]*defInfo
 	defKeyCache  map[types.Object]*DefKey
 
+	// outputLock protects Output (and calls to Sink), skipResolve,
+	// seenDocObjs and seenDocKeys, which are written to while packages
+	// are graphed (possibly concurrently; see GraphPackages). The other
+	// maps are only written to in New.
+	outputLock sync.Mutex
+
 	structFields map[*types.Var]*structField
 
+	// implements maps concrete types to the interfaces they implement,
+	// and implementedBy maps interfaces to the concrete types that
+	// implement them (see buildImplements).
+	implements    map[*types.TypeName][]*types.TypeName
+	implementedBy map[*types.TypeName][]*types.TypeName
+
+	// methodNames are the MethodNames of the packages whose types
+	// buildImplements matched, by import path.
+	methodNames map[string]*MethodNames
+
 	scopeNodes map[*types.Scope]ast.Node
 
 	paths      map[types.Object][]string
@@ -47,16 +86,30 @@ type Grapher struct {
 
 	seenDocObjs map[types.Object]struct{}
 	seenDocKeys map[string]struct{}
+
+	// pkgErrs are the errors that occurred in New while preparing each
+	// package to be graphed, which Graph returns for the package.
+	pkgErrs map[*packages.Package]error
 }
 
-func New(prog *loader.Program) *Grapher {
+// New creates a grapher for pkgs, which must have been loaded (by
+// go/packages) with at least the NeedTypes, NeedSyntax and
+// NeedTypesInfo modes and a shared FileSet. Dependencies of pkgs that
+// were loaded from export data (without syntax) can be referred to but
+// not graphed.
+func New(pkgs []*packages.Package) *Grapher {
 	g := &Grapher{
-		program:      prog,
+		pkgs:         pkgs,
+		files:        make(map[*token.File]*packageFile),
 		defInfoCache: make(map[types.Object]*defInfo),
 		defKeyCache:  make(map[types.Object]*DefKey),
 
 		structFields: make(map[*types.Var]*structField),
 
+		implements:    make(map[*types.TypeName][]*types.TypeName),
+		implementedBy: make(map[*types.TypeName][]*types.TypeName),
+		methodNames:   make(map[string]*MethodNames),
+
 		scopeNodes: make(map[*types.Scope]ast.Node),
 
 		paths:      make(map[types.Object][]string),
@@ -65,32 +118,107 @@ func New(prog *loader.Program) *Grapher {
 		pkgscope:   make(map[types.Object]bool),
 
 		skipResolve: make(map[*ast.Ident]struct{}),
+
+		pkgErrs: make(map[*packages.Package]error),
 	}
 
-	for _, pkgInfo := range sortedPkgs(prog.AllPackages) {
-		g.buildStructFields(pkgInfo)
-		g.buildScopeInfo(pkgInfo)
-		g.assignPathsInPackage(pkgInfo)
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if g.fset == nil {
+			g.fset = pkg.Fset
+		}
+		if pkg.Types != nil && pkg.TypesInfo != nil && len(pkg.Syntax) > 0 {
+			g.allPkgs = append(g.allPkgs, pkg)
+		}
+	})
+	if g.fset == nil {
+		g.fset = token.NewFileSet()
 	}
+	sort.Sort(packageInfos(g.allPkgs))
+
+	hasSyntax := make(map[*types.Package]bool, len(g.allPkgs))
+	for _, pkg := range g.allPkgs {
+		hasSyntax[pkg.Types] = true
+		for _, f := range pkg.Syntax {
+			g.files[g.fset.File(f.Pos())] = &packageFile{pkg, f}
+		}
+		if err := g.buildStructFields(pkg); err != nil {
+			g.pkgErrs[pkg] = err
+		}
+		g.buildScopeInfo(pkg)
+		g.assignPathsInPackage(pkg.Types)
+	}
+
+	// Assign paths to the package-level objects of the dependencies
+	// that were loaded from export data, so that refs to them can be
+	// resolved.
+	deps := typesOnlyDeps(g.allPkgs, hasSyntax)
+	for _, pkg := range deps {
+		g.assignPathsInPackage(pkg)
+	}
+
+	typesPkgs := make([]*types.Package, 0, len(g.allPkgs)+len(deps))
+	for _, pkg := range g.allPkgs {
+		typesPkgs = append(typesPkgs, pkg.Types)
+	}
+	g.buildImplements(append(typesPkgs, deps...), hasSyntax)
 
 	return g
 }
 
-func sortedPkgs(m map[*types.Package]*loader.PackageInfo) []*loader.PackageInfo {
-	var pis []*loader.PackageInfo
-	for _, pi := range m {
-		pis = append(pis, pi)
+// typesOnlyDeps returns the (transitive) dependencies of pkgs that do
+// not have syntax, sorted by import path.
+func typesOnlyDeps(pkgs []*packages.Package, hasSyntax map[*types.Package]bool) []*types.Package {
+	seen := make(map[*types.Package]bool)
+	var deps []*types.Package
+	var visit func(*types.Package)
+	visit = func(pkg *types.Package) {
+		for _, imp := range pkg.Imports() {
+			if seen[imp] || hasSyntax[imp] {
+				continue
+			}
+			seen[imp] = true
+			deps = append(deps, imp)
+			visit(imp)
+		}
+	}
+	for _, pkg := range pkgs {
+		visit(pkg.Types)
+	}
+	sort.Sort(typesPackages(deps))
+	return deps
+}
+
+// packageFile is a file in a package that has syntax.
+type packageFile struct {
+	pkg  *packages.Package
+	file *ast.File
+}
+
+// pathEnclosingInterval returns the package containing the source
+// interval [start, end) and the path of AST nodes enclosing it (as
+// astutil.PathEnclosingInterval does). It returns a nil package and
+// path if the interval is not in a package that has syntax.
+func (g *Grapher) pathEnclosingInterval(start, end token.Pos) (pkg *packages.Package, path []ast.Node, exact bool) {
+	pf, ok := g.files[g.fset.File(start)]
+	if !ok {
+		return nil, nil, false
 	}
-	sort.Sort(packageInfos(pis))
-	return pis
+	path, exact = astutil.PathEnclosingInterval(pf.file, start, end)
+	return pf.pkg, path, exact
 }
 
-type packageInfos []*loader.PackageInfo
+type packageInfos []*packages.Package
 
 func (pi packageInfos) Len() int           { return len(pi) }
-func (pi packageInfos) Less(i, j int) bool { return pi[i].Pkg.Path() < pi[j].Pkg.Path() }
+func (pi packageInfos) Less(i, j int) bool { return pi[i].ID < pi[j].ID }
 func (pi packageInfos) Swap(i, j int)      { pi[i], pi[j] = pi[j], pi[i] }
 
+type typesPackages []*types.Package
+
+func (tp typesPackages) Len() int           { return len(tp) }
+func (tp typesPackages) Less(i, j int) bool { return tp[i].Path() < tp[j].Path() }
+func (tp typesPackages) Swap(i, j int)      { tp[i], tp[j] = tp[j], tp[i] }
+
 func (g *Grapher) checkDef(def *Def) bool {
 	//	log.Printf("SYM %v %v", def.DefKey.PackageImportPath, def.DefKey.Path)
 	if filepath.Base(def.File) == "C" {
@@ -109,9 +237,10 @@ func (g *Grapher) checkRef(ref *Ref) bool {
 	return true
 }
 
+// GraphImported graphs the packages passed to New.
 func (g *Grapher) GraphImported() error {
-	for _, pkgInfo := range g.program.Imported {
-		err := g.Graph(pkgInfo)
+	for _, pkg := range g.pkgs {
+		err := g.Graph(pkg)
 		if err != nil {
 			return err
 		}
@@ -119,9 +248,11 @@ func (g *Grapher) GraphImported() error {
 	return nil
 }
 
+// GraphAll graphs the packages passed to New and all of their
+// dependencies that have syntax.
 func (g *Grapher) GraphAll() error {
-	for _, pkgInfo := range g.program.AllPackages {
-		err := g.Graph(pkgInfo)
+	for _, pkg := range g.allPkgs {
+		err := g.Graph(pkg)
 		if err != nil {
 			return err
 		}
@@ -129,12 +260,17 @@ func (g *Grapher) GraphAll() error {
 	return nil
 }
 
-func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
-	if len(pkgInfo.Files) == 0 {
-		log.Printf("warning: attempted to graph package %+v with no files", pkgInfo)
+func (g *Grapher) Graph(pkg *packages.Package) error {
+	if len(pkg.Syntax) == 0 || pkg.TypesInfo == nil {
+		log.Printf("warning: attempted to graph package %s with no files", pkg.ID)
 		return nil
 	}
+	if err := g.pkgErrs[pkg]; err != nil {
+		return err
+	}
 
+	unit := unitImportPath(pkg.Types)
+	kinds := refKinds(pkg)
 	seen := make(map[ast.Node]struct{})
 	skipResolveObjs := make(map[types.Object]struct{})
 
@@ -144,25 +280,45 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 	var pkgRefs []*Ref
 	var pkgDocs []*Doc
 
-	for node, obj := range pkgInfo.Implicits {
+	// Create the defs of the Go files, from which the refs of their
+	// import specs are made.
+	fileDefs, fileKeys := g.fileDefs(pkg, unit)
+	for _, def := range fileDefs {
+		if ok := g.checkDef(def); ok {
+			pkgDefs = append(pkgDefs, def)
+		}
+	}
+	fileKey := func(node ast.Node) *DefKey {
+		return fileKeys[g.fset.Position(node.Pos()).Filename]
+	}
+
+	for node, obj := range pkg.TypesInfo.Implicits {
 		if importSpec, ok := node.(*ast.ImportSpec); ok {
-			ref, err := g.NewRef(importSpec, obj, pkgInfo.Pkg.Path())
+			ref, err := g.NewRef(importSpec, obj, unit)
 			if err != nil {
 				return err
 			}
+			ref.Kind = RefImport
+			ref.From = fileKey(importSpec)
 			if ok := g.checkRef(ref); ok {
 				pkgRefs = append(pkgRefs, ref)
 			}
 			seen[importSpec] = struct{}{}
 		} else if x, ok := node.(*ast.Ident); ok {
-			g.skipResolve[x] = struct{}{}
+			g.skip(x)
 		} else if _, ok := node.(*ast.CaseClause); ok {
 			// type-specific *Var for each type switch case clause
 			skipResolveObjs[obj] = struct{}{}
 		}
 	}
 
-	pkgDef, err := g.NewPackageDef(pkgInfo, pkgInfo.Pkg)
+	asmBodies, asmRefs, err := g.asmBodies(pkg, unit)
+	if err != nil {
+		return err
+	}
+	pkgRefs = append(pkgRefs, asmRefs...)
+
+	pkgDef, err := g.NewPackageDef(pkg)
 	if err != nil {
 		return err
 	}
@@ -170,17 +326,17 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 		pkgDefs = append(pkgDefs, pkgDef)
 	}
 
-	for ident, obj := range pkgInfo.Defs {
+	for ident, obj := range pkg.TypesInfo.Defs {
 		_, isLabel := obj.(*types.Label)
 		if obj == nil || ident.Name == "_" || isLabel {
-			g.skipResolve[ident] = struct{}{}
+			g.skip(ident)
 			continue
 		}
 
 		if v, isVar := obj.(*types.Var); isVar && obj.Pos() != ident.Pos() && !v.IsField() {
 			// If this is an assign statement reassignment of existing var, treat this as a
 			// use (not a def).
-			pkgInfo.Uses[ident] = obj
+			pkg.TypesInfo.Uses[ident] = obj
 			continue
 		}
 
@@ -192,24 +348,29 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 			if err != nil {
 				return err
 			}
+			def.AsmBodies = asmBodies[obj]
 			if ok := g.checkDef(def); ok {
 				pkgDefs = append(pkgDefs, def)
 			}
 		}
 
-		ref, err := g.NewRef(ident, obj, pkgInfo.Pkg.Path())
+		ref, err := g.NewRef(ident, obj, unit)
 		if err != nil {
 			return err
 		}
 		ref.IsDef = true
+		if isPkg {
+			// the name of a renamed import spec
+			ref.From = fileKey(ident)
+		}
 		if ok := g.checkRef(ref); ok {
 			pkgRefs = append(pkgRefs, ref)
 		}
 	}
 
-	for ident, obj := range pkgInfo.Uses {
+	for ident, obj := range pkg.TypesInfo.Uses {
 		if _, isLabel := obj.(*types.Label); isLabel {
-			g.skipResolve[ident] = struct{}{}
+			g.skip(ident)
 			continue
 		}
 
@@ -218,7 +379,7 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 		}
 
 		if _, skip := skipResolveObjs[obj]; skip {
-			g.skipResolve[ident] = struct{}{}
+			g.skip(ident)
 		}
 
 		if _, seen := seen[ident]; seen {
@@ -229,10 +390,11 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 			continue
 		}
 
-		ref, err := g.NewRef(ident, obj, pkgInfo.Pkg.Path())
+		ref, err := g.NewRef(ident, obj, unit)
 		if err != nil {
 			return err
 		}
+		ref.Kind = refKind(ident, obj, kinds)
 		if ok := g.checkRef(ref); ok {
 			pkgRefs = append(pkgRefs, ref)
 		}
@@ -240,9 +402,9 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 
 	// Create a ref that represent the name of the package ("package foo")
 	// for each file.
-	for _, f := range pkgInfo.Files {
-		pkgObj := types.NewPkgName(f.Name.Pos(), pkgInfo.Pkg, pkgInfo.Pkg.Name(), pkgInfo.Pkg)
-		ref, err := g.NewRef(f.Name, pkgObj, pkgInfo.Pkg.Path())
+	for _, f := range pkg.Syntax {
+		pkgObj := types.NewPkgName(f.Name.Pos(), pkg.Types, pkg.Types.Name(), pkg.Types)
+		ref, err := g.NewRef(f.Name, pkgObj, unit)
 		if err != nil {
 			return err
 		}
@@ -251,21 +413,118 @@ func (g *Grapher) Graph(pkgInfo *loader.PackageInfo) error {
 		}
 	}
 
+	// Create the defs of the C declarations of a cgo package and the
+	// refs to them.
+	cDefs, cRefs, err := g.cgoDefsAndRefs(pkg, unit)
+	if err != nil {
+		return err
+	}
+	pkgDefs = append(pkgDefs, cDefs...)
+	pkgRefs = append(pkgRefs, cRefs...)
+
+	// Create the refs in directive comments (and the defs of
+	// embedded files).
+	directiveDefs, directiveRefs, err := g.directiveRefs(pkg, unit)
+	if err != nil {
+		return err
+	}
+	pkgDefs = append(pkgDefs, directiveDefs...)
+	pkgRefs = append(pkgRefs, directiveRefs...)
+
 	if !g.SkipDocs {
-		pkgDocs, err = g.emitDocs(pkgInfo)
+		pkgDocs, err = g.emitDocs(pkg)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Transfer pkg graph data to output
-	g.Defs = append(g.Defs, pkgDefs...)
-	g.Refs = append(g.Refs, pkgRefs...)
-	g.Docs = append(g.Docs, pkgDocs...)
+	// Transfer pkg graph data to the sink (or output). Sort it first so
+	// that each package's records are emitted in a deterministic order.
+	pkgOutput := Output{Defs: pkgDefs, Refs: pkgRefs, Docs: pkgDocs}
+	pkgOutput.Sort()
+	g.outputLock.Lock()
+	defer g.outputLock.Unlock()
+	if g.Sink != nil {
+		return g.Sink.Emit(pkg, pkgOutput.Defs, pkgOutput.Refs, pkgOutput.Docs)
+	}
+	return g.Output.Emit(pkg, pkgOutput.Defs, pkgOutput.Refs, pkgOutput.Docs)
+}
 
+// A Sink receives the defs, refs and docs of each package as soon as
+// the package is graphed. The grapher never calls a sink's Emit method
+// concurrently, even when packages are graphed concurrently.
+//
+// Callers that emit graph data that is not from a single package (such
+// as output merged by MergeOutputs) pass a nil pkg.
+type Sink interface {
+	Emit(pkg *packages.Package, defs []*Def, refs []*Ref, docs []*Doc) error
+}
+
+// Emit implements Sink by appending defs, refs and docs to o.
+func (o *Output) Emit(pkg *packages.Package, defs []*Def, refs []*Ref, docs []*Doc) error {
+	o.Defs = append(o.Defs, defs...)
+	o.Refs = append(o.Refs, refs...)
+	o.Docs = append(o.Docs, docs...)
 	return nil
 }
 
+// skip adds ident to the set of idents that the grapher does not
+// resolve.
+func (g *Grapher) skip(ident *ast.Ident) {
+	g.outputLock.Lock()
+	defer g.outputLock.Unlock()
+	g.skipResolve[ident] = struct{}{}
+}
+
+// GraphError is an error that occurred while graphing a package.
+type GraphError struct {
+	Pkg *packages.Package
+	Err error
+}
+
+func (e *GraphError) Error() string {
+	return fmt.Sprintf("graphing package %s: %s", e.Pkg.ID, e.Err)
+}
+
+// GraphPackages graphs pkgs, using up to workers goroutines (or
+// GOMAXPROCS goroutines if workers <= 0). Packages that fail to graph
+// do not stop the others from being graphed; their errors are
+// returned in the order of pkgs. When it returns, Output is
+// sorted, so the result does not depend on the order in which the
+// packages finished. (If Sink is set, packages are emitted to it in
+// the order in which they finish.)
+func (g *Grapher) GraphPackages(pkgs []*packages.Package, workers int) []*GraphError {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	errs := make([]error, len(pkgs))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, pkg := range pkgs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, pkg *packages.Package) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = g.Graph(pkg)
+		}(i, pkg)
+	}
+	wg.Wait()
+
+	g.Output.Sort()
+
+	var graphErrs []*GraphError
+	for i, err := range errs {
+		if err != nil {
+			graphErrs = append(graphErrs, &GraphError{Pkg: pkgs[i], Err: err})
+		}
+	}
+	return graphErrs
+}
+
 type defInfo struct {
 	exported bool
 	pkgscope bool
@@ -280,6 +539,10 @@ func (g *Grapher) defKey(obj types.Object) (*DefKey, error) {
 }
 
 func (g *Grapher) defInfo(obj types.Object) (*DefKey, *defInfo, error) {
+	// Refer to the methods and fields of instantiated generic types
+	// (and to instantiated generic methods) by their generic origins.
+	obj = originObject(obj)
+
 	key, info := g.lookupDefInfo(obj)
 	if key != nil && info != nil {
 		return key, info, nil
@@ -310,18 +573,18 @@ func (g *Grapher) lookupDefInfo(obj types.Object) (*DefKey, *defInfo) {
 func (g *Grapher) makeDefInfo(obj types.Object) (*DefKey, *defInfo, error) {
 	switch obj := obj.(type) {
 	case *types.Builtin:
-		return &DefKey{"builtin", []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
+		return &DefKey{PackageImportPath: "builtin", Path: []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
 	case *types.Nil:
-		return &DefKey{"builtin", []string{"nil"}}, &defInfo{pkgscope: false, exported: true}, nil
+		return &DefKey{PackageImportPath: "builtin", Path: []string{"nil"}}, &defInfo{pkgscope: false, exported: true}, nil
 	case *types.TypeName:
 		if basic, ok := obj.Type().(*types.Basic); ok {
-			return &DefKey{"builtin", []string{basic.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
+			return &DefKey{PackageImportPath: "builtin", Path: []string{basic.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
 		}
 		if obj.Name() == "error" {
-			return &DefKey{"builtin", []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
+			return &DefKey{PackageImportPath: "builtin", Path: []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
 		}
 	case *types.PkgName:
-		return &DefKey{obj.Imported().Path(), []string{}}, &defInfo{pkgscope: false, exported: true}, nil
+		return pkgDefKey(obj.Imported(), []string{}), &defInfo{pkgscope: false, exported: true}, nil
 	case *types.Const:
 		var pkg string
 		if obj.Pkg() == nil {
@@ -330,24 +593,27 @@ func (g *Grapher) makeDefInfo(obj types.Object) (*DefKey, *defInfo, error) {
 			pkg = obj.Pkg().Path()
 		}
 		if obj.Val().Kind() == constant.Bool && pkg == "builtin" {
-			return &DefKey{pkg, []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
+			return &DefKey{PackageImportPath: pkg, Path: []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
 		}
 	}
 
 	if obj.Pkg() == nil {
 		// builtin
-		return &DefKey{"builtin", []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
+		return &DefKey{PackageImportPath: "builtin", Path: []string{obj.Name()}}, &defInfo{pkgscope: false, exported: true}, nil
 	}
 
-	path := g.path(obj)
+	path, err := g.path(obj)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Handle the case where a dir has 2 main packages that are not
 	// intended to be compiled together and have overlapping def
 	// paths. Prefix the def path with the filename.
 	if obj.Pkg().Name() == "main" {
-		p := g.program.Fset.Position(obj.Pos())
+		p := g.fset.Position(obj.Pos())
 		path = append([]string{filepath.Base(p.Filename)}, path...)
 	}
 
-	return &DefKey{obj.Pkg().Path(), path}, &defInfo{pkgscope: g.pkgscope[obj], exported: g.exported[obj]}, nil
+	return pkgDefKey(obj.Pkg(), path), &defInfo{pkgscope: g.pkgscope[obj], exported: g.exported[obj]}, nil
 }
@@ -0,0 +1,71 @@
+package gog
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// createPkgs creates a program with n packages p0, p1, ..., whose
+// files are written to dir (so that their docs can be read).
+func createPkgs(t *testing.T, dir string, n int) []*packages.Package {
+	fset := token.NewFileSet()
+	var pkgs []*packages.Package
+	for i := 0; i < n; i++ {
+		src := fmt.Sprintf(`// Package p%d is a package.
+package p%d
+
+// T is a type.
+type T struct { F int }
+
+// M is a method.
+func (t *T) M(x int) int { y := x + t.F; return y }
+`, i, i)
+		filename := filepath.Join(dir, fmt.Sprintf("p%d.go", i))
+		if err := ioutil.WriteFile(filename, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+		if err != nil {
+			t.Fatalf("ParseFile: %s\n\n%s", err, src)
+		}
+		pkgs = append(pkgs, checkPkg(t, fset, fmt.Sprintf("p%d", i), []*ast.File{f}))
+	}
+	return pkgs
+}
+
+func TestGraphPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gog-graph-packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 8
+	var want *Output
+	for _, workers := range []int{1, 4, n, 0} {
+		pkgs := createPkgs(t, dir, n)
+		g := New(pkgs)
+		if errs := g.GraphPackages(pkgs, workers); len(errs) > 0 {
+			t.Fatalf("workers=%d: %v", workers, errs)
+		}
+		if len(g.Defs) == 0 || len(g.Refs) == 0 || len(g.Docs) == 0 {
+			t.Fatalf("workers=%d: got %d defs, %d refs, %d docs, want some of each", workers, len(g.Defs), len(g.Refs), len(g.Docs))
+		}
+		if want == nil {
+			want = &g.Output
+			continue
+		}
+		if !reflect.DeepEqual(&g.Output, want) {
+			t.Errorf("workers=%d: output differs from output with workers=1", workers)
+		}
+	}
+}
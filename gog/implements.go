@@ -0,0 +1,248 @@
+package gog
+
+import (
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// namedType is a named type declared at package level.
+type namedType struct {
+	obj   *types.TypeName
+	named *types.Named
+
+	// methods is the set of the names of the methods of the type (for
+	// an interface) or of a pointer to the type (for a concrete type).
+	methods map[string]bool
+
+	hasSyntax bool
+}
+
+// buildImplements computes which concrete types implement which
+// interfaces, among the named types declared at package level in pkgs
+// (and the predeclared error interface). Interfaces with no methods
+// (which every type implements) are omitted. Only relationships
+// involving a type in a package with syntax are recorded, because the
+// others are never output.
+//
+// Either a type or a pointer to it may implement an interface. Generic
+// types are not considered.
+func (g *Grapher) buildImplements(pkgs []*types.Package, hasSyntax map[*types.Package]bool) {
+	var concrete []*namedType
+	ifacesByMethod := make(map[string][]*namedType)
+	addIface := func(t *namedType, iface *types.Interface) {
+		t.methods = make(map[string]bool, iface.NumMethods())
+		for i := 0; i < iface.NumMethods(); i++ {
+			t.methods[iface.Method(i).Name()] = true
+		}
+		// Index interfaces by their first method, so that each
+		// concrete type is only checked against the interfaces that
+		// could possibly match.
+		first := iface.Method(0).Name()
+		ifacesByMethod[first] = append(ifacesByMethod[first], t)
+	}
+
+	errorObj := types.Universe.Lookup("error").(*types.TypeName)
+	errorType := errorObj.Type().(*types.Named)
+	addIface(&namedType{obj: errorObj, named: errorType}, errorType.Underlying().(*types.Interface))
+
+	for _, pkg := range pkgs {
+		names := &MethodNames{}
+		scope := pkg.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || obj.IsAlias() {
+				continue
+			}
+			named, ok := obj.Type().(*types.Named)
+			if !ok || named.TypeParams().Len() > 0 {
+				continue
+			}
+			t := &namedType{obj: obj, named: named, hasSyntax: hasSyntax[pkg]}
+			if iface, ok := named.Underlying().(*types.Interface); ok {
+				if iface.NumMethods() > 0 {
+					addIface(t, iface)
+					names.Interfaces = append(names.Interfaces, joinNames(t.methods))
+				}
+				continue
+			}
+			mset := types.NewMethodSet(types.NewPointer(named))
+			if mset.Len() == 0 {
+				continue
+			}
+			t.methods = make(map[string]bool, mset.Len())
+			for i := 0; i < mset.Len(); i++ {
+				t.methods[mset.At(i).Obj().Name()] = true
+			}
+			concrete = append(concrete, t)
+			names.Types = append(names.Types, joinNames(t.methods))
+		}
+		if g.methodNames[pkg.Path()] == nil {
+			g.methodNames[pkg.Path()] = &MethodNames{}
+		}
+		g.methodNames[pkg.Path()].Merge(names)
+	}
+
+	for _, t := range concrete {
+		seen := make(map[*namedType]bool)
+		for method := range t.methods {
+			for _, iface := range ifacesByMethod[method] {
+				if seen[iface] || !(t.hasSyntax || iface.hasSyntax) {
+					continue
+				}
+				seen[iface] = true
+				if !hasMethods(t.methods, iface.methods) {
+					continue
+				}
+				ifaceType := iface.named.Underlying().(*types.Interface)
+				if types.Implements(t.named, ifaceType) || types.Implements(types.NewPointer(t.named), ifaceType) {
+					g.implements[t.obj] = append(g.implements[t.obj], iface.obj)
+					g.implementedBy[iface.obj] = append(g.implementedBy[iface.obj], t.obj)
+				}
+			}
+		}
+	}
+
+	for _, objs := range g.implements {
+		sort.Sort(typeNames(objs))
+	}
+	for _, objs := range g.implementedBy {
+		sort.Sort(typeNames(objs))
+	}
+}
+
+// joinNames returns the sorted, space-separated names in set.
+func joinNames(set map[string]bool) string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// hasMethods reports whether all of the method names in want are in
+// have.
+func hasMethods(have, want map[string]bool) bool {
+	for name := range want {
+		if !have[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// implementsKeys returns the def keys of the interfaces that obj
+// implements (if obj is a concrete type) and of the concrete types
+// that implement obj (if obj is an interface).
+func (g *Grapher) implementsKeys(obj types.Object) (implements, implementedBy []*DefKey, err error) {
+	tn, ok := obj.(*types.TypeName)
+	if !ok {
+		return nil, nil, nil
+	}
+	if implements, err = g.defKeys(g.implements[tn]); err != nil {
+		return nil, nil, err
+	}
+	if implementedBy, err = g.defKeys(g.implementedBy[tn]); err != nil {
+		return nil, nil, err
+	}
+	return implements, implementedBy, nil
+}
+
+func (g *Grapher) defKeys(objs []*types.TypeName) ([]*DefKey, error) {
+	var keys []*DefKey
+	for _, obj := range objs {
+		key, _, err := g.defInfo(obj)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+type typeNames []*types.TypeName
+
+func (tn typeNames) Len() int      { return len(tn) }
+func (tn typeNames) Swap(i, j int) { tn[i], tn[j] = tn[j], tn[i] }
+func (tn typeNames) Less(i, j int) bool {
+	if pi, pj := pkgPath(tn[i]), pkgPath(tn[j]); pi != pj {
+		return pi < pj
+	}
+	return tn[i].Name() < tn[j].Name()
+}
+
+// pkgPath returns the import path of obj's package, or "" if obj is
+// predeclared.
+func pkgPath(obj types.Object) string {
+	if obj.Pkg() == nil {
+		return ""
+	}
+	return obj.Pkg().Path()
+}
+
+// MethodNames are the method names of the named types of a package,
+// by which buildImplements first matches concrete types with the
+// interfaces that they may implement. Each entry is the sorted,
+// space-separated method names of an interface (with methods) or of a
+// pointer to a concrete type (with methods). Generic types are
+// omitted.
+type MethodNames struct {
+	Interfaces []string `json:",omitempty"`
+	Types      []string `json:",omitempty"`
+}
+
+// MayImplement reports whether a concrete type in m may implement an
+// interface in other, or a concrete type in other may implement an
+// interface in m: whether it has all of the interface's method names.
+func (m *MethodNames) MayImplement(other *MethodNames) bool {
+	return mayImplement(m.Types, other.Interfaces) || mayImplement(other.Types, m.Interfaces)
+}
+
+func mayImplement(concrete, ifaces []string) bool {
+	for _, t := range concrete {
+		have := methodSet(t)
+		for _, iface := range ifaces {
+			if hasMethods(have, methodSet(iface)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func methodSet(names string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range strings.Fields(names) {
+		set[name] = true
+	}
+	return set
+}
+
+// Merge adds the entries of other (such as the method names of the
+// same package under another build configuration) to m.
+func (m *MethodNames) Merge(other *MethodNames) {
+	m.Interfaces = mergeNames(m.Interfaces, other.Interfaces)
+	m.Types = mergeNames(m.Types, other.Types)
+}
+
+// mergeNames returns the sorted union of a and b.
+func mergeNames(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var names []string
+	for _, s := range append(append([]string(nil), a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			names = append(names, s)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MethodNames returns the MethodNames of the packages whose named
+// types buildImplements matched (the packages that were loaded, and
+// their dependencies), by import path.
+func (g *Grapher) MethodNames() map[string]*MethodNames {
+	return g.methodNames
+}
@@ -0,0 +1,81 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestImplements(t *testing.T) {
+	fset := token.NewFileSet()
+	parse := func(name, src string) []*ast.File {
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*ast.File{f}
+	}
+	a := checkPkg(t, fset, "a", parse("a.go", `package a
+type I interface { M() }
+type Empty interface{}
+type T struct{}
+func (*T) M() {}
+type N int
+`))
+	b := checkPkg(t, fset, "b", parse("b.go", `package b
+import "a"
+type U struct{}
+func (U) M() {}
+func (U) Error() string { return "" }
+var _ a.I = U{}
+`), a)
+
+	g := New([]*packages.Package{a, b})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	type implements struct{ implements, implementedBy []defPath }
+	got := map[defPath]implements{}
+	for _, def := range g.Defs {
+		if len(def.Implements) == 0 && len(def.ImplementedBy) == 0 {
+			continue
+		}
+		var impl implements
+		for _, key := range def.Implements {
+			impl.implements = append(impl.implements, key.defPath())
+		}
+		for _, key := range def.ImplementedBy {
+			impl.implementedBy = append(impl.implementedBy, key.defPath())
+		}
+		got[def.DefKey.defPath()] = impl
+	}
+	want := map[defPath]implements{
+		{"a", "I"}: {implementedBy: []defPath{{"a", "T"}, {"b", "U"}}},
+		{"a", "T"}: {implements: []defPath{{"a", "I"}}},
+		{"b", "U"}: {implements: []defPath{{"builtin", "error"}, {"a", "I"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	methodNames := g.MethodNames()
+	wantNames := map[string]*MethodNames{
+		"a": {Interfaces: []string{"M"}, Types: []string{"M"}},
+		"b": {Types: []string{"Error M"}},
+	}
+	if !reflect.DeepEqual(methodNames, wantNames) {
+		t.Errorf("got method names %+v, want %+v", methodNames, wantNames)
+	}
+	if !methodNames["b"].MayImplement(methodNames["a"]) {
+		t.Error("got b may not implement a, want it may")
+	}
+	if other := (&MethodNames{Interfaces: []string{"M N"}, Types: []string{"N"}}); methodNames["b"].MayImplement(other) {
+		t.Error("got b may implement an interface with a method it lacks, want it may not")
+	}
+}
@@ -0,0 +1,175 @@
+package gog
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// PackagesToGraph returns the packages in pkgs (as returned by
+// packages.Load) that should be graphed. When pkgs was loaded with
+// tests, a package's test variant (which also contains its _test.go
+// files) is returned instead of the package itself, and the generated
+// test main packages are omitted. The packages are sorted by import
+// path.
+func PackagesToGraph(pkgs []*packages.Package) []*packages.Package {
+	byKey := make(map[string]*packages.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		if strings.HasSuffix(pkg.ID, ".test") {
+			// test main package
+			continue
+		}
+		if prev, ok := byKey[pkg.PkgPath]; ok && isTestVariant(prev) {
+			continue
+		}
+		byKey[pkg.PkgPath] = pkg
+	}
+
+	graph := make([]*packages.Package, 0, len(byKey))
+	for _, pkg := range byKey {
+		graph = append(graph, pkg)
+	}
+	sort.Sort(packageInfos(graph))
+	return graph
+}
+
+// isTestVariant reports whether pkg is a package compiled for a test,
+// whose ID is like "p [p.test]".
+func isTestVariant(pkg *packages.Package) bool {
+	return strings.HasSuffix(pkg.ID, ".test]")
+}
+
+// CheckFiles replaces the syntax and type information of pkg with the
+// result of parsing and type-checking filenames. It is used for
+// packages that go/packages can't type-check from their original
+// source files: packages that use cgo (whose files go/packages
+// replaces with generated files, unless cgo is disabled, in which case
+// it omits them) and package unsafe. References to "C" are not
+// type-checked (the grapher resolves them to the C declarations in
+// pkg's cgo preambles and in the .c and .h files among its
+// OtherFiles, which callers should set).
+//
+// Imports are resolved to the packages that pkg already imports (and
+// unsafe). The other imports of filenames (such as those that only
+// pkg's cgo files import, which go/packages omits when cgo is
+// disabled) are loaded with cfg, if it is not nil. The type errors in
+// filenames replace the type errors in pkg.Errors and pkg.TypeErrors.
+func CheckFiles(cfg *packages.Config, pkg *packages.Package, filenames []string) error {
+	files := make([]*ast.File, 0, len(filenames))
+	for _, filename := range filenames {
+		f, err := parser.ParseFile(pkg.Fset, filename, nil, parser.ParseComments)
+		if f == nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	imports := map[string]*types.Package{"unsafe": types.Unsafe}
+	if pkg.Types != nil {
+		for _, imp := range pkg.Types.Imports() {
+			imports[imp.Path()] = imp
+		}
+	}
+	if cfg != nil {
+		if err := loadImports(cfg, pkg.Fset, files, imports); err != nil {
+			return err
+		}
+	}
+
+	var typeErrs []types.Error
+	conf := types.Config{
+		FakeImportC: true,
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if imp, ok := imports[path]; ok {
+				return imp, nil
+			}
+			return nil, fmt.Errorf("package %q could not be loaded", path)
+		}),
+		Error: func(err error) {
+			if err, ok := err.(types.Error); ok {
+				typeErrs = append(typeErrs, err)
+			}
+		},
+	}
+	info := newTypesInfo()
+	typesPkg, _ := conf.Check(pkg.PkgPath, pkg.Fset, files, info)
+	pkg.Syntax, pkg.Types, pkg.TypesInfo = files, typesPkg, info
+
+	var errs []packages.Error
+	for _, err := range pkg.Errors {
+		if err.Kind != packages.TypeError {
+			errs = append(errs, err)
+		}
+	}
+	for _, err := range typeErrs {
+		errs = append(errs, packages.Error{
+			Pos:  err.Fset.Position(err.Pos).String(),
+			Msg:  err.Msg,
+			Kind: packages.TypeError,
+		})
+	}
+	pkg.Errors, pkg.TypeErrors, pkg.IllTyped = errs, typeErrs, len(typeErrs) > 0
+	return nil
+}
+
+// loadImports loads the packages that files import and that are not
+// in imports (by import path) with cfg, and adds them to imports. The
+// packages are loaded from export data, so only their types are
+// loaded.
+func loadImports(cfg *packages.Config, fset *token.FileSet, files []*ast.File, imports map[string]*types.Package) error {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || path == "C" || imports[path] != nil || seen[path] {
+				continue
+			}
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	conf := *cfg
+	conf.Mode = packages.NeedName | packages.NeedTypes
+	conf.Tests = false
+	conf.Fset = fset
+	pkgs, err := packages.Load(&conf, paths...)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		if pkg.Types != nil && len(pkg.Errors) == 0 {
+			imports[pkg.PkgPath] = pkg.Types
+		}
+	}
+	return nil
+}
+
+// newTypesInfo returns a types.Info that records everything that the
+// grapher needs.
+func newTypesInfo() *types.Info {
+	return &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Scopes:     make(map[ast.Node]*types.Scope),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Instances:  make(map[*ast.Ident]types.Instance),
+	}
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
@@ -1,6 +1,7 @@
 package gog
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -16,39 +17,55 @@ func TestPaths(t *testing.T) {
 		{`type A struct {b struct { c string }}`, []defPath{{"foo", "A/b"}, {"foo", "A/b/c"}}, nil},
 		{`type A struct { B }; type B struct { c string }`, []defPath{{"foo", "A/B"}}, []defPath{{"foo", "A/B/c"}, {"foo", "A/c"}}},
 		{`type A struct { *B }; type B struct { c string }`, []defPath{{"foo", "A/B"}}, []defPath{{"foo", "A/B/c"}, {"foo", "A/c"}}},
-		{`func _() { var a int; _ = a }`, []defPath{{"foo", "_/a"}}, nil},
+		{`func _() { var a int; _ = a }`, []defPath{{"foo", "_$sources[0]/a"}}, nil},
 		{`type A int; func (a A) x() { var b int; _ = b }`, []defPath{{"foo", "A/x/a"}, {"foo", "A/x/b"}}, nil},
-		{`func _() { if true { var a int; _ = a } }`, []defPath{{"foo", "_/$sources[0]0/$sources[0]0/a"}}, nil},
+		{`func _() { if true { var a int; _ = a } }`, []defPath{{"foo", "_$sources[0]/a"}}, nil},
 		{`type A int; func (a A) F() {}`, []defPath{{"foo", "A/F"}}, nil},
 		{`type A int; func (a *A) F() {}`, []defPath{{"foo", "A/F"}}, nil},
-		{`func F() {f := func(a int) (b int) { c := 7; return c; }; _ = f }`, []defPath{{"foo", "F/f"}, {"foo", "F/$sources[0]0/a"}, {"foo", "F/$sources[0]0/b"}, {"foo", "F/$sources[0]0/c"}}, nil},
-		{`func F() { {a:=0;_=a};{a:=0;_=a} }`, []defPath{{"foo", "F/$sources[0]0/a"}, {"foo", "F/$sources[0]1/a"}}, nil},
-		{`func init() {}; func init() {}`, []defPath{{"foo", "init$sources[0]28"}, {"foo", "init$sources[0]44"}}, nil},
+		{`func F() {f := func(a int) (b int) { c := 7; return c; }; _ = f }`, []defPath{{"foo", "F/f"}, {"foo", "F/a"}, {"foo", "F/b"}, {"foo", "F/c"}}, nil},
+		{`func F() { {a:=0;_=a};{a:=0;_=a} }`, []defPath{{"foo", "F/a"}, {"foo", "F/a$1"}}, nil},
+		{`func init() {}; func init() {}`, []defPath{{"foo", "init$sources[0]"}, {"foo", "init$sources[0]$1"}}, nil},
 		{`var x struct { y int }`, []defPath{{"foo", "x/y"}}, nil},
 		{`func f(x struct{y int}) { _ = x.y }`, []defPath{{"foo", "f/x/y"}}, nil},
 		{`type I interface { A(); B() }`, []defPath{{"foo", "I"}, {"foo", "I/A"}, {"foo", "I/B"}}, nil},
 		{`type I interface { A(x int); B(x int) }`, []defPath{{"foo", "I/A/x"}, {"foo", "I/B/x"}}, nil},
-		{`type f func(i int); type g func(i int)`, []defPath{{"foo", "$sources[0]/$sources[0]0/i"}, {"foo", "$sources[0]/$sources[0]1/i"}}, nil},
+		{`type f func(i int); type g func(i int)`, []defPath{{"foo", "f/i"}, {"foo", "g/i"}}, nil},
 
 		// Test that the 2 `x`s have unique paths. This doesn't test that they'd
 		// have unique paths if they were defined in different files (which was
 		// a persistent issue).
-		{`func init() { x:=0;_=x};func init() { x:=0;_=x}`, []defPath{{"foo", "init$sources[0]28/x"}, {"foo", "init$sources[0]52/x"}}, nil},
+		{`func init() { x:=0;_=x};func init() { x:=0;_=x}`, []defPath{{"foo", "init$sources[0]/x"}, {"foo", "init$sources[0]$1/x"}}, nil},
 
 		{`func a() { const x = false; _ = x}; const x = 3`, []defPath{{"foo", "a/x"}, {"foo", "x"}}, nil},
+
+		// Local paths don't depend on positions or blocks.
+		{`func F(x int) { if x > 0 { x := 1; _ = x }; for x := range []int{} { _ = x } }`, []defPath{{"foo", "F/x"}, {"foo", "F/x$1"}, {"foo", "F/x$2"}}, nil},
+		{`func F() { v := []struct{ a int }{}; _ = v }`, []defPath{{"foo", "F/v"}, {"foo", "F/a"}}, nil},
+		{`var f = func(a int) { _ = a }`, []defPath{{"foo", "f/a"}}, nil},
+		{`var _ = func(a int) { _ = a }; var _ = func(a int) { _ = a }`, []defPath{{"foo", "_$sources[0]/a"}, {"foo", "_$sources[0]$1/a"}}, nil},
+		{`func F() { type I interface { M(a int) }; var a I; _ = a }`, []defPath{{"foo", "F/I/M"}, {"foo", "F/I/M/a"}, {"foo", "F/a"}}, nil},
+
+		// The params, results and methods in the types of struct fields
+		// are under the fields, not beside them.
+		{`type T struct { f func() (f int) }`, []defPath{{"foo", "T/f"}, {"foo", "T/f/f"}}, nil},
+		{`type T struct { i interface{ m(a int) } }; func (T) m() {}`, []defPath{{"foo", "T/m"}, {"foo", "T/i/m"}, {"foo", "T/i/m/a"}}, nil},
+		{`type T struct { a, b func(x int) }`, []defPath{{"foo", "T/a"}, {"foo", "T/b"}, {"foo", "T/a/x"}}, nil},
+		{`var v struct { r int; f func() (r int) }`, []defPath{{"foo", "v/r"}, {"foo", "v/f/r"}}, nil},
+		{`func F() { v := struct{ a struct{ f func() (a int) } }{}; _ = v }`, []defPath{{"foo", "F/v"}, {"foo", "F/v/a"}, {"foo", "F/v/a/f"}, {"foo", "F/v/a/f/a"}}, nil},
 	}
 
 	for _, c := range cases {
 		src := `package foo; /*START*/ ` + c.defs + ` /*END*/`
 		start, end := uint32(strings.Index(src, "/*START*/")), uint32(strings.Index(src, "/*END*/"))
-		prog := createPkg(t, "foo", []string{src}, nil)
+		pkgs := createPkg(t, "foo", []string{src}, nil)
 
-		g := New(prog)
+		g := New(pkgs)
 		g.SkipDocs = true
-		err := g.Graph(prog.Created[0])
+		err := g.Graph(pkgs[0])
 		if err != nil {
 			t.Fatal(err)
 		}
+		checkUnique(t, g)
 
 		var paths []defPath
 		for _, s := range g.Defs {
@@ -88,3 +105,52 @@ func TestPaths(t *testing.T) {
 		}
 	}
 }
+
+// TestPathsStable tests that the paths of local defs don't change when
+// code that is not in the same declaration is added above them.
+func TestPathsStable(t *testing.T) {
+	localPaths := func(src string) map[defPath]bool {
+		pkgs := createPkg(t, "foo", []string{src}, nil)
+		g := New(pkgs)
+		g.SkipDocs = true
+		if err := g.Graph(pkgs[0]); err != nil {
+			t.Fatal(err)
+		}
+		paths := make(map[defPath]bool)
+		for _, def := range g.Defs {
+			if strings.HasPrefix(def.DefKey.defPath().path, "F/") {
+				paths[def.DefKey.defPath()] = true
+			}
+		}
+		return paths
+	}
+
+	const f = `func F(a int) { b := a; { c := b; _ = c } }`
+	want := localPaths("package foo\n" + f)
+	if len(want) != 3 {
+		t.Fatalf("got local paths %v, want 3", want)
+	}
+	got := localPaths("package foo\n\nvar x = 1\n\nfunc G() { { a := 2; _ = a } }\n" + f)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got local paths %v after adding code above, want %v", got, want)
+	}
+}
+
+// TestPathsMissingScope tests that graphing a def whose scope was not
+// assigned a path fails with an error instead of panicking.
+func TestPathsMissingScope(t *testing.T) {
+	pkgs := createPkg(t, "foo", []string{`package foo; func F() { a := 0; _ = a }`}, nil)
+	g := New(pkgs)
+	g.SkipDocs = true
+	for obj := range g.paths {
+		if obj.Name() == "a" {
+			delete(g.paths, obj)
+		}
+	}
+	for scope := range g.scopePaths {
+		delete(g.scopePaths, scope)
+	}
+	if err := g.Graph(pkgs[0]); err == nil || !strings.Contains(err.Error(), "no scope path") {
+		t.Errorf("got error %v, want a missing scope path error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package gog
+
+import (
+	"go/types"
+	"sort"
+)
+
+// A Promotion is a method or field that is promoted to a type through
+// embedding: a method or field of a struct type's embedded field, or a
+// method of an interface type's embedded interface.
+type Promotion struct {
+	// Member is the promoted method or field.
+	Member *DefKey
+
+	// Via is the chain of embedded fields (or, for an interface type,
+	// embedded interfaces) through which Member is promoted, starting
+	// with the one in the type that Member is promoted to.
+	Via []*DefKey
+}
+
+// promotions returns the methods and fields that are promoted to the
+// type named by obj, sorted by their def keys. It returns nil if obj
+// is not a non-generic named type.
+func (g *Grapher) promotions(obj types.Object) ([]*Promotion, error) {
+	tn, ok := obj.(*types.TypeName)
+	if !ok || tn.IsAlias() {
+		return nil, nil
+	}
+	named, ok := tn.Type().(*types.Named)
+	if !ok || named.TypeParams().Len() > 0 {
+		return nil, nil
+	}
+
+	var members []types.Object
+	var vias [][]types.Object
+	switch typ := named.Underlying().(type) {
+	case *types.Struct:
+		// Promoted methods.
+		mset := types.NewMethodSet(types.NewPointer(named))
+		for i := 0; i < mset.Len(); i++ {
+			sel := mset.At(i)
+			if len(sel.Index()) > 1 {
+				members = append(members, sel.Obj().(*types.Func).Origin())
+				vias = append(vias, embeddingChain(named, sel.Index()[:len(sel.Index())-1]))
+			}
+		}
+
+		// Promoted fields.
+		seen := make(map[*types.Var]bool)
+		for _, f := range embeddedFields(typ, map[*types.Struct]bool{}) {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			fobj, index, _ := types.LookupFieldOrMethod(named, true, f.Pkg(), f.Name())
+			if fobj != f || len(index) < 2 {
+				// f is not promoted, because it is ambiguous or
+				// shadowed by a shallower field or method.
+				continue
+			}
+			members = append(members, f.Origin())
+			vias = append(vias, embeddingChain(named, index[:len(index)-1]))
+		}
+
+	case *types.Interface:
+		seen := make(map[*types.Func]bool)
+		var visit func(iface *types.Interface, via []types.Object)
+		visit = func(iface *types.Interface, via []types.Object) {
+			for i := 0; i < iface.NumEmbeddeds(); i++ {
+				embedded, ok := iface.EmbeddedType(i).(*types.Named)
+				if !ok {
+					continue
+				}
+				eiface, ok := embedded.Underlying().(*types.Interface)
+				if !ok {
+					continue
+				}
+				via := append(via[:len(via):len(via)], embedded.Obj())
+				for j := 0; j < eiface.NumExplicitMethods(); j++ {
+					m := eiface.ExplicitMethod(j)
+					if !seen[m] {
+						seen[m] = true
+						members = append(members, m)
+						vias = append(vias, via)
+					}
+				}
+				visit(eiface, via)
+			}
+		}
+		visit(typ, nil)
+	}
+
+	var promotions []*Promotion
+	for i, member := range members {
+		key, _, err := g.defInfo(member)
+		if err != nil {
+			return nil, err
+		}
+		p := &Promotion{Member: key}
+		for _, obj := range vias[i] {
+			key, _, err := g.defInfo(obj)
+			if err != nil {
+				return nil, err
+			}
+			p.Via = append(p.Via, key)
+		}
+		promotions = append(promotions, p)
+	}
+	sort.Sort(promotionsByMember(promotions))
+	return promotions, nil
+}
+
+// embeddedFields returns the fields of the structs that are embedded
+// (directly or indirectly) in styp. These are the fields that may be
+// promoted to styp.
+func embeddedFields(styp *types.Struct, seen map[*types.Struct]bool) []*types.Var {
+	if seen[styp] {
+		return nil
+	}
+	seen[styp] = true
+
+	var fields []*types.Var
+	for i := 0; i < styp.NumFields(); i++ {
+		f := styp.Field(i)
+		if !f.Embedded() {
+			continue
+		}
+		if estyp, ok := derefType(f.Type()).Underlying().(*types.Struct); ok {
+			for j := 0; j < estyp.NumFields(); j++ {
+				fields = append(fields, estyp.Field(j))
+			}
+			fields = append(fields, embeddedFields(estyp, seen)...)
+		}
+	}
+	return fields
+}
+
+// embeddingChain returns the embedded fields that are selected, in
+// turn, by the field indexes in index, starting with typ's field.
+func embeddingChain(typ types.Type, index []int) []types.Object {
+	var chain []types.Object
+	for _, i := range index {
+		f := derefType(typ).Underlying().(*types.Struct).Field(i)
+		chain = append(chain, f.Origin())
+		typ = f.Type()
+	}
+	return chain
+}
+
+type promotionsByMember []*Promotion
+
+func (p promotionsByMember) Len() int           { return len(p) }
+func (p promotionsByMember) Less(i, j int) bool { return p[i].Member.less(p[j].Member) }
+func (p promotionsByMember) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,88 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestPromotions(t *testing.T) {
+	fset := token.NewFileSet()
+	parse := func(name, src string) []*ast.File {
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*ast.File{f}
+	}
+	a := checkPkg(t, fset, "a", parse("a.go", `package a
+type Inner struct{ F int; g int }
+func (Inner) M() {}
+func (*Inner) PM() {}
+type Middle struct{ *Inner; H int }
+type Reader interface { Read() }
+type Closer interface { Close() }
+type ReadCloser interface { Reader; Closer }
+type ReadCloseFlusher interface { ReadCloser; Flush() }
+`))
+	b := checkPkg(t, fset, "b", parse("b.go", `package b
+import "a"
+type Outer struct {
+	a.Middle
+	a.Reader
+	H string // shadows Middle.H
+}
+func (Outer) M() {} // shadows Inner.M
+`), a)
+
+	g := New([]*packages.Package{a, b})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	type promotion struct {
+		member defPath
+		via    []defPath
+	}
+	got := map[defPath][]promotion{}
+	for _, def := range g.Defs {
+		for _, p := range def.Promotions {
+			var via []defPath
+			for _, key := range p.Via {
+				via = append(via, key.defPath())
+			}
+			got[def.DefKey.defPath()] = append(got[def.DefKey.defPath()], promotion{p.Member.defPath(), via})
+		}
+	}
+	want := map[defPath][]promotion{
+		{"a", "Middle"}: {
+			{defPath{"a", "Inner/F"}, []defPath{{"a", "Middle/Inner"}}},
+			{defPath{"a", "Inner/M"}, []defPath{{"a", "Middle/Inner"}}},
+			{defPath{"a", "Inner/PM"}, []defPath{{"a", "Middle/Inner"}}},
+			{defPath{"a", "Inner/g"}, []defPath{{"a", "Middle/Inner"}}},
+		},
+		{"a", "ReadCloser"}: {
+			{defPath{"a", "Closer/Close"}, []defPath{{"a", "Closer"}}},
+			{defPath{"a", "Reader/Read"}, []defPath{{"a", "Reader"}}},
+		},
+		{"a", "ReadCloseFlusher"}: {
+			{defPath{"a", "Closer/Close"}, []defPath{{"a", "ReadCloser"}, {"a", "Closer"}}},
+			{defPath{"a", "Reader/Read"}, []defPath{{"a", "ReadCloser"}, {"a", "Reader"}}},
+		},
+		{"b", "Outer"}: {
+			{defPath{"a", "Inner/F"}, []defPath{{"b", "Outer/Middle"}, {"a", "Middle/Inner"}}},
+			{defPath{"a", "Inner/PM"}, []defPath{{"b", "Outer/Middle"}, {"a", "Middle/Inner"}}},
+			{defPath{"a", "Inner/g"}, []defPath{{"b", "Outer/Middle"}, {"a", "Middle/Inner"}}},
+			{defPath{"a", "Middle/Inner"}, []defPath{{"b", "Outer/Middle"}}},
+			{defPath{"a", "Reader/Read"}, []defPath{{"b", "Outer/Reader"}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\n\nwant %+v", got, want)
+	}
+}
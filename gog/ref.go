@@ -2,8 +2,11 @@ package gog
 
 import (
 	"go/ast"
+	"go/token"
 
 	"go/types"
+
+	"golang.org/x/tools/go/packages"
 )
 
 func (g *Grapher) NewRef(node ast.Node, obj types.Object, pkgPath string) (*Ref, error) {
@@ -12,11 +15,11 @@ func (g *Grapher) NewRef(node ast.Node, obj types.Object, pkgPath string) (*Ref,
 		return nil, err
 	}
 
-	pos := g.program.Fset.Position(node.Pos())
+	pos := g.fset.Position(node.Pos())
 	return &Ref{
 		Unit: pkgPath,
 		File: pos.Filename,
-		Span: makeSpan(g.program.Fset, node),
+		Span: makeSpan(g.fset, node),
 		Def:  key,
 	}, nil
 }
@@ -30,4 +33,189 @@ type Ref struct {
 	// IsDef is true if ref is to the definition of Def, and false if it's to a
 	// use of Def.
 	IsDef bool
+
+	// Kind is how the ref uses Def: one of the RefKind constants. It
+	// is empty for refs to definitions (IsDef) and for the package
+	// clause of each file.
+	Kind string `json:",omitempty"`
+
+	// From is the def that the ref is made from, if it is recorded: the
+	// def of the Go file that an import spec is in.
+	From *DefKey `json:",omitempty"`
+
+	// BuildConfigs are the names of the build configurations that
+	// this ref exists under, if it doesn't exist under all of them
+	// (see MergeOutputs).
+	BuildConfigs []string `json:",omitempty"`
+}
+
+// Ref kinds (see Ref.Kind).
+const (
+	RefCall   = "call"   // called (a func or method)
+	RefRead   = "read"   // read (or otherwise used as a value)
+	RefWrite  = "write"  // assigned to, incremented or decremented, or has its address taken
+	RefType   = "type"   // used as a type
+	RefEmbed  = "embed"  // embedded in a struct or interface type
+	RefKey    = "key"    // a struct field used as a key in a composite literal
+	RefImport = "import" // an imported package (in an import spec or a qualified identifier)
+	RefAsm    = "asm"    // implemented in assembly (the name of a func in a TEXT symbol)
+
+	// Refs in directive comments.
+	RefLinkname  = "linkname"  // linked to by a //go:linkname directive (or its local name)
+	RefGenerate  = "generate"  // a package run by a //go:generate go run directive
+	RefEmbedFile = "embedfile" // a file embedded by a //go:embed directive
+)
+
+// refKinds returns the kinds of the refs of the identifiers in pkg's
+// files that are called, written to, embedded or used as composite
+// literal keys. The kinds of the refs of other identifiers depend only
+// on what they refer to (see refKind).
+func refKinds(pkg *packages.Package) map[*ast.Ident]string {
+	kinds := make(map[*ast.Ident]string)
+	mark := func(expr ast.Expr, kind string, isObj func(types.Object) bool) {
+		ident := targetIdent(pkg.TypesInfo, expr)
+		if ident == nil {
+			return
+		}
+		// Prefer Uses, because the identifier of an embedded field
+		// both defines the field and uses the embedded type.
+		obj := pkg.TypesInfo.Uses[ident]
+		if obj == nil {
+			obj = pkg.TypesInfo.Defs[ident]
+		}
+		if isObj(obj) {
+			kinds[ident] = kind
+		}
+	}
+	isCallable := func(obj types.Object) bool {
+		switch obj.(type) {
+		case *types.Func, *types.Builtin, *types.Var: // calls of func values are calls, too
+			return true
+		}
+		return false
+	}
+	isVar := func(obj types.Object) bool {
+		_, ok := obj.(*types.Var)
+		return ok
+	}
+	isField := func(obj types.Object) bool {
+		v, ok := obj.(*types.Var)
+		return ok && v.IsField()
+	}
+	isTypeName := func(obj types.Object) bool {
+		_, ok := obj.(*types.TypeName)
+		return ok
+	}
+	markEmbedded := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, f := range fields.List {
+			if len(f.Names) == 0 {
+				typ := f.Type
+				if star, ok := typ.(*ast.StarExpr); ok {
+					typ = star.X
+				}
+				mark(typ, RefEmbed, isTypeName)
+			}
+		}
+	}
+
+	for _, f := range pkg.Syntax {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				mark(n.Fun, RefCall, isCallable)
+			case *ast.AssignStmt:
+				for _, lhs := range n.Lhs {
+					mark(lhs, RefWrite, isVar)
+				}
+			case *ast.IncDecStmt:
+				mark(n.X, RefWrite, isVar)
+			case *ast.RangeStmt:
+				if n.Tok == token.ASSIGN {
+					if n.Key != nil {
+						mark(n.Key, RefWrite, isVar)
+					}
+					if n.Value != nil {
+						mark(n.Value, RefWrite, isVar)
+					}
+				}
+			case *ast.UnaryExpr:
+				if n.Op == token.AND {
+					mark(n.X, RefWrite, isVar)
+				}
+			case *ast.CompositeLit:
+				for _, elt := range n.Elts {
+					if kv, ok := elt.(*ast.KeyValueExpr); ok {
+						if key, ok := kv.Key.(*ast.Ident); ok {
+							mark(key, RefKey, isField)
+						}
+					}
+				}
+			case *ast.StructType:
+				markEmbedded(n.Fields)
+			case *ast.InterfaceType:
+				markEmbedded(n.Methods)
+			}
+			return true
+		})
+	}
+	return kinds
+}
+
+// targetIdent returns the identifier that expr (a possibly qualified
+// or instantiated identifier) refers to, or nil if there is none. The
+// operands of index expressions that are not instantiations (such as m
+// in m[k]) are not the target of expr, so they are only read.
+func targetIdent(info *types.Info, expr ast.Expr) *ast.Ident {
+	for {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return e
+		case *ast.SelectorExpr:
+			return e.Sel
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			if !isInstantiation(info, e.X) {
+				return nil
+			}
+			expr = e.X
+		case *ast.IndexListExpr:
+			if !isInstantiation(info, e.X) {
+				return nil
+			}
+			expr = e.X
+		default:
+			return nil
+		}
+	}
+}
+
+// isInstantiation reports whether expr, the operand of an index
+// expression, is a generic func or type that the index expression
+// instantiates (such as F in F[int]).
+func isInstantiation(info *types.Info, expr ast.Expr) bool {
+	ident := targetIdent(info, expr)
+	if ident == nil {
+		return false
+	}
+	_, ok := info.Instances[ident]
+	return ok
+}
+
+// refKind returns the kind of the ref of ident, which refers to obj.
+// kinds is the result of refKinds.
+func refKind(ident *ast.Ident, obj types.Object, kinds map[*ast.Ident]string) string {
+	if kind, ok := kinds[ident]; ok {
+		return kind
+	}
+	switch obj.(type) {
+	case *types.PkgName:
+		return RefImport
+	case *types.TypeName:
+		return RefType
+	}
+	return RefRead
 }
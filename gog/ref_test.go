@@ -0,0 +1,105 @@
+package gog
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestRefKinds(t *testing.T) {
+	fset := token.NewFileSet()
+	parse := func(name, src string) []*ast.File {
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*ast.File{f}
+	}
+	a := checkPkg(t, fset, "a", parse("a.go", `package a
+type T struct{ F int }
+type U struct{}
+type J interface{ M() }
+var V int
+func Fn() {}
+func Gen[T any](v T) T { return v }
+func Pair[K comparable, V any]() {}
+`))
+	const src = `package p
+import "a"
+type S struct {
+	a.T
+	*a.U
+	f int
+}
+type I interface{ a.J }
+func f() {
+	var s S
+	s.f = 1
+	s.f++
+	_ = s.f
+	x := &s.f
+	a.Fn()
+	g := a.Fn
+	g()
+	_ = a.T{F: a.V}
+	n := len("")
+	x, y := &n, int64(n)
+	for n = range []int{} {}
+	_, _ = x, y
+	m := map[int]func(){}
+	m[0]()
+	l := []int{0}
+	l[0] = 1
+	a.Gen[int](0)
+	a.Pair[int, string]()
+}
+`
+	p := checkPkg(t, fset, "p", parse("p.go", src), a)
+
+	g := New([]*packages.Package{p})
+	g.SkipDocs = true
+	if err := g.Graph(p); err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(refsByPos(g.Refs))
+
+	var got []string
+	for _, ref := range g.Refs {
+		if ref.IsDef {
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s:%s", src[ref.Span[0]:ref.Span[1]], ref.Kind))
+	}
+	want := []string{
+		"p:", `"a":import`,
+		"a:import", "T:embed", "a:import", "U:embed", "int:type", // type S
+		"a:import", "J:embed", // type I
+		"S:type",
+		"s:read", "f:write", // s.f = 1
+		"s:read", "f:write", // s.f++
+		"s:read", "f:read", // _ = s.f
+		"s:read", "f:write", // x := &s.f
+		"a:import", "Fn:call",
+		"a:import", "Fn:read", // g := a.Fn
+		"g:call",
+		"a:import", "T:type", "F:key", "a:import", "V:read",
+		"len:call",
+		"x:write", "n:write", "int64:type", "n:read",
+		"n:write", "int:type", // for n = range
+		"x:read", "y:read",
+		"int:type",           // m := map[int]func(){}
+		"m:read",             // m[0]()
+		"int:type", "l:read", // l[0] = 1
+		"a:import", "Gen:call", "int:type",
+		"a:import", "Pair:call", "int:type", "string:type",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got ref kinds\n%q\n\nwant\n%q", got, want)
+	}
+}
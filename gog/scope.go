@@ -3,33 +3,31 @@ package gog
 import (
 	"fmt"
 	"go/ast"
-	"go/token"
 	"log"
-	"math/rand"
 	"path/filepath"
 	"strings"
 
 	"go/types"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
-func (g *Grapher) buildScopeInfo(pkgInfo *loader.PackageInfo) {
-	for node, scope := range pkgInfo.Scopes {
+func (g *Grapher) buildScopeInfo(pkg *packages.Package) {
+	for node, scope := range pkg.TypesInfo.Scopes {
 		g.scopeNodes[scope] = node
 	}
 }
 
-func (g *Grapher) path(obj types.Object) (path []string) {
+func (g *Grapher) path(obj types.Object) ([]string, error) {
 	if path, present := g.paths[obj]; present {
-		return path
+		return path, nil
 	}
 
 	var scope *types.Scope
-	pkgInfo, astPath, _ := g.program.PathEnclosingInterval(obj.Pos(), obj.Pos())
+	pkg, astPath, _ := g.pathEnclosingInterval(obj.Pos(), obj.Pos())
 	if astPath != nil {
 		for _, node := range astPath {
-			if s, hasScope := pkgInfo.Scopes[node]; hasScope {
+			if s, hasScope := pkg.TypesInfo.Scopes[node]; hasScope {
 				scope = s
 			}
 		}
@@ -41,106 +39,46 @@ func (g *Grapher) path(obj types.Object) (path []string) {
 	if scope == nil {
 		// TODO(sqs): make this actually handle cases like the one described in
 		// https://github.com/sourcegraph/sourcegraph.com/issues/218
-		log.Printf("Warning: no scope for object %s at pos %s", obj.String(), g.program.Fset.Position(obj.Pos()))
-		return nil
+		log.Printf("Warning: no scope for object %s at pos %s", obj.String(), g.fset.Position(obj.Pos()))
+		return nil, nil
 	}
 
 	prefix, hasPath := g.scopePaths[scope]
 	if !hasPath {
-		panic("no scope path for scope " + scope.String())
+		return nil, fmt.Errorf("no scope path for object %s at %s", obj, g.fset.Position(obj.Pos()))
 	}
-	path = append([]string{}, prefix...)
-	p := g.program.Fset.Position(obj.Pos())
-	path = append(path, obj.Name()+uniqID(p))
-	return path
-
-	panic("no scope node for object " + obj.String())
-}
-
-func uniqID(p token.Position) string {
-	return fmt.Sprintf("$%s%d", strippedFilename(p.Filename), p.Offset)
-}
-
-func (g *Grapher) scopePath(prefix []string, s *types.Scope) []string {
-	if path, present := g.scopePaths[s]; present {
-		return path
-	}
-	path := append(prefix, g.scopeLabel(s)...)
-	g.scopePaths[s] = path
-	return path
+	return append(append([]string{}, prefix...), obj.Name()), nil
 }
 
-func (g *Grapher) scopeLabel(s *types.Scope) (path []string) {
-	node, present := g.scopeNodes[s]
-	if !present {
-		// TODO(sqs): diagnose why this happens. See https://github.com/sourcegraph/sourcegraph.com/issues/163.
-		// log.Printf("no node found for scope (giving a dummy label); scope is: %s", s.String())
-		return []string{fmt.Sprintf("ERROR%d", rand.Intn(10000))}
-	}
-
-	switch n := node.(type) {
-	case *ast.File:
-		return []string{}
-
-	case *ast.Package:
-		return []string{}
-
-	case *ast.FuncType:
-		// get func name
-		_, astPath, _ := g.program.PathEnclosingInterval(n.Pos(), n.End())
-		if false {
-			log.Printf("----------")
-			for i, n := range astPath {
-				log.Printf("%d. %T %+v", i, n, n)
-			}
-		}
-		if f, ok := astPath[0].(*ast.FuncDecl); ok {
-			var path []string
-			if f.Recv != nil {
-				path = []string{derefNode(f.Recv.List[0].Type).(*ast.Ident).Name}
-			}
-			var uniqName string
-			if f.Name.Name == "init" {
-				// init function can appear multiple times in each file and
-				// package, so need to uniquify it
-				uniqName = f.Name.Name + uniqID(g.program.Fset.Position(f.Name.Pos()))
-			} else {
-				uniqName = f.Name.Name
-			}
-			path = append(path, uniqName)
-			return path
-		}
-	}
-
-	// get this scope's index in parent
-	// TODO(sqs): is it necessary to uniquify this here now that we're handling
-	// init above?
-	p := s.Parent()
-	var prefix []string
-	if fs, ok := g.scopeNodes[p].(*ast.File); ok {
-		// avoid file scope collisions by using file index as well
-		filename := g.program.Fset.Position(fs.Name.Pos()).Filename
-		prefix = []string{fmt.Sprintf("$%s", strippedFilename(filename))}
-	}
-	for i := 0; i < p.NumChildren(); i++ {
-		if p.Child(i) == s {
-			filename := g.program.Fset.Position(node.Pos()).Filename
-			return append(prefix, fmt.Sprintf("$%s%d", strippedFilename(filename), i))
-		}
+// ordinalName returns name if it is the first (n == 0) object with
+// that name in its declaration, and name$n otherwise.
+func ordinalName(name string, n int) string {
+	if n == 0 {
+		return name
 	}
-
-	panic("unreachable")
+	return fmt.Sprintf("%s$%d", name, n)
 }
 
 func strippedFilename(filename string) string {
 	return strings.TrimSuffix(filepath.Base(filename), ".go")
 }
 
-func (g *Grapher) assignPathsInPackage(pkgInfo *loader.PackageInfo) {
-	pkg := pkgInfo.Pkg
+func (g *Grapher) assignPathsInPackage(pkg *types.Package) {
 	g.assignPaths(pkg.Scope(), []string{}, true)
+
+	// The children of the package scope are the file scopes, whose
+	// names are imported packages.
+	for i := 0; i < pkg.Scope().NumChildren(); i++ {
+		s := pkg.Scope().Child(i)
+		g.assignPaths(s, []string{}, false)
+		if f, ok := g.scopeNodes[s].(*ast.File); ok {
+			g.assignLocalPathsInFile(f)
+		}
+	}
 }
 
+// assignPaths assigns paths to the objects in the scope s (and to
+// their methods and fields), under prefix.
 func (g *Grapher) assignPaths(s *types.Scope, prefix []string, pkgscope bool) {
 	g.scopePaths[s] = prefix
 
@@ -149,55 +87,168 @@ func (g *Grapher) assignPaths(s *types.Scope, prefix []string, pkgscope bool) {
 		if _, seen := g.paths[e]; seen {
 			continue
 		}
-		path := append(append([]string{}, prefix...), name)
-		g.paths[e] = path
-		g.exported[e] = ast.IsExported(name) && pkgscope
-		g.pkgscope[e] = pkgscope
+		g.assignPath(e, append(append([]string{}, prefix...), name), pkgscope)
+	}
+}
 
-		if tn, ok := e.(*types.TypeName); ok {
+// assignPath assigns path to obj, and paths under it to its methods and
+// fields.
+func (g *Grapher) assignPath(obj types.Object, path []string, pkgscope bool) {
+	g.paths[obj] = path
+	g.exported[obj] = ast.IsExported(obj.Name()) && pkgscope
+	g.pkgscope[obj] = pkgscope
+
+	if tn, ok := obj.(*types.TypeName); ok {
+		switch typ := tn.Type().(type) {
+		case *types.Named:
 			// methods
-			named := tn.Type().(*types.Named)
-			g.assignMethodPaths(named, path, pkgscope)
+			g.assignMethodPaths(typ, path, pkgscope)
 
 			// struct fields
-			typ := derefType(tn.Type().Underlying())
-			if styp, ok := typ.(*types.Struct); ok {
+			if styp, ok := derefType(typ.Underlying()).(*types.Struct); ok {
 				g.assignStructFieldPaths(styp, path, pkgscope)
 			}
-		} else if v, ok := e.(*types.Var); ok {
-			// struct fields if type is anonymous struct
-			if styp, ok := derefType(v.Type()).(*types.Struct); ok {
+		case *types.Alias:
+			// struct fields if the alias is of an anonymous struct (the
+			// fields and methods of named types are assigned paths under
+			// the types themselves)
+			if styp, ok := types.Unalias(typ).(*types.Struct); ok {
 				g.assignStructFieldPaths(styp, path, pkgscope)
 			}
 		}
+	} else if v, ok := obj.(*types.Var); ok {
+		// struct fields if type is anonymous struct
+		if styp, ok := derefType(v.Type()).(*types.Struct); ok {
+			g.assignStructFieldPaths(styp, path, pkgscope)
+		}
 	}
+}
 
-	seenChildPrefixes := map[string]struct{}{}
-	for i := 0; i < s.NumChildren(); i++ {
-		c := s.Child(i)
-		childPrefix := prefix
-		pkgscope := pkgscope
-
-		if path := g.scopePath(prefix, c); path != nil {
-			childPrefix = append([]string{}, path...)
-			pkgscope = false
-		}
+// assignLocalPathsInFile assigns paths to the objects declared inside
+// the top-level declarations of f (such as the params and local vars of
+// funcs, and the type params of generic types).
+//
+// The path of a local object is the path of the top-level declaration
+// it is in, followed by its name, to which $n is appended if it is the
+// nth (counting from 0) object with that name in the declaration (see
+// ordinalName). So the paths of local objects only depend on the
+// declaration they are in, not on the position of the declaration in
+// the file or on the blocks they are in.
+func (g *Grapher) assignLocalPathsInFile(f *ast.File) {
+	pf := g.files[g.fset.File(f.Pos())]
+	if pf == nil {
+		return
+	}
+	info := pf.pkg.TypesInfo
+	filename := strippedFilename(g.fset.Position(f.Pos()).Filename)
+
+	// The funcs that are not in the package scope (init funcs and funcs
+	// named _) and the specs that declare only _ are numbered in the
+	// file, because their names are not unique.
+	unscoped := make(map[string]int)
+	unscopedName := func(name string) string {
+		n := unscoped[name]
+		unscoped[name]++
+		return ordinalName(name+"$"+filename, n)
+	}
 
-		if len(childPrefix) >= 1 {
-			// Ensure all child prefixes are unique. This is an issue when you
-			// have, for example:
-			//  func init() { x:=0;_=x};func init() { x:=0;_=x}
-			// This is valid Go code but if we don't uniquify the two `x`s, they
-			// will have the same paths.
-			cp := strings.Join(childPrefix, "/")
-			if _, seen := seenChildPrefixes[cp]; seen {
-				childPrefix[len(childPrefix)-1] += fmt.Sprintf("$%d", i)
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			obj := info.Defs[decl.Name]
+			if obj == nil {
+				continue
+			}
+			path, ok := g.paths[obj]
+			if !ok {
+				path = []string{unscopedName(decl.Name.Name)}
+				g.assignPath(obj, path, true)
+			}
+			g.assignLocalPaths(info, decl, path)
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					if path, ok := g.paths[info.Defs[spec.Name]]; ok {
+						g.assignLocalPaths(info, spec, path)
+					}
+				case *ast.ValueSpec:
+					var path []string
+					for _, name := range spec.Names {
+						if obj := info.Defs[name]; obj != nil && name.Name != "_" {
+							path = g.paths[obj]
+							break
+						}
+					}
+					if path == nil {
+						path = []string{unscopedName("_")}
+					}
+					g.assignLocalPaths(info, spec, path)
+				}
 			}
-			seenChildPrefixes[cp] = struct{}{}
 		}
+	}
+}
 
-		g.assignPaths(c, childPrefix, pkgscope)
+// assignLocalPaths assigns paths under prefix to the objects declared
+// in node (a top-level declaration, the type of an interface method or
+// the type of a struct field)
+// that don't have paths yet, numbering those with the same name in the
+// order they are declared in. It also assigns prefix as the path of the
+// scopes in node.
+func (g *Grapher) assignLocalPaths(info *types.Info, node ast.Node, prefix []string) {
+	names := make(map[string]int)
+	assign := func(obj types.Object) {
+		if obj == nil {
+			return
+		}
+		if _, isLabel := obj.(*types.Label); isLabel {
+			return
+		}
+		if _, seen := g.paths[obj]; seen {
+			return
+		}
+		n := names[obj.Name()]
+		names[obj.Name()]++
+		g.assignPath(obj, append(append([]string{}, prefix...), ordinalName(obj.Name(), n)), false)
 	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		if s, ok := info.Scopes[n]; ok {
+			g.scopePaths[s] = prefix
+		}
+		switch n := n.(type) {
+		case *ast.Ident:
+			assign(info.Defs[n])
+		case *ast.CaseClause:
+			// the type-specific var of a type switch case clause
+			assign(info.Implicits[n])
+		case *ast.Field:
+			// the params and results of an interface method are under
+			// the method
+			if ft, ok := n.Type.(*ast.FuncType); ok && len(n.Names) == 1 {
+				if m, ok := info.Defs[n.Names[0]].(*types.Func); ok {
+					assign(m)
+					g.assignLocalPaths(info, ft, g.paths[m])
+					return false
+				}
+			}
+			// the params and results of func-typed struct fields, and
+			// the methods of interface-typed ones, are under the field
+			// (so they don't collide with the fields and methods of the
+			// struct)
+			if len(n.Names) > 0 {
+				if v, ok := info.Defs[n.Names[0]].(*types.Var); ok && v.IsField() {
+					for _, name := range n.Names {
+						assign(info.Defs[name])
+					}
+					g.assignLocalPaths(info, n.Type, g.paths[v])
+					return false
+				}
+			}
+		}
+		return true
+	})
 }
 
 func (g *Grapher) assignMethodPaths(named *types.Named, prefix []string, pkgscope bool) {
@@ -208,24 +259,16 @@ func (g *Grapher) assignMethodPaths(named *types.Named, prefix []string, pkgscop
 
 		g.exported[m] = ast.IsExported(m.Name())
 		g.pkgscope[m] = pkgscope
-
-		if s := m.Scope(); s != nil {
-			g.assignPaths(s, path, false)
-		}
 	}
 
 	if iface, ok := named.Underlying().(*types.Interface); ok {
 		for i := 0; i < iface.NumExplicitMethods(); i++ {
-			m := iface.Method(i)
+			m := iface.ExplicitMethod(i)
 			path := append(append([]string{}, prefix...), m.Name())
 			g.paths[m] = path
 
 			g.exported[m] = ast.IsExported(m.Name())
 			g.pkgscope[m] = pkgscope
-
-			if s := m.Scope(); s != nil {
-				g.assignPaths(s, path, false)
-			}
 		}
 	}
 }
@@ -0,0 +1,88 @@
+package gog
+
+import "sort"
+
+// Sort sorts the defs, refs and docs in o by file and position (and
+// then by def key), so that output is deterministic.
+func (o *Output) Sort() {
+	sort.Sort(defsByPos(o.Defs))
+	sort.Sort(refsByPos(o.Refs))
+	sort.Sort(docsByPos(o.Docs))
+}
+
+func (k *DefKey) less(other *DefKey) bool {
+	switch {
+	case k == nil || other == nil:
+		return k == nil && other != nil
+	case k.PackageImportPath != other.PackageImportPath:
+		return k.PackageImportPath < other.PackageImportPath
+	case k.UnitType != other.UnitType:
+		return k.UnitType < other.UnitType
+	}
+	for i := 0; i < len(k.Path) && i < len(other.Path); i++ {
+		if k.Path[i] != other.Path[i] {
+			return k.Path[i] < other.Path[i]
+		}
+	}
+	return len(k.Path) < len(other.Path)
+}
+
+type defsByPos []*Def
+
+func (d defsByPos) Len() int      { return len(d) }
+func (d defsByPos) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d defsByPos) Less(i, j int) bool {
+	a, b := d[i], d[j]
+	switch {
+	case a.File != b.File:
+		return a.File < b.File
+	case a.IdentSpan != b.IdentSpan:
+		return spanLess(a.IdentSpan, b.IdentSpan)
+	}
+	return a.DefKey.less(b.DefKey)
+}
+
+type refsByPos []*Ref
+
+func (r refsByPos) Len() int      { return len(r) }
+func (r refsByPos) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r refsByPos) Less(i, j int) bool {
+	a, b := r[i], r[j]
+	switch {
+	case a.File != b.File:
+		return a.File < b.File
+	case a.Span != b.Span:
+		return spanLess(a.Span, b.Span)
+	case a.Unit != b.Unit:
+		return a.Unit < b.Unit
+	case a.IsDef != b.IsDef:
+		return a.IsDef
+	}
+	return a.Def.less(b.Def)
+}
+
+type docsByPos []*Doc
+
+func (d docsByPos) Len() int      { return len(d) }
+func (d docsByPos) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d docsByPos) Less(i, j int) bool {
+	a, b := d[i], d[j]
+	switch {
+	case a.File != b.File:
+		return a.File < b.File
+	case a.Span != b.Span:
+		return spanLess(a.Span, b.Span)
+	case a.Unit != b.Unit:
+		return a.Unit < b.Unit
+	case a.DefKey.less(b.DefKey) || b.DefKey.less(a.DefKey):
+		return a.DefKey.less(b.DefKey)
+	}
+	return a.Format < b.Format
+}
+
+func spanLess(a, b [2]uint32) bool {
+	if a[0] != b[0] {
+		return a[0] < b[0]
+	}
+	return a[1] < b[1]
+}
@@ -9,7 +9,7 @@ import (
 	"testing"
 	"time"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 var stdlibPath = flag.String("test.stdlib-pkg", "", "in TestStdlib, only graph this package (import path)")
@@ -57,12 +57,12 @@ func testPkg(t *testing.T, path string) {
 		return
 	}
 	conf := Default
-	conf.Import(path)
-	prog, err := conf.Load()
+	conf.Tests = false
+	pkgs, err := packages.Load(&conf, path)
 	if err != nil {
 		t.Fatal(path, err)
 	}
-	g := New(prog)
+	g := New(pkgs)
 
 	start := time.Now()
 	err = g.GraphAll()
@@ -76,11 +76,11 @@ func testPkg(t *testing.T, path string) {
 	defCount += len(g.Defs)
 	refCount += len(g.Refs)
 
-	checkAllIdents(t, g, prog)
-	checkUnique(t, g, prog)
+	checkAllIdents(t, g, pkgs)
+	checkUnique(t, g)
 }
 
-func checkUnique(t *testing.T, g *Grapher, prog *loader.Program) {
+func checkUnique(t *testing.T, g *Grapher) {
 	defs := make(map[defPath]*Def, len(g.Defs))
 	for _, s := range g.Defs {
 		key := s.DefKey.defPath()
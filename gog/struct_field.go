@@ -1,9 +1,10 @@
 package gog
 
 import (
+	"fmt"
 	"go/types"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 type structField struct {
@@ -11,8 +12,10 @@ type structField struct {
 	parent types.Type
 }
 
-func (g *Grapher) buildStructFields(pkgInfo *loader.PackageInfo) {
-	for _, obj := range pkgInfo.Defs {
+// buildStructFields records the structs that the fields of pkg's
+// struct types and the fields selected in pkg's files are in.
+func (g *Grapher) buildStructFields(pkg *packages.Package) error {
+	for _, obj := range pkg.TypesInfo.Defs {
 		if tn, ok := obj.(*types.TypeName); ok {
 			typ := tn.Type().Underlying()
 			if st, ok := typ.(*types.Struct); ok {
@@ -24,10 +27,12 @@ func (g *Grapher) buildStructFields(pkgInfo *loader.PackageInfo) {
 		}
 	}
 
-	for selExpr, sel := range pkgInfo.Selections {
+	for selExpr, sel := range pkg.TypesInfo.Selections {
 		switch sel.Kind() {
 		case types.FieldVal:
-			rt := derefType(sel.Recv())
+			// The receiver may be an alias (of a pointer), such as
+			// type A = *T.
+			rt := types.Unalias(derefType(types.Unalias(sel.Recv())))
 			var pkg *types.Package
 			switch rt := rt.(type) {
 			case *types.Named:
@@ -35,9 +40,9 @@ func (g *Grapher) buildStructFields(pkgInfo *loader.PackageInfo) {
 			case *types.Struct:
 				pkg = sel.Obj().Pkg()
 			default:
-				panic("unhandled field recv type " + rt.String())
+				return fmt.Errorf("unhandled field receiver type %s at %s", rt, g.fset.Position(selExpr.Pos()))
 			}
-			sfobj, _, _ := types.LookupFieldOrMethod(derefType(sel.Recv()), false, pkg, selExpr.Sel.Name)
+			sfobj, _, _ := types.LookupFieldOrMethod(rt, false, pkg, selExpr.Sel.Name)
 
 			// Record that this field is in this struct so we can construct the
 			// right def path to the field.
@@ -45,4 +50,5 @@ func (g *Grapher) buildStructFields(pkgInfo *loader.PackageInfo) {
 			g.structFields[sf] = &structField{sf, rt}
 		}
 	}
+	return nil
 }
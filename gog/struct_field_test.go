@@ -47,16 +47,35 @@ func TestResolveStructFields(t *testing.T) {
 			wantRefs:  []*DefKey{{PackageImportPath: "foo", Path: []string{"B", "A"}}},
 		},
 
+		"alias struct field ref": {
+			pkgDefs:   `type A struct {x string}; type B = A;`,
+			localDefs: `var b B;`,
+			ref:       `b.x`,
+			wantRefs:  []*DefKey{{PackageImportPath: "foo", Path: []string{"A", "x"}}},
+		},
+		"alias of pointer struct field ref": {
+			pkgDefs:   `type A struct {x string}; type P = *A;`,
+			localDefs: `var p P;`,
+			ref:       `p.x`,
+			wantRefs:  []*DefKey{{PackageImportPath: "foo", Path: []string{"A", "x"}}},
+		},
+		"alias of anonymous struct field ref": {
+			pkgDefs:   `type S = struct {x string};`,
+			localDefs: `var s S;`,
+			ref:       `s.x`,
+			wantRefs:  []*DefKey{{PackageImportPath: "foo", Path: []string{"S", "x"}}},
+		},
+
 		"local: basic struct field ref": {
 			pkgDefs:   ``,
 			localDefs: `type A struct {x string}; var a A;`,
 			ref:       `a.x`,
-			wantRefs:  []*DefKey{{PackageImportPath: "foo", Path: []string{"_", "A", "x"}}},
+			wantRefs:  []*DefKey{{PackageImportPath: "foo", Path: []string{"_$sources[0]", "A", "x"}}},
 		},
 
 		"anonymous struct field ref": {
 			ref:      `(struct{x int}{}).x`,
-			wantRefs: []*DefKey{{PackageImportPath: "foo", Path: []string{"x$sources[0]47"}}},
+			wantRefs: []*DefKey{{PackageImportPath: "foo", Path: []string{"_$sources[0]", "x"}}},
 		},
 
 		"stdlib struct field ref": {
@@ -74,11 +93,11 @@ func TestResolveStructFields(t *testing.T) {
 	for label, c := range cases {
 		src := `package foo; ` + c.pkgDefs + ` func _() { ` + c.localDefs + ` _ = /*START*/` + c.ref + `/*END*/; }`
 		start, end := uint32(strings.Index(src, "/*START*/")), uint32(strings.Index(src, "/*END*/"))
-		prog := createPkg(t, "foo", []string{src}, nil)
+		pkgs := createPkg(t, "foo", []string{src}, nil)
 
-		g := New(prog)
+		g := New(pkgs)
 		g.SkipDocs = true
-		err := g.Graph(prog.Created[0])
+		err := g.Graph(pkgs[0])
 		if err != nil {
 			t.Fatal(label, err)
 		}
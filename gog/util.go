@@ -58,7 +58,36 @@ func derefType(t types.Type) types.Type {
 	return t
 }
 
+// methodRecvTypeName returns the name of the type of a method receiver,
+// such as T for *T or List for *List[T].
 func methodRecvTypeName(recvType ast.Expr) string {
-	recvType = derefNode(recvType)
-	return recvType.(*ast.Ident).Name
+	for {
+		switch t := recvType.(type) {
+		case *ast.Ident:
+			return t.Name
+		case *ast.StarExpr:
+			recvType = t.X
+		case *ast.ParenExpr:
+			recvType = t.X
+		case *ast.IndexExpr:
+			recvType = t.X
+		case *ast.IndexListExpr:
+			recvType = t.X
+		default:
+			return ""
+		}
+	}
+}
+
+// originObject returns the generic object that obj, a method or field
+// of an instantiated generic type, was instantiated from, or obj itself
+// if it was not instantiated.
+func originObject(obj types.Object) types.Object {
+	switch obj := obj.(type) {
+	case *types.Func:
+		return obj.Origin()
+	case *types.Var:
+		return obj.Origin()
+	}
+	return obj
 }
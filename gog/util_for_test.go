@@ -3,23 +3,27 @@ package gog
 import (
 	"fmt"
 	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io/ioutil"
 	"testing"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
-func graphPkgFromFiles(t *testing.T, path string, filenames []string) (*Grapher, *loader.Program) {
-	prog := createPkgFromFiles(t, path, filenames)
-	g := New(prog)
+func graphPkgFromFiles(t *testing.T, path string, filenames []string) (*Grapher, []*packages.Package) {
+	pkgs := createPkgFromFiles(t, path, filenames)
+	g := New(pkgs)
 	err := g.GraphAll()
 	if err != nil {
 		t.Fatal(err)
 	}
-	return g, prog
+	return g, pkgs
 }
 
-func createPkgFromFiles(t *testing.T, path string, filenames []string) *loader.Program {
+func createPkgFromFiles(t *testing.T, path string, filenames []string) []*packages.Package {
 	sources := make([]string, len(filenames))
 	for i, file := range filenames {
 		src, err := ioutil.ReadFile(file)
@@ -31,8 +35,8 @@ func createPkgFromFiles(t *testing.T, path string, filenames []string) *loader.P
 	return createPkg(t, path, sources, filenames)
 }
 
-func createPkg(t *testing.T, path string, sources []string, names []string) *loader.Program {
-	conf := Default
+func createPkg(t *testing.T, path string, sources []string, names []string) []*packages.Package {
+	fset := token.NewFileSet()
 
 	var files []*ast.File
 	for i, src := range sources {
@@ -42,19 +46,44 @@ func createPkg(t *testing.T, path string, sources []string, names []string) *loa
 		} else {
 			name = fmt.Sprintf("sources[%d]", i)
 		}
-		f, err := conf.ParseFile(name, src)
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
 		if err != nil {
 			t.Fatalf("ParseFile: %s\n\n%s", err, src)
 		}
 		files = append(files, f)
 	}
 
-	conf.CreateFromFiles(path, files...)
-	prog, err := conf.Load()
+	return []*packages.Package{checkPkg(t, fset, path, files)}
+}
+
+// checkPkg type-checks files as the package path, like go/packages
+// does, except that imported packages (other than deps) are
+// type-checked from source.
+func checkPkg(t *testing.T, fset *token.FileSet, path string, files []*ast.File, deps ...*packages.Package) *packages.Package {
+	sourceImporter := importer.ForCompiler(fset, "source", nil)
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			for _, dep := range deps {
+				if dep.PkgPath == path {
+					return dep.Types, nil
+				}
+			}
+			return sourceImporter.Import(path)
+		}),
+		FakeImportC: true,
+	}
+	info := newTypesInfo()
+	pkg, err := conf.Check(path, fset, files, info)
 	if err != nil {
 		t.Fatal(err)
 	}
-	conf.Import("builtin")
-
-	return prog
+	return &packages.Package{
+		ID:        path,
+		Name:      pkg.Name(),
+		PkgPath:   path,
+		Fset:      fset,
+		Syntax:    files,
+		Types:     pkg,
+		TypesInfo: info,
+	}
 }
@@ -0,0 +1,34 @@
+package gog
+
+import (
+	"go/types"
+	"strings"
+)
+
+// isXTest reports whether pkg is an external test package (a package
+// named foo_test in the directory of package foo, whose import path is
+// "foo_test").
+func isXTest(pkg *types.Package) bool {
+	return strings.HasSuffix(pkg.Name(), "_test") && strings.HasSuffix(pkg.Path(), "_test")
+}
+
+// unitImportPath returns the import path of the source unit that pkg's
+// files belong to. An external test package belongs to the unit of the
+// package it tests.
+func unitImportPath(pkg *types.Package) string {
+	if isXTest(pkg) {
+		return strings.TrimSuffix(pkg.Path(), "_test")
+	}
+	return pkg.Path()
+}
+
+// pkgDefKey returns the def key of the def at path in pkg. The defs of
+// an external test package foo_test are in package foo's namespace,
+// underneath the path "foo_test", so that they don't collide with
+// foo's own defs.
+func pkgDefKey(pkg *types.Package, path []string) *DefKey {
+	if isXTest(pkg) {
+		return &DefKey{PackageImportPath: unitImportPath(pkg), Path: append([]string{pkg.Name()}, path...)}
+	}
+	return &DefKey{PackageImportPath: pkg.Path(), Path: path}
+}
@@ -0,0 +1,65 @@
+package gog
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestXTest(t *testing.T) {
+	fset := token.NewFileSet()
+	parse := func(name, src string) []*ast.File {
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*ast.File{f}
+	}
+	foo := checkPkg(t, fset, "foo", parse("foo.go", `package foo; type T int; func F() {}`))
+	xtest := checkPkg(t, fset, "foo_test", parse("foo_test.go", `package foo_test; import "foo"; type T struct{}; func TestF() { foo.F() }`), foo)
+
+	g := New([]*packages.Package{foo, xtest})
+	g.SkipDocs = true
+	if err := g.GraphAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	defs := map[defPath]bool{}
+	for _, def := range g.Defs {
+		dp := def.DefKey.defPath()
+		if defs[dp] {
+			t.Errorf("duplicate def %+v", dp)
+		}
+		defs[dp] = true
+	}
+	wantDefs := map[defPath]bool{
+		{"foo", ""}:               true,
+		{"foo", "T"}:              true,
+		{"foo", "F"}:              true,
+		{"foo", "foo.go"}:         true,
+		{"foo", "foo_test.go"}:    true,
+		{"foo", "foo_test"}:       true,
+		{"foo", "foo_test/T"}:     true,
+		{"foo", "foo_test/TestF"}: true,
+	}
+	if !reflect.DeepEqual(defs, wantDefs) {
+		t.Errorf("got defs %v, want %v", defs, wantDefs)
+	}
+
+	var found bool
+	for _, ref := range g.Refs {
+		if ref.Unit != "foo" {
+			t.Errorf("ref %+v: got unit %q, want %q", ref, ref.Unit, "foo")
+		}
+		if ref.File == "foo_test.go" && ref.Def.defPath() == (defPath{"foo", "F"}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ref from foo_test to foo.F not found")
+	}
+}
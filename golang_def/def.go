@@ -2,6 +2,8 @@ package golang_def
 
 import (
 	"encoding/json"
+	"go/scanner"
+	"go/token"
 	"path"
 
 	"strings"
@@ -18,10 +20,78 @@ type DefData struct {
 	// def (if this def is not a package). If this def is a package,
 	// PackageImportPath is its own import path.
 	PackageImportPath string `json:",omitempty"`
+
+	// BuildConfigs are the names of the build configurations that this
+	// def exists under, if it doesn't exist under all of the build
+	// configurations that were graphed.
+	BuildConfigs []string `json:",omitempty"`
+
+	// Implements are the interfaces that this def implements, if it is
+	// a concrete type. ImplementedBy are the concrete types that
+	// implement this def, if it is an interface.
+	Implements    []graph.DefKey `json:",omitempty"`
+	ImplementedBy []graph.DefKey `json:",omitempty"`
+
+	// Promotions are the methods and fields that are promoted to this
+	// def through embedding, if it is a type.
+	Promotions []Promotion `json:",omitempty"`
+
+	// AsmBodies are the assembly implementations of this def, if it is
+	// a func that is declared without a body.
+	AsmBodies []AsmBody `json:",omitempty"`
+
+	// GoFile is the summary of the file, if this def is a Go file of its
+	// package.
+	GoFile *GoFile `json:",omitempty"`
+}
+
+// A Promotion is a method or field that is promoted to a type through
+// embedding.
+type Promotion struct {
+	// Member is the promoted method or field.
+	Member graph.DefKey
+
+	// Via is the chain of embedded fields (or embedded interfaces)
+	// through which Member is promoted, outermost first.
+	Via []graph.DefKey
+}
+
+// An AsmBody is the assembly implementation of a func: the func's TEXT
+// symbol in a .s file. Start and End are the byte offsets of the
+// func's name in the symbol.
+type AsmBody struct {
+	File       string
+	Start, End uint32
+
+	// Arch is the GOARCH that the name of File restricts it to, if any.
+	Arch string `json:",omitempty"`
+}
+
+// A GoFile is the summary of a Go file: its imports, its build
+// constraint expression (from its //go:build or // +build lines, if
+// any), and the byte offsets of its package clause.
+type GoFile struct {
+	Imports         []FileImport `json:",omitempty"`
+	BuildConstraint string       `json:",omitempty"`
+
+	PackageStart, PackageEnd uint32
+}
+
+// A FileImport is an import spec of a Go file. Name is the name that
+// the spec gives the package, if any, and Start and End are the byte
+// offsets of the spec.
+type FileImport struct {
+	Path       string
+	Name       string `json:",omitempty"`
+	Start, End uint32
 }
 
 func init() {
 	graph.RegisterMakeDefFormatter("GoPackage", newDefFormatter)
+
+	// The C declarations of cgo packages (whose Decl is their C
+	// declaration).
+	graph.RegisterMakeDefFormatter("C", newDefFormatter)
 }
 
 func newDefFormatter(s *graph.Def) graph.DefFormatter {
@@ -39,7 +109,12 @@ type defFormatter struct {
 	info *DefData
 }
 
-func (f defFormatter) Language() string { return "Go" }
+func (f defFormatter) Language() string {
+	if f.def.UnitType == "C" {
+		return "C"
+	}
+	return "Go"
+}
 
 func (f defFormatter) DefKeyword() string {
 	switch f.info.Kind {
@@ -57,12 +132,26 @@ func (f defFormatter) DefKeyword() string {
 		return "interface"
 	case definfo.Const:
 		return "const"
+	case definfo.File:
+		return "file"
 	}
 	return ""
 }
 
 func (f defFormatter) Kind() string { return f.info.Kind }
 
+// Decl returns the Go source declaration of the def, such as
+// "func (t *T) M(x int) error" (including the fields or methods of
+// struct and interface types), if the grapher recorded it. Otherwise it
+// returns the def's keyword, name and type.
+func (f defFormatter) Decl() string {
+	if f.info.Decl != "" {
+		return f.info.Decl
+	}
+	// The formatted type starts with the separator that it needs.
+	return strings.TrimSpace(f.DefKeyword() + " " + f.Name(graph.ScopeQualified) + f.Type(graph.ScopeQualified))
+}
+
 func (f defFormatter) pkgPath(qual graph.Qualification) string {
 	switch qual {
 	case graph.DepQualified:
@@ -101,6 +190,14 @@ func (f defFormatter) Name(qual graph.Qualification) string {
 		return pkg
 	}
 
+	if f.info.Kind == definfo.File {
+		// files are named by their paths in the package's directory
+		if pkg != "" {
+			return pkg + "/" + f.def.Name
+		}
+		return f.def.Name
+	}
+
 	var prefix string
 	if recvlike != "" {
 		prefix = fmtReceiver(recvlike, pkg)
@@ -136,18 +233,30 @@ func (f defFormatter) NameAndTypeSeparator() string {
 	return " "
 }
 
+// Type returns the type of the def, starting with the separator that
+// it needs after the def's name (such as " struct {...}" for a struct
+// type, or "(x int) error" for a func). It is taken from the def's
+// source declaration if the grapher recorded it, so it includes struct
+// fields, interface methods and parameter names, and refers to other
+// packages as the source does. Otherwise it is built from the def's
+// type string, with package paths qualified according to qual.
 func (f defFormatter) Type(qual graph.Qualification) string {
+	if f.def.Kind == "file" {
+		return ""
+	}
+	if f.info.Decl != "" && f.def.UnitType != "C" {
+		if ts, ok := f.declType(); ok {
+			return ts
+		}
+	}
+
 	var ts string
 	switch f.def.Kind {
 	case "func":
 		ts = f.info.TypeString
 		ts = strings.TrimPrefix(ts, "func")
 	case "type":
-		ts = f.info.UnderlyingTypeString
-		if i := strings.Index(ts, "{"); i != -1 {
-			ts = ts[:i]
-		}
-		ts = " " + ts
+		ts = " " + f.info.UnderlyingTypeString
 	default:
 		ts = " " + f.info.TypeString
 	}
@@ -160,8 +269,105 @@ func (f defFormatter) Type(qual graph.Qualification) string {
 	}
 	ts = strings.Replace(ts, oldPkgPath, newPkgPath, -1)
 
-	ts = strings.Replace(ts, f.def.Repo+"/", "", -1)
-	ts = strings.Replace(ts, f.def.Repo+".", path.Base(f.def.Repo), -1)
+	if f.def.Repo != "" {
+		ts = strings.Replace(ts, f.def.Repo+"/", "", -1)
+		ts = strings.Replace(ts, f.def.Repo+".", path.Base(f.def.Repo), -1)
+	}
 
 	return ts
 }
+
+// declType returns the part of the def's Decl after its name, or false
+// if the Decl doesn't have the form that the grapher gives the def's
+// kind.
+func (f defFormatter) declType() (string, bool) {
+	decl, name := f.info.Decl, f.def.Name
+	switch f.info.Kind {
+	case definfo.Type, definfo.Interface, definfo.TypeParam:
+		return cutPrefix(decl, "type "+name)
+	case definfo.Func, definfo.Method:
+		rest, ok := cutPrefix(decl, "func ")
+		if !ok {
+			return "", false
+		}
+		if strings.HasPrefix(rest, "(") {
+			// Skip the receiver.
+			end := closingParen(rest)
+			if end == -1 {
+				return "", false
+			}
+			rest = strings.TrimLeft(rest[end+1:], " ")
+		}
+		return cutPrefix(rest, name)
+	case definfo.Var:
+		return cutPrefix(decl, "var "+name)
+	case definfo.Const:
+		rest, ok := cutPrefix(decl, "const "+name)
+		if !ok {
+			return "", false
+		}
+		if i := strings.Index(rest, " = "); i != -1 {
+			rest = rest[:i]
+		}
+		if rest == "" {
+			// An untyped const.
+			return " " + f.info.TypeString, true
+		}
+		return rest, true
+	case definfo.Field:
+		// The decl of a field is its name (unless it is embedded), its
+		// type and its tag, if any.
+		typ := stripFieldTag(decl)
+		if rest, ok := cutPrefix(typ, name+" "); ok {
+			typ = rest
+		}
+		return " " + typ, true
+	}
+	return "", false
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return "", false
+	}
+	return s[len(prefix):], true
+}
+
+// closingParen returns the index of the parenthesis that closes the
+// one that s starts with, or -1 if there is none.
+func closingParen(s string) int {
+	var depth int
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// stripFieldTag returns the decl of a struct field without its tag.
+func stripFieldTag(decl string) string {
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(decl))
+	s.Init(file, []byte(decl), nil, 0)
+	end := len(decl)
+	for {
+		pos, tok, _ := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.STRING {
+			end = file.Offset(pos)
+		} else if tok != token.SEMICOLON {
+			end = len(decl)
+		}
+	}
+	return strings.TrimSpace(decl[:end])
+}
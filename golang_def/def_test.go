@@ -82,6 +82,21 @@ func TestDefFormatter(t *testing.T) {
 				graph.RepositoryWideQualified: " struct {x mypkg/subpkg.T1; w mypkg.T2; y mypkg/subpkg/subsubpkg.T2}",
 			},
 		},
+		{
+			// keep import paths in types if the repo is unknown
+			def: &graph.Def{
+				Name: "F",
+				Kind: "field",
+				Data: defInfo(DefData{
+					PackageImportPath: "example.com/foo/b",
+					DefInfo: definfo.DefInfo{
+						PkgName: "b", Kind: definfo.Field,
+						TypeString: "example.com/foo/a.T",
+					},
+				}),
+			},
+			wantTypes: map[graph.Qualification]string{graph.ScopeQualified: " example.com/foo/a.T"},
+		},
 		{
 			// qualify funcs with import path
 			def: &graph.Def{
@@ -106,6 +121,20 @@ func TestDefFormatter(t *testing.T) {
 			},
 			wantNames: map[graph.Qualification]string{graph.LanguageWideQualified: "a/b"},
 		},
+		{
+			// qualify files with import path
+			def: &graph.Def{
+				Name: "static/index.html",
+				Kind: "file",
+				Data: defInfo(DefData{PackageImportPath: "a/b", DefInfo: definfo.DefInfo{PkgName: "x", Kind: definfo.File}}),
+			},
+			wantNames: map[graph.Qualification]string{
+				graph.ScopeQualified:        "static/index.html",
+				graph.DepQualified:          "x/static/index.html",
+				graph.LanguageWideQualified: "a/b/static/index.html",
+			},
+			wantTypes: map[graph.Qualification]string{graph.ScopeQualified: ""},
+		},
 	}
 	for _, test := range tests {
 		sf := newDefFormatter(test.def)
@@ -123,3 +152,116 @@ func TestDefFormatter(t *testing.T) {
 		}
 	}
 }
+
+func TestDefFormatterDecl(t *testing.T) {
+	tests := []struct {
+		def  *graph.Def
+		want string
+	}{
+		{
+			// use the declaration that the grapher recorded
+			def: &graph.Def{
+				Name: "T",
+				Kind: definfo.Type,
+				Data: defInfo(DefData{DefInfo: definfo.DefInfo{Kind: definfo.Type, Decl: "type T struct {\n\tA int\n}", UnderlyingTypeString: "struct{A int}"}}),
+			},
+			want: "type T struct {\n\tA int\n}",
+		},
+		{
+			// fall back to the keyword, name and type
+			def: &graph.Def{
+				Name: "F",
+				Kind: definfo.Func,
+				Data: defInfo(DefData{DefInfo: definfo.DefInfo{Kind: definfo.Func, TypeString: "func(x int)"}}),
+			},
+			want: "func F(x int)",
+		},
+	}
+	for _, test := range tests {
+		decl := newDefFormatter(test.def).(defFormatter).Decl()
+		if decl != test.want {
+			t.Errorf("%v: got decl %q, want %q", test.def, decl, test.want)
+		}
+	}
+}
+
+func TestDefFormatterDeclType(t *testing.T) {
+	tests := []struct {
+		name, kind string
+		decl       string
+		typeString string
+		want       string
+	}{
+		{
+			name: "T", kind: definfo.Type,
+			decl: "type T struct {\n\tA    int\n\tB, C string `json:\"b\"`\n\tio.Reader\n}",
+			want: " struct {\n\tA    int\n\tB, C string `json:\"b\"`\n\tio.Reader\n}",
+		},
+		{
+			name: "I", kind: definfo.Interface,
+			decl: "type I interface {\n\tM(x int) (string, error)\n\tfmt.Stringer\n}",
+			want: " interface {\n\tM(x int) (string, error)\n\tfmt.Stringer\n}",
+		},
+		{
+			name: "M", kind: definfo.Method,
+			decl: "func (t *T[K]) M(f func() (int, error)) error",
+			want: "(f func() (int, error)) error",
+		},
+		{
+			// an interface method
+			name: "M", kind: definfo.Method,
+			decl: "func (I) M(x int) (string, error)",
+			want: "(x int) (string, error)",
+		},
+		{
+			name: "F", kind: definfo.Func,
+			decl: "func F[T any](x T)",
+			want: "[T any](x T)",
+		},
+		{
+			name: "V", kind: definfo.Var,
+			decl: "var V map[string]io.Reader",
+			want: " map[string]io.Reader",
+		},
+		{
+			name: "C", kind: definfo.Const,
+			decl: "const C time.Duration = 1000",
+			want: " time.Duration",
+		},
+		{
+			name: "C", kind: definfo.Const,
+			decl: "const C = \"a = b\"", typeString: "untyped string",
+			want: " untyped string",
+		},
+		{
+			name: "B", kind: definfo.Field,
+			decl: "B string `json:\"b\"`",
+			want: " string",
+		},
+		{
+			name: "S", kind: definfo.Field,
+			decl: "S struct {\n\tX int `json:\"x\"`\n}",
+			want: " struct {\n\tX int `json:\"x\"`\n}",
+		},
+		{
+			// an embedded field
+			name: "Reader", kind: definfo.Field,
+			decl: "*io.Reader `json:\"-\"`",
+			want: " *io.Reader",
+		},
+	}
+	for _, test := range tests {
+		def := &graph.Def{
+			Name: test.name,
+			Kind: test.kind,
+			Data: defInfo(DefData{DefInfo: definfo.DefInfo{Kind: test.kind, Decl: test.decl, TypeString: test.typeString}}),
+		}
+		f := newDefFormatter(def)
+		if typ := f.Type(graph.ScopeQualified); typ != test.want {
+			t.Errorf("%q: got type %q, want %q", test.decl, typ, test.want)
+		}
+		if decl := f.(defFormatter).Decl(); decl != test.decl {
+			t.Errorf("%q: got decl %q", test.decl, decl)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package golang_def
+
+import "sourcegraph.com/sourcegraph/srclib/graph"
+
+// StructuredDocFormat is the format of docs whose Data is a
+// JSON-encoded StructuredDoc.
+const StructuredDocFormat = "application/vnd.srclib-go.doc+json"
+
+// A StructuredDoc is a doc comment split into its parts, so that it can
+// be rendered without parsing HTML.
+type StructuredDoc struct {
+	// Summary is the first sentence of the doc, as plain text.
+	Summary string `json:",omitempty"`
+
+	// Deprecated is the text of the doc's "Deprecated:" paragraph
+	// (without the "Deprecated:" prefix), if it has one.
+	Deprecated string `json:",omitempty"`
+
+	// Blocks are the paragraphs, headings, code blocks and lists of
+	// the doc, in order.
+	Blocks []*DocBlock
+
+	// Links are the doc links (such as [pkg.Name]) in the doc, in
+	// order.
+	Links []*DocLink `json:",omitempty"`
+}
+
+// Kinds of DocBlocks.
+const (
+	DocParagraph = "paragraph"
+	DocHeading   = "heading"
+	DocCode      = "code"
+	DocList      = "list"
+)
+
+// A DocBlock is a paragraph, heading, code block or list in a doc.
+type DocBlock struct {
+	Kind string
+
+	// Text is the plain text of a paragraph, heading or code block.
+	// Links appear as their text.
+	Text string `json:",omitempty"`
+
+	// Items are the plain text of the items of a list, and Ordered
+	// is whether the list is numbered.
+	Items   []string `json:",omitempty"`
+	Ordered bool     `json:",omitempty"`
+}
+
+// A DocLink is a link in a doc to a package or to a package-level
+// identifier (or a method or field of one), such as [pkg.Name].
+type DocLink struct {
+	// Text is the text of the link, such as "pkg.Name".
+	Text string
+
+	// ImportPath is the import path of the package that is linked to
+	// (or whose identifier is), and Recv and Name are the receiver
+	// type and name of the identifier (if any).
+	ImportPath string
+	Recv       string `json:",omitempty"`
+	Name       string `json:",omitempty"`
+
+	// Def is the def key of the package or identifier, or nil if it is
+	// not in the doc's package or in one of the packages it imports
+	// (or if its unit could not be resolved).
+	Def *graph.DefKey `json:",omitempty"`
+}
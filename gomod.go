@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+)
+
+// goModule is a Go module rooted at a go.mod file inside the
+// repository being analyzed.
+type goModule struct {
+	// Dir is the absolute path of the directory containing go.mod.
+	Dir string
+
+	gog.GoMod
+
+	// Sum is the contents of the module's go.sum file, if any.
+	Sum gog.GoSum
+}
+
+// importPath returns the import path of the package in dir, which
+// must be underneath m.Dir.
+func (m *goModule) importPath(dir string) (string, error) {
+	rel, err := filepath.Rel(m.Dir, dir)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return m.Module, nil
+	}
+	return m.Module + "/" + filepath.ToSlash(rel), nil
+}
+
+// requirement returns the version of the module that provides
+// importPath in m's build, and the import path under which its source
+// can be fetched (which differs from importPath if the module is
+// replaced by another module). Requirements replaced by local
+// directories are not returned; see (goModule).localReplacement.
+func (m *goModule) requirement(importPath string) (fetchPath, version string, ok bool) {
+	if req, replace, ok := m.RequiredVersion(importPath); ok {
+		if replace == nil {
+			return importPath, req.Version, true
+		}
+		if replace.IsLocal() {
+			return "", "", false
+		}
+		return replace.New.Path + strings.TrimPrefix(importPath, req.Path), replace.New.Version, true
+	}
+	if mod, ok := m.Sum.ModuleVersion(importPath, m.Exclude); ok {
+		return importPath, mod.Version, true
+	}
+	return "", "", false
+}
+
+// localReplacement returns the directory containing the package
+// importPath if it is provided by a module that m's go.mod replaces
+// with a local directory.
+func (m *goModule) localReplacement(importPath string) (dir string, ok bool) {
+	req, replace, ok := m.RequiredVersion(importPath)
+	if !ok || replace == nil || !replace.IsLocal() {
+		return "", false
+	}
+	dir = filepath.FromSlash(replace.New.Path)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(m.Dir, dir)
+	}
+	return filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(importPath, req.Path))), true
+}
+
+// goModules is a list of modules sorted by decreasing Dir length, so
+// that nested modules come before the modules that contain them.
+type goModules []*goModule
+
+func (ms goModules) Len() int           { return len(ms) }
+func (ms goModules) Less(i, j int) bool { return len(ms[i].Dir) > len(ms[j].Dir) }
+func (ms goModules) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
+
+// forDir returns the innermost module containing dir, or nil if dir is
+// not in any module.
+func (ms goModules) forDir(dir string) *goModule {
+	for _, m := range ms {
+		if pathHasPrefix(dir, m.Dir) {
+			return m
+		}
+	}
+	return nil
+}
+
+// forImportPath returns the module in ms whose module path is the
+// longest prefix of importPath, or nil if there is none.
+func (ms goModules) forImportPath(importPath string) *goModule {
+	var found *goModule
+	for _, m := range ms {
+		if gog.ImportPathInModule(importPath, m.Module) && (found == nil || len(m.Module) > len(found.Module)) {
+			found = m
+		}
+	}
+	return found
+}
+
+// findGoModules finds all go.mod files in the directory tree rooted at
+// dir, including nested modules. Directories that the go tool ignores
+// (and vendor dirs, which hold other repositories' modules) are
+// skipped.
+func findGoModules(dir string) (goModules, error) {
+	var mods goModules
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && (name[0] == '.' || name[0] == '_' || name == "testdata" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name != "go.mod" {
+			return nil
+		}
+		gomod, err := gog.LoadGoModFile(path)
+		if err != nil {
+			log.Printf("Ignoring Go module at %s: %s.", path, err)
+			return nil
+		}
+		if gomod.Module == "" {
+			log.Printf("Ignoring Go module at %s: no module directive.", path)
+			return nil
+		}
+		mod := &goModule{Dir: filepath.Dir(path), GoMod: gomod}
+		if sum, err := gog.LoadGoSumFile(filepath.Join(mod.Dir, "go.sum")); err == nil {
+			mod.Sum = sum
+		} else if !os.IsNotExist(err) {
+			log.Printf("Ignoring go.sum for Go module at %s: %s.", path, err)
+		}
+		mods = append(mods, mod)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(mods)
+	return mods, nil
+}
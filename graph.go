@@ -1,23 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"go/build"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 
 	"sourcegraph.com/sourcegraph/srclib-go/gog"
 	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
 	defpkg "sourcegraph.com/sourcegraph/srclib-go/golang_def"
+	"sourcegraph.com/sourcegraph/srclib/dep"
 	"sourcegraph.com/sourcegraph/srclib/graph"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
@@ -31,24 +35,14 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// Check that we have the '-i' flag.
-	cmd := exec.Command("go", "help", "build")
-	o, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
-	usage := strings.Split(string(o), "\n")[0] // The usage is on the first line.
-	matched, err := regexp.MatchString("-i", usage)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if !matched {
-		log.Fatal("'go build' does not have the '-i' flag. Please upgrade to go1.3+.")
-	}
 }
 
-type GraphCmd struct{}
+type GraphCmd struct {
+	Stream bool `long:"stream" description:"write defs, refs and docs as newline-delimited JSON records as each package is graphed"`
+
+	PrevOutput string `long:"prev-output" description:"graph incrementally, copying the output of the units that have not changed from this previous output (requires --manifest)"`
+	Manifest   string `long:"manifest" description:"read the manifest of the previous output from this file (if it exists), and write the manifest of this output to it"`
+}
 
 var graphCmd GraphCmd
 
@@ -57,21 +51,80 @@ var graphCmd GraphCmd
 var allowErrorsInGoGet = true
 
 func (c *GraphCmd) Execute(args []string) error {
-	inputBytes, err := ioutil.ReadAll(os.Stdin)
+	units, err := readSourceUnits()
 	if err != nil {
 		return err
 	}
+
+	if c.PrevOutput != "" && (c.Manifest == "" || c.Stream) {
+		return fmt.Errorf("--prev-output requires --manifest and can't be used with --stream")
+	}
+
+	var manifest, prevManifest *graphManifest
+	if c.Manifest != "" {
+		if manifest, err = buildManifest(units); err != nil {
+			return err
+		}
+		if prevManifest, err = readManifest(c.Manifest); err != nil {
+			return err
+		}
+	}
+
+	if c.Stream {
+		if err := GraphStream(units, os.Stdout); err != nil {
+			return err
+		}
+	} else {
+		var out *graphOutput
+		if manifest != nil {
+			// Graph incrementally if there is a previous output, and
+			// record the method names of the packages in the manifest
+			// either way.
+			var prev *graphOutput
+			if c.PrevOutput != "" && prevManifest != nil {
+				if prev, err = readGraphOutput(c.PrevOutput); err != nil {
+					return err
+				}
+			}
+			if out, err = GraphIncremental(units, prev, prevManifest, manifest); err != nil {
+				return err
+			}
+		} else {
+			if out, err = Graph(units); err != nil {
+				return err
+			}
+			makeOutputPathsRelative(out)
+		}
+
+		if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+			return err
+		}
+	}
+
+	if manifest != nil {
+		return writeManifest(c.Manifest, manifest)
+	}
+	return nil
+}
+
+// readSourceUnits reads the source units to operate on from stdin
+// and applies the config of the first one.
+func readSourceUnits() (unit.SourceUnits, error) {
+	inputBytes, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
 	var units unit.SourceUnits
 	if err := json.NewDecoder(bytes.NewReader(inputBytes)).Decode(&units); err != nil {
 		// Legacy API: try parsing input as a single source unit
 		var u *unit.SourceUnit
 		if err := json.NewDecoder(bytes.NewReader(inputBytes)).Decode(&u); err != nil {
-			return err
+			return nil, err
 		}
 		units = unit.SourceUnits{u}
 	}
 	if err := os.Stdin.Close(); err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(units) == 0 {
@@ -81,18 +134,17 @@ func (c *GraphCmd) Execute(args []string) error {
 	// HACK: fix this. Is this required? We only seem to be setting
 	// GOROOT and GOPATH
 	if err := unmarshalTypedConfig(units[0].Config); err != nil {
-		return err
+		return nil, err
 	}
 	if err := config.apply(); err != nil {
-		return err
-	}
-
-	out, err := Graph(units)
-	if err != nil {
-		return err
+		return nil, err
 	}
+	return units, nil
+}
 
-	// Make paths relative to repo.
+// makeOutputPathsRelative makes the file paths in out relative to the
+// repository.
+func makeOutputPathsRelative(out *graphOutput) {
 	for _, gs := range out.Defs {
 		if gs.File == "" {
 			log.Printf("no file %+v", gs)
@@ -111,11 +163,6 @@ func (c *GraphCmd) Execute(args []string) error {
 			gd.File = relPath(cwd, gd.File)
 		}
 	}
-
-	if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
-		return err
-	}
-	return nil
 }
 
 func relPath(base, path string) string {
@@ -126,23 +173,149 @@ func relPath(base, path string) string {
 	return filepath.ToSlash(rp)
 }
 
-func Graph(units unit.SourceUnits) (*graph.Output, error) {
-	var pkgs []*build.Package
+func Graph(units unit.SourceUnits) (*graphOutput, error) {
+	o, err := doGraph(unitsAsBuildPackages(units), nil)
+	if err != nil {
+		return nil, err
+	}
+	return convertGoOutput(o), nil
+}
+
+// GraphStream graphs units like Graph, but instead of returning the
+// output, it writes the defs, refs and docs of each package to w as
+// soon as the package is graphed, as newline-delimited JSON
+// graphRecords.
+func GraphStream(units unit.SourceUnits, w io.Writer) error {
+	sink := &graphRecordSink{w: bufio.NewWriter(w)}
+	sink.enc = json.NewEncoder(sink.w)
+	if _, err := doGraph(unitsAsBuildPackages(units), sink); err != nil {
+		return err
+	}
+	return sink.err
+}
+
+// graphRecord is a def, ref or doc in the output of GraphStream.
+type graphRecord struct {
+	Type string      // "def", "ref" or "doc"
+	Data interface{} // the *graph.Def, *goRef or *graph.Doc
+}
+
+// graphRecordSink is a gog.Sink that writes graph data as
+// newline-delimited JSON graphRecords.
+type graphRecordSink struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+
+	// err is the first error that occurred writing output. Once it is
+	// set, nothing more is written.
+	err error
+}
+
+func (s *graphRecordSink) Emit(pkg *packages.Package, defs []*gog.Def, refs []*gog.Ref, docs []*gog.Doc) error {
+	if s.err != nil {
+		return nil
+	}
+	out := convertGoOutput(&gog.Output{Defs: defs, Refs: refs, Docs: docs})
+	makeOutputPathsRelative(out)
+	s.err = s.write(out)
+	return nil
+}
+
+func (s *graphRecordSink) write(out *graphOutput) error {
+	for _, d := range out.Defs {
+		if err := s.enc.Encode(graphRecord{Type: "def", Data: d}); err != nil {
+			return err
+		}
+	}
+	for _, r := range out.Refs {
+		if err := s.enc.Encode(graphRecord{Type: "ref", Data: r}); err != nil {
+			return err
+		}
+	}
+	for _, d := range out.Docs {
+		if err := s.enc.Encode(graphRecord{Type: "doc", Data: d}); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// A unitPackage is the build package of a source unit, and the root
+// directory (absolute) of the Go module that the unit is in, or "" if
+// it is not in a module.
+type unitPackage struct {
+	*build.Package
+	moduleRoot string
+}
+
+// unitsAsBuildPackages converts units to the build packages to graph,
+// skipping units that can't be converted. The module root of each
+// unit is taken from its own config (not the config of the first
+// unit), because the units may be in different modules.
+func unitsAsBuildPackages(units unit.SourceUnits) []*unitPackage {
+	var pkgs []*unitPackage
 	for _, u := range units {
 		pkg, err := UnitDataAsBuildPackage(u)
 		if err != nil {
 			log.Printf("Ignoring unit %q due to error in converting to build pkg: %s.", u.Name, err)
 			continue
 		}
-		pkgs = append(pkgs, pkg)
+		pkgs = append(pkgs, &unitPackage{Package: pkg, moduleRoot: unitModuleRoot(u)})
 	}
+	return pkgs
+}
 
-	o, err := doGraph(pkgs)
-	if err != nil {
-		return nil, err
+// newGrapher returns a grapher for pkgs that outputs docs in the
+// formats of the Srcfile config.
+func newGrapher(pkgs []*packages.Package) *gog.Grapher {
+	g := gog.New(pkgs)
+	g.DocFormats = config.DocFormats
+	return g
+}
+
+// unitModuleRoot returns the root directory (absolute) of the Go
+// module that u is in, or "" if it is not in a module.
+func unitModuleRoot(u *unit.SourceUnit) string {
+	root, _ := u.Config["ModuleRoot"].(string)
+	if root == "" {
+		return ""
 	}
+	return cleanDirs([]string{filepath.FromSlash(root)})[0]
+}
+
+// unitImportPath returns the import path of the unit that pkg belongs
+// to. The external test package foo_test belongs to the unit of foo.
+func unitImportPath(pkg *packages.Package) string {
+	if strings.HasSuffix(pkg.Name, "_test") {
+		return strings.TrimSuffix(pkg.PkgPath, "_test")
+	}
+	return pkg.PkgPath
+}
 
-	o2 := graph.Output{}
+// graphOutput is srclib's graph output, except that its refs have
+// Go-specific data.
+type graphOutput struct {
+	Defs []*graph.Def `json:",omitempty"`
+	Refs []*goRef     `json:",omitempty"`
+	Docs []*graph.Doc `json:",omitempty"`
+}
+
+// goRef is a graph.Ref with the kind of the ref (see gog.Ref.Kind),
+// the def that it is made from (see gog.Ref.From) and the build
+// configurations that it exists under (see gog.Ref.BuildConfigs),
+// which graph.Ref has no fields for.
+type goRef struct {
+	*graph.Ref
+	Kind         string        `json:",omitempty"`
+	From         *graph.DefKey `json:",omitempty"`
+	BuildConfigs []string      `json:",omitempty"`
+}
+
+// convertGoOutput converts the grapher's output to srclib's graph
+// output format, skipping (and logging) anything that can't be
+// converted.
+func convertGoOutput(o *gog.Output) *graphOutput {
+	o2 := graphOutput{}
 
 	for _, gs := range o.Defs {
 		d, err := convertGoDef(gs)
@@ -175,11 +348,11 @@ func Graph(units unit.SourceUnits) (*graph.Output, error) {
 		}
 	}
 
-	return &o2, nil
+	return &o2
 }
 
 func convertGoDef(gs *gog.Def) (*graph.Def, error) {
-	resolvedTarget, err := ResolveDep(gs.DefKey.PackageImportPath)
+	resolvedTarget, err := resolveDefKey(gs.DefKey)
 	if err != nil {
 		return nil, err
 	}
@@ -212,6 +385,49 @@ func convertGoDef(gs *gog.Def) (*graph.Def, error) {
 	d := defpkg.DefData{
 		PackageImportPath: gs.DefKey.PackageImportPath,
 		DefInfo:           gs.DefInfo,
+		BuildConfigs:      gs.BuildConfigs,
+	}
+	if d.Implements, err = convertGoDefKeys(gs.Implements); err != nil {
+		return nil, err
+	}
+	if d.ImplementedBy, err = convertGoDefKeys(gs.ImplementedBy); err != nil {
+		return nil, err
+	}
+	for _, p := range gs.Promotions {
+		member, err := convertGoDefKeys([]*gog.DefKey{p.Member})
+		if err != nil {
+			return nil, err
+		}
+		via, err := convertGoDefKeys(p.Via)
+		if err != nil {
+			return nil, err
+		}
+		if len(member) == 1 && len(via) == len(p.Via) {
+			d.Promotions = append(d.Promotions, defpkg.Promotion{Member: member[0], Via: via})
+		}
+	}
+	for _, b := range gs.AsmBodies {
+		d.AsmBodies = append(d.AsmBodies, defpkg.AsmBody{
+			File:  relPath(cwd, b.File),
+			Start: b.Span[0],
+			End:   b.Span[1],
+			Arch:  b.Arch,
+		})
+	}
+	if f := gs.GoFile; f != nil {
+		d.GoFile = &defpkg.GoFile{
+			BuildConstraint: f.BuildConstraint,
+			PackageStart:    f.PackageSpan[0],
+			PackageEnd:      f.PackageSpan[1],
+		}
+		for _, imp := range f.Imports {
+			d.GoFile.Imports = append(d.GoFile.Imports, defpkg.FileImport{
+				Path:  imp.Path,
+				Name:  imp.Name,
+				Start: imp.Span[0],
+				End:   imp.Span[1],
+			})
+		}
 	}
 	def.Data, err = json.Marshal(d)
 	if err != nil {
@@ -226,8 +442,43 @@ func convertGoDef(gs *gog.Def) (*graph.Def, error) {
 	return def, nil
 }
 
-func convertGoRef(gr *gog.Ref) (*graph.Ref, error) {
-	resolvedTarget, err := ResolveDep(gr.Def.PackageImportPath)
+// resolveDefKey resolves the unit that the def key k is in (see
+// ResolveDep). The C declarations of a cgo package are in a unit of
+// type "C" that has the name (and repository) of the cgo package.
+func resolveDefKey(k *gog.DefKey) (*dep.ResolvedTarget, error) {
+	resolvedTarget, err := ResolveDep(k.PackageImportPath)
+	if err != nil || resolvedTarget == nil || k.UnitType == "" {
+		return resolvedTarget, err
+	}
+	t := *resolvedTarget
+	t.ToUnitType = k.UnitType
+	return &t, nil
+}
+
+// convertGoDefKeys converts the grapher's def keys to srclib def
+// keys, skipping def keys that don't resolve to a unit.
+func convertGoDefKeys(keys []*gog.DefKey) ([]graph.DefKey, error) {
+	var keys2 []graph.DefKey
+	for _, k := range keys {
+		resolvedTarget, err := resolveDefKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if resolvedTarget == nil {
+			continue
+		}
+		keys2 = append(keys2, graph.DefKey{
+			Repo:     filepath.ToSlash(uriOrEmpty(resolvedTarget.ToRepoCloneURL)),
+			UnitType: resolvedTarget.ToUnitType,
+			Unit:     resolvedTarget.ToUnit,
+			Path:     filepath.ToSlash(pathOrDot(filepath.Join(k.Path...))),
+		})
+	}
+	return keys2, nil
+}
+
+func convertGoRef(gr *gog.Ref) (*goRef, error) {
+	resolvedTarget, err := resolveDefKey(gr.Def)
 	if err != nil {
 		return nil, err
 	}
@@ -243,23 +494,39 @@ func convertGoRef(gr *gog.Ref) (*graph.Ref, error) {
 		return nil, nil
 	}
 
-	return &graph.Ref{
-		DefRepo:     filepath.ToSlash(uriOrEmpty(resolvedTarget.ToRepoCloneURL)),
-		DefPath:     filepath.ToSlash(pathOrDot(filepath.Join(gr.Def.Path...))),
-		DefUnit:     resolvedTarget.ToUnit,
-		DefUnitType: resolvedTarget.ToUnitType,
-		Def:         gr.IsDef,
-		Unit:        resolvedRefUnit.ToUnit,
-		File:        filepath.ToSlash(gr.File),
-		Start:       gr.Span[0],
-		End:         gr.Span[1],
+	var from *graph.DefKey
+	if gr.From != nil {
+		keys, err := convertGoDefKeys([]*gog.DefKey{gr.From})
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 1 {
+			from = &keys[0]
+		}
+	}
+
+	return &goRef{
+		Ref: &graph.Ref{
+			DefRepo:     filepath.ToSlash(uriOrEmpty(resolvedTarget.ToRepoCloneURL)),
+			DefPath:     filepath.ToSlash(pathOrDot(filepath.Join(gr.Def.Path...))),
+			DefUnit:     resolvedTarget.ToUnit,
+			DefUnitType: resolvedTarget.ToUnitType,
+			Def:         gr.IsDef,
+			Unit:        resolvedRefUnit.ToUnit,
+			File:        filepath.ToSlash(gr.File),
+			Start:       gr.Span[0],
+			End:         gr.Span[1],
+		},
+		Kind:         gr.Kind,
+		From:         from,
+		BuildConfigs: gr.BuildConfigs,
 	}, nil
 }
 
 func convertGoDoc(gd *gog.Doc) (*graph.Doc, error) {
 	var key graph.DefKey
 	if gd.DefKey != nil {
-		resolvedTarget, err := ResolveDep(gd.PackageImportPath)
+		resolvedTarget, err := resolveDefKey(gd.DefKey)
 		if err != nil {
 			return nil, err
 		}
@@ -278,10 +545,17 @@ func convertGoDoc(gd *gog.Doc) (*graph.Doc, error) {
 		return nil, nil
 	}
 
+	data := gd.Data
+	if gd.Format == gog.DocStructured {
+		if data, err = convertStructuredDoc(data); err != nil {
+			return nil, err
+		}
+	}
+
 	return &graph.Doc{
 		DefKey:  key,
 		Format:  gd.Format,
-		Data:    gd.Data,
+		Data:    data,
 		File:    filepath.ToSlash(gd.File),
 		Start:   gd.Span[0],
 		End:     gd.Span[1],
@@ -289,6 +563,42 @@ func convertGoDoc(gd *gog.Doc) (*graph.Doc, error) {
 	}, nil
 }
 
+// convertStructuredDoc converts the grapher's structured doc data to
+// the data of a golang_def.StructuredDoc, whose links refer to srclib
+// def keys.
+func convertStructuredDoc(data string) (string, error) {
+	var gsd gog.StructuredDoc
+	if err := json.Unmarshal([]byte(data), &gsd); err != nil {
+		return "", err
+	}
+	sd := defpkg.StructuredDoc{
+		Summary:    gsd.Summary,
+		Deprecated: gsd.Deprecated,
+		Blocks:     make([]*defpkg.DocBlock, len(gsd.Blocks)),
+	}
+	for i, b := range gsd.Blocks {
+		sd.Blocks[i] = &defpkg.DocBlock{Kind: b.Kind, Text: b.Text, Items: b.Items, Ordered: b.Ordered}
+	}
+	for _, l := range gsd.Links {
+		link := &defpkg.DocLink{Text: l.Text, ImportPath: l.ImportPath, Recv: l.Recv, Name: l.Name}
+		if l.Def != nil {
+			keys, err := convertGoDefKeys([]*gog.DefKey{l.Def})
+			if err != nil {
+				return "", err
+			}
+			if len(keys) == 1 {
+				link.Def = &keys[0]
+			}
+		}
+		sd.Links = append(sd.Links, link)
+	}
+	b, err := json.Marshal(sd)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func uriOrEmpty(cloneURL string) string {
 	if cloneURL == "" {
 		return ""
@@ -314,67 +624,287 @@ func treePath(path string) string {
 // encountering "reasonably common" errors (such as compile errors).
 var allowErrorsInGraph = true
 
-func doGraph(pkgs []*build.Package) (*gog.Output, error) {
-	// Special-case: if this is a Cgo package, treat the CgoFiles as GoFiles or
-	// else the character offsets will be junk.
-	//
-	// See https://codereview.appspot.com/86140043.
-	loaderConfig.Build.CgoEnabled = false
-	build.Default = *loaderConfig.Build
+// doGraph graphs pkgs under each of the build configurations in
+// config.BuildConfigs (or the default build configuration, if there
+// are none), merging the results. If sink is non-nil, the graph data
+// is emitted to it (and the returned output is empty).
+func doGraph(pkgs []*unitPackage, sink gog.Sink) (*gog.Output, error) {
+	if len(config.BuildConfigs) == 0 {
+		return doGraphConfig(pkgs, gog.BuildConfig{}, sink)
+	}
 
-	for _, pkg := range pkgs {
-		importPath := pkg.ImportPath
-		importUnsafe := importPath == "unsafe"
+	if sink != nil {
+		if err := doGraphConfigsStream(pkgs, sink); err != nil {
+			return nil, err
+		}
+		return &gog.Output{}, nil
+	}
 
-		if len(pkg.CgoFiles) > 0 {
-			var allGoFiles []string
-			allGoFiles = append(allGoFiles, pkg.GoFiles...)
-			allGoFiles = append(allGoFiles, pkg.CgoFiles...)
-			allGoFiles = append(allGoFiles, pkg.TestGoFiles...)
-			for i, f := range allGoFiles {
-				allGoFiles[i] = filepath.Join(cwd, pkg.Dir, f)
-			}
-			loaderConfig.CreateFromFilenames(pkg.ImportPath, allGoFiles...)
-		} else {
-			// Normal import
-			loaderConfig.ImportWithTests(importPath)
+	outputs := make([]*gog.Output, len(config.BuildConfigs))
+	for i, bc := range config.BuildConfigs {
+		o, err := doGraphConfig(pkgs, bc, nil)
+		if err != nil {
+			return nil, fmt.Errorf("build config %s: %s", bc, err)
 		}
+		outputs[i] = o
+	}
+	return gog.MergeOutputs(config.BuildConfigs, outputs), nil
+}
 
-		if importUnsafe {
-			// Special-case "unsafe" because go/loader does not let you load it
-			// directly.
-			if loaderConfig.ImportPkgs == nil {
-				loaderConfig.ImportPkgs = make(map[string]bool)
+// doGraphConfigsStream graphs pkgs under each of config.BuildConfigs,
+// emitting the merged output of each unit to sink as soon as the unit
+// has been graphed under all of them. The packages are loaded under
+// all of the build configurations first, so that only the output of
+// the units that are being graphed is kept in memory.
+func doGraphConfigsStream(pkgs []*unitPackage, sink gog.Sink) error {
+	configs := config.BuildConfigs
+	graphers := make([]*gog.Grapher, len(configs))
+	outputs := make([]*pkgOutputs, len(configs))
+	unitPkgs := make([]map[string][]*packages.Package, len(configs))
+	var units []string
+	seenUnit := make(map[string]bool)
+	for i, bc := range configs {
+		loaded, err := loadPackages(pkgs, bc)
+		if err != nil {
+			return fmt.Errorf("build config %s: %s", bc, err)
+		}
+		outputs[i] = &pkgOutputs{outputs: make(map[*packages.Package]*gog.Output)}
+		graphers[i] = newGrapher(loaded)
+		graphers[i].Sink = outputs[i]
+		unitPkgs[i] = make(map[string][]*packages.Package)
+		for _, pkg := range loaded {
+			unit := unitImportPath(pkg)
+			if !seenUnit[unit] {
+				seenUnit[unit] = true
+				units = append(units, unit)
 			}
-			loaderConfig.ImportPkgs["unsafe"] = true
+			unitPkgs[i][unit] = append(unitPkgs[i][unit], pkg)
 		}
 	}
 
-	prog, err := loaderConfig.Load()
+	workers := config.GraphWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var (
+		sinkMu  sync.Mutex
+		sinkErr error
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, workers)
+	for _, unit := range units {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(unit string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			unitOutputs := make([]*gog.Output, len(configs))
+			for i, g := range graphers {
+				unitOutputs[i] = &gog.Output{}
+				for _, pkg := range unitPkgs[i][unit] {
+					if err := g.Graph(pkg); err != nil {
+						log.Printf("Ignoring pkg %q due to error in gog.Graph: %s.", pkg.Name, err)
+						continue
+					}
+					if o := outputs[i].take(pkg); o != nil {
+						unitOutputs[i].Emit(pkg, o.Defs, o.Refs, o.Docs)
+					}
+				}
+			}
+			o := gog.MergeOutputs(configs, unitOutputs)
+
+			sinkMu.Lock()
+			defer sinkMu.Unlock()
+			if sinkErr == nil {
+				sinkErr = sink.Emit(nil, o.Defs, o.Refs, o.Docs)
+			}
+		}(unit)
+	}
+	wg.Wait()
+	return sinkErr
+}
+
+// pkgOutputs is a gog.Sink that keeps the output of each package until
+// it is taken.
+type pkgOutputs struct {
+	mu      sync.Mutex
+	outputs map[*packages.Package]*gog.Output
+}
+
+func (s *pkgOutputs) Emit(pkg *packages.Package, defs []*gog.Def, refs []*gog.Ref, docs []*gog.Doc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputs[pkg] = &gog.Output{Defs: defs, Refs: refs, Docs: docs}
+	return nil
+}
+
+// take returns the output of pkg and forgets it.
+func (s *pkgOutputs) take(pkg *packages.Package) *gog.Output {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.outputs[pkg]
+	delete(s.outputs, pkg)
+	return o
+}
+
+// doGraphConfig graphs pkgs under the build configuration bc.
+func doGraphConfig(pkgs []*unitPackage, bc gog.BuildConfig, sink gog.Sink) (*gog.Output, error) {
+	graphPkgs, err := loadPackages(pkgs, bc)
 	if err != nil {
-		log.Println("XXX", err)
 		return nil, err
 	}
 
-	g := gog.New(prog)
+	g := newGrapher(graphPkgs)
+	g.Sink = sink
 
-	var pkgInfos []*loader.PackageInfo
-	for _, pkg := range prog.Created {
-		if strings.HasSuffix(pkg.Pkg.Name(), "_test") {
-			// ignore xtest packages
-			continue
+	for _, err := range g.GraphPackages(graphPkgs, config.GraphWorkers) {
+		log.Printf("Ignoring pkg %q due to error in gog.Graph: %s.", err.Pkg.Name, err.Err)
+	}
+
+	return &g.Output, nil
+}
+
+// loadPackages loads and type-checks pkgs (and their tests) under the
+// build configuration bc, returning the packages to graph. Packages
+// that can't be type-checked are skipped. The packages of each Go
+// module are loaded from the module's root (and the packages that are
+// not in a module, in GOPATH mode), sharing a FileSet.
+func loadPackages(pkgs []*unitPackage, bc gog.BuildConfig) ([]*packages.Package, error) {
+	var roots []string
+	byRoot := make(map[string][]*unitPackage)
+	for _, pkg := range pkgs {
+		if _, ok := byRoot[pkg.moduleRoot]; !ok {
+			roots = append(roots, pkg.moduleRoot)
+		}
+		byRoot[pkg.moduleRoot] = append(byRoot[pkg.moduleRoot], pkg)
+	}
+
+	fset := token.NewFileSet()
+	var graphPkgs []*packages.Package
+	for _, root := range roots {
+		cfg := loadConfig(bc, root)
+		cfg.Fset = fset
+		loaded, err := loadModulePackages(cfg, byRoot[root], bc)
+		if err != nil {
+			return nil, err
 		}
-		pkgInfos = append(pkgInfos, pkg)
+		graphPkgs = append(graphPkgs, loaded...)
 	}
-	for _, pkg := range prog.Imported {
-		pkgInfos = append(pkgInfos, pkg)
+	return graphPkgs, nil
+}
+
+// loadModulePackages loads pkgs, which are in the same Go module (or
+// are not in a module), with cfg. See loadPackages.
+func loadModulePackages(cfg *packages.Config, pkgs []*unitPackage, bc gog.BuildConfig) ([]*packages.Package, error) {
+	var patterns []string
+	buildPkgs := make(map[string]*build.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		patterns = append(patterns, pkg.ImportPath)
+		buildPkgs[pkg.ImportPath] = pkg.Package
 	}
 
-	for _, pkg := range pkgInfos {
-		if err := g.Graph(pkg); err != nil {
-			log.Printf("Ignoring pkg %q due to error in gog.Graph: %s.", pkg.Pkg.Name(), err)
+	loaded, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var graphPkgs []*packages.Package
+	for _, pkg := range gog.PackagesToGraph(loaded) {
+		if pkg.PkgPath == "unsafe" {
+			// Special-case "unsafe" because go/packages does not
+			// type-check its source.
+			if err := gog.CheckFiles(cfg, pkg, pkg.GoFiles); err != nil {
+				log.Printf("Ignoring pkg %q due to error type-checking it: %s.", pkg.PkgPath, err)
+				continue
+			}
+		} else if bpkg := buildPkgs[pkg.PkgPath]; bpkg != nil && len(bpkg.CgoFiles) > 0 {
+			bpkg, err := importBuildConfig(bpkg, bc)
+			if err != nil {
+				log.Printf("Ignoring pkg %q due to error importing it: %s.", pkg.PkgPath, err)
+				continue
+			}
+			var allGoFiles []string
+			allGoFiles = append(allGoFiles, bpkg.GoFiles...)
+			allGoFiles = append(allGoFiles, bpkg.CgoFiles...)
+			allGoFiles = append(allGoFiles, bpkg.TestGoFiles...)
+			for i, f := range allGoFiles {
+				allGoFiles[i] = filepath.Join(cwd, bpkg.Dir, f)
+			}
+			if err := gog.CheckFiles(cfg, pkg, allGoFiles); err != nil {
+				log.Printf("Ignoring pkg %q due to error type-checking it: %s.", pkg.PkgPath, err)
+				continue
+			}
+			// go/packages omits the C files (and other non-Go files)
+			// of cgo packages when cgo is disabled. The grapher reads
+			// the C declarations in them.
+			var otherFiles []string
+			for _, files := range [][]string{bpkg.CFiles, bpkg.CXXFiles, bpkg.MFiles, bpkg.HFiles, bpkg.FFiles, bpkg.SFiles, bpkg.SwigFiles, bpkg.SwigCXXFiles, bpkg.SysoFiles} {
+				for _, f := range files {
+					otherFiles = append(otherFiles, filepath.Join(cwd, bpkg.Dir, f))
+				}
+			}
+			pkg.OtherFiles = otherFiles
 		}
+
+		graphPkgs = append(graphPkgs, pkg)
 	}
 
-	return &g.Output, nil
+	// Log the errors after the packages that go/packages can't
+	// type-check have been type-checked again, so that their errors are
+	// the ones from type-checking their original files.
+	packages.Visit(loaded, nil, func(pkg *packages.Package) {
+		for _, err := range pkg.Errors {
+			log.Printf("warning: %s", err)
+		}
+	})
+	return graphPkgs, nil
+}
+
+// loadConfig returns the go/packages config with which to load the
+// packages to graph under the build configuration bc, from the root of
+// their Go module, moduleRoot ("" if they are not in a module).
+func loadConfig(bc gog.BuildConfig, moduleRoot string) *packages.Config {
+	cfg := packagesConfig
+	cfg.Dir = cwd
+	cfg.Env = append(os.Environ(), config.env()...)
+	if moduleRoot != "" {
+		cfg.Dir = moduleRoot
+		cfg.Env = append(cfg.Env, "GO111MODULE=on")
+	} else {
+		cfg.Env = append(cfg.Env, "GO111MODULE=off")
+	}
+	// Special-case: if this is a Cgo package, treat the CgoFiles as GoFiles or
+	// else the character offsets will be junk. Disable cgo so that go/packages
+	// doesn't replace the CgoFiles with generated files, and type-check them
+	// in loadPackages.
+	//
+	// See https://codereview.appspot.com/86140043.
+	cfg.Env = append(cfg.Env, "CGO_ENABLED=0")
+	return bc.Apply(&cfg)
+}
+
+// importBuildConfig returns bpkg as imported under the build
+// configuration bc (bpkg is returned as is for the default
+// configuration), so that it lists the files that bc selects.
+func importBuildConfig(bpkg *build.Package, bc gog.BuildConfig) (*build.Package, error) {
+	if bc.GOOS == "" && bc.GOARCH == "" && len(bc.Tags) == 0 {
+		return bpkg, nil
+	}
+	ctx := buildContext
+	if bc.GOOS != "" {
+		ctx.GOOS = bc.GOOS
+	}
+	if bc.GOARCH != "" {
+		ctx.GOARCH = bc.GOARCH
+	}
+	ctx.BuildTags = append(append([]string(nil), ctx.BuildTags...), bc.Tags...)
+	p, err := ctx.ImportDir(filepath.Join(cwd, bpkg.Dir), 0)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the (repository-relative) Dir of bpkg.
+	p.Dir = bpkg.Dir
+	return p, nil
 }
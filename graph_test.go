@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	defpkg "sourcegraph.com/sourcegraph/srclib-go/golang_def"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestGraphBuildConfigs(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{
+		BuildConfigs: []gog.BuildConfig{{GOOS: "linux"}, {GOOS: "windows"}},
+	}, map[string]string{
+		"go.mod":       "module example.com/p\n\ngo 1.21\n",
+		"p.go":         "package p\n\nfunc A() { F() }\n",
+		"p_linux.go":   "package p\n\nfunc F() {}\n",
+		"p_windows.go": "package p\n\nfunc F() { W() }\n\nfunc W() {}\n",
+	})
+
+	out, err := Graph(units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeOutputPathsRelative(out)
+
+	defConfigs := make(map[string][]string)
+	for _, d := range out.Defs {
+		var data struct{ BuildConfigs []string }
+		if err := json.Unmarshal(d.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		defConfigs[d.Path] = data.BuildConfigs
+	}
+	wantDefConfigs := map[string][]string{
+		".":            nil,
+		"p.go":         nil,
+		"p_linux.go":   {"linux"},
+		"p_windows.go": {"windows"},
+		"A":            nil,
+		"F":            nil,
+		"W":            {"windows"},
+	}
+	if !reflect.DeepEqual(defConfigs, wantDefConfigs) {
+		t.Errorf("got def build configs %v, want %v", defConfigs, wantDefConfigs)
+	}
+
+	// The refs' build configs must survive the conversion to (and the
+	// encoding of) the graph output.
+	b, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded graphOutput
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	refConfigs := make(map[string][]string)
+	for _, r := range decoded.Refs {
+		if r.DefPath == "A" || r.DefPath == "F" || r.DefPath == "W" {
+			refConfigs[fmt.Sprintf("%s:%d %s", r.File, r.Start, r.DefPath)] = r.BuildConfigs
+		}
+	}
+	wantRefConfigs := map[string][]string{
+		"p.go:16 A":         nil,
+		"p.go:22 F":         nil,
+		"p_linux.go:16 F":   {"linux"},
+		"p_windows.go:16 F": {"windows"},
+		"p_windows.go:22 W": {"windows"},
+		"p_windows.go:34 W": {"windows"},
+	}
+	if !reflect.DeepEqual(refConfigs, wantRefConfigs) {
+		t.Errorf("got ref build configs %v, want %v", refConfigs, wantRefConfigs)
+	}
+}
+
+func TestGraphDocFormats(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{
+		DocFormats: []string{gog.DocStructured},
+	}, map[string]string{
+		"go.mod": "module example.com/p\n\ngo 1.21\n",
+		"p.go":   "package p\n\nimport \"example.com/p/q\"\n\n// F calls [q.G] and returns a [T].\nfunc F() T { q.G(); return T{} }\n\ntype T struct{}\n",
+		"q/q.go": "package q\n\nfunc G() {}\n",
+	})
+
+	out, err := Graph(units)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sd *defpkg.StructuredDoc
+	for _, d := range out.Docs {
+		if d.Format != gog.DocStructured {
+			t.Errorf("got doc in format %q, want only %q", d.Format, gog.DocStructured)
+		}
+		if d.Path == "F" {
+			if err := json.Unmarshal([]byte(d.Data), &sd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if sd == nil {
+		t.Fatal("no structured doc for F")
+	}
+	want := []*defpkg.DocLink{
+		{Text: "q.G", ImportPath: "example.com/p/q", Name: "G", Def: &graph.DefKey{UnitType: "GoPackage", Unit: "example.com/p/q", Path: "G"}},
+		{Text: "T", ImportPath: "example.com/p", Name: "T", Def: &graph.DefKey{UnitType: "GoPackage", Unit: "example.com/p", Path: "T"}},
+	}
+	if !reflect.DeepEqual(sd.Links, want) {
+		t.Errorf("got links %s, want %s", toJSON(t, sd.Links), toJSON(t, want))
+	}
+}
+
+func TestGraphStreamBuildConfigs(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{
+		BuildConfigs: []gog.BuildConfig{{GOOS: "linux"}, {GOOS: "windows"}},
+	}, map[string]string{
+		"go.mod":         "module example.com/r\n\ngo 1.21\n",
+		"a/a.go":         "package a\n\nfunc A() { F() }\n",
+		"a/a_linux.go":   "package a\n\nfunc F() {}\n",
+		"a/a_windows.go": "package a\n\nfunc F() { W() }\n\nfunc W() {}\n",
+		"b/b.go":         "package b\n\nimport \"example.com/r/a\"\n\nfunc B() { a.A() }\n",
+	})
+
+	out, err := Graph(units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeOutputPathsRelative(out)
+	var want []string
+	for _, d := range out.Defs {
+		want = append(want, toJSON(t, graphRecord{Type: "def", Data: d}))
+	}
+	for _, r := range out.Refs {
+		want = append(want, toJSON(t, graphRecord{Type: "ref", Data: r}))
+	}
+	for _, d := range out.Docs {
+		want = append(want, toJSON(t, graphRecord{Type: "doc", Data: d}))
+	}
+	sort.Strings(want)
+
+	var buf bytes.Buffer
+	if err := GraphStream(units, &buf); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Each unit's merged output is emitted as soon as it is graphed,
+	// not all at the end.
+	var sink unitsSink
+	if _, err := doGraph(unitsAsBuildPackages(units), &sink); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(sink.units)
+	if want := []string{"example.com/r/a", "example.com/r/b"}; !reflect.DeepEqual(sink.units, want) {
+		t.Errorf("got units %v emitted, want %v", sink.units, want)
+	}
+}
+
+// unitsSink is a gog.Sink that records the unit of the defs of each
+// call to Emit, or "mixed" if they are from several units.
+type unitsSink struct {
+	units []string
+}
+
+func (s *unitsSink) Emit(pkg *packages.Package, defs []*gog.Def, refs []*gog.Ref, docs []*gog.Doc) error {
+	unit := defs[0].PackageImportPath
+	for _, d := range defs {
+		if d.PackageImportPath != unit {
+			unit = "mixed"
+		}
+	}
+	s.units = append(s.units, unit)
+	return nil
+}
+
+func toJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A graphManifest records what the output of the graph command was
+// computed from, so that a later run can tell which source units need
+// to be graphed again (see GraphIncremental).
+type graphManifest struct {
+	// Config is a hash of the srclib-go executable and of the config
+	// that the units were graphed with. If it differs, all units are
+	// graphed again.
+	Config string
+
+	// Units maps the names of the graphed source units to what they
+	// were graphed from.
+	Units map[string]*manifestUnit
+
+	// Packages are the method names of the named types of the units'
+	// packages and of their dependencies, by import path, with which a
+	// later run finds the units whose types may implement, or be
+	// implemented by, the types of the packages that changed (see
+	// GraphIncremental). They are omitted if the output was streamed.
+	Packages map[string]*gog.MethodNames `json:",omitempty"`
+
+	// deps are the import paths of the packages that the packages (and
+	// tests) of each unit import, directly or indirectly, under any of
+	// the build configurations, by unit name.
+	deps map[string]map[string]bool
+}
+
+type manifestUnit struct {
+	// Dir is the directory of the unit, relative to the repository.
+	Dir string
+
+	// Files maps the files of the unit (and of its tests), relative to
+	// the repository, to the SHA-256 hashes of their contents.
+	Files map[string]string
+
+	// Imports is a hash of the files of the packages that the unit's
+	// packages (and tests) import, directly or indirectly, under each
+	// of the build configurations.
+	Imports string
+}
+
+// buildManifest computes the manifest of graphing units.
+func buildManifest(units unit.SourceUnits) (*graphManifest, error) {
+	configHash, err := hashConfig()
+	if err != nil {
+		return nil, err
+	}
+	m := &graphManifest{
+		Config: configHash,
+		Units:  make(map[string]*manifestUnit, len(units)),
+		deps:   make(map[string]map[string]bool, len(units)),
+	}
+	h := &fileHasher{hashes: make(map[string]string)}
+
+	var roots []string
+	patterns := make(map[string][]string)
+	byImportPath := make(map[string]string, len(units))
+	for _, u := range units {
+		bpkg, err := UnitDataAsBuildPackage(u)
+		if err != nil {
+			// The unit is not graphed either (see
+			// unitsAsBuildPackages).
+			continue
+		}
+		mu := &manifestUnit{Dir: filepath.ToSlash(filepath.Clean(bpkg.Dir)), Files: make(map[string]string, len(u.Files))}
+		for _, f := range u.Files {
+			if mu.Files[f], err = h.hash(filepath.Join(cwd, f)); err != nil {
+				return nil, err
+			}
+		}
+		m.Units[u.Name] = mu
+		m.deps[u.Name] = make(map[string]bool)
+		byImportPath[bpkg.ImportPath] = u.Name
+		root := unitModuleRoot(u)
+		if _, ok := patterns[root]; !ok {
+			roots = append(roots, root)
+		}
+		patterns[root] = append(patterns[root], bpkg.ImportPath)
+	}
+
+	configs := config.BuildConfigs
+	if len(configs) == 0 {
+		configs = []gog.BuildConfig{{}}
+	}
+	imports := make(map[*manifestUnit][]string)
+	for _, bc := range configs {
+		var loaded []*packages.Package
+		for _, root := range roots {
+			cfg := loadConfig(bc, root)
+			cfg.Mode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps
+			pkgs, err := packages.Load(cfg, patterns[root]...)
+			if err != nil {
+				return nil, fmt.Errorf("build config %s: %s", bc, err)
+			}
+			loaded = append(loaded, pkgs...)
+		}
+
+		pkgHashes := make(map[*packages.Package]string)
+		var pkgHash func(pkg *packages.Package) (string, error)
+		pkgHash = func(pkg *packages.Package) (string, error) {
+			if ph, ok := pkgHashes[pkg]; ok {
+				return ph, nil
+			}
+			hh := sha256.New()
+			fmt.Fprintf(hh, "package %s\n", pkg.ID)
+			for _, f := range pkgFiles(pkg) {
+				fh, err := h.hash(f)
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(hh, "file %s %s\n", f, fh)
+			}
+			for _, imp := range sortedImports(pkg) {
+				ih, err := pkgHash(pkg.Imports[imp])
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(hh, "import %s %s\n", imp, ih)
+			}
+			pkgHashes[pkg] = hex.EncodeToString(hh.Sum(nil))
+			return pkgHashes[pkg], nil
+		}
+
+		for _, pkg := range loaded {
+			if strings.HasSuffix(pkg.ID, ".test") {
+				// The generated test main package.
+				continue
+			}
+			name, ok := byImportPath[pkg.PkgPath]
+			if !ok && strings.HasSuffix(pkg.Name, "_test") {
+				name, ok = byImportPath[strings.TrimSuffix(pkg.PkgPath, "_test")]
+			}
+			if !ok {
+				continue
+			}
+			mu := m.Units[name]
+			addDeps(m.deps[name], pkg)
+			for _, f := range pkgFiles(pkg) {
+				rel := relPath(cwd, f)
+				if mu.Files[rel], err = h.hash(f); err != nil {
+					return nil, err
+				}
+			}
+			for _, imp := range sortedImports(pkg) {
+				ih, err := pkgHash(pkg.Imports[imp])
+				if err != nil {
+					return nil, err
+				}
+				imports[mu] = append(imports[mu], fmt.Sprintf("%s %s %s %s", bc, pkg.ID, imp, ih))
+			}
+		}
+	}
+	for mu, lines := range imports {
+		sort.Strings(lines)
+		hh := sha256.New()
+		for _, line := range lines {
+			fmt.Fprintln(hh, line)
+		}
+		mu.Imports = hex.EncodeToString(hh.Sum(nil))
+	}
+	return m, nil
+}
+
+// addDeps adds the import paths of the packages that pkg imports,
+// directly or indirectly, to deps.
+func addDeps(deps map[string]bool, pkg *packages.Package) {
+	for _, imp := range pkg.Imports {
+		if !deps[imp.PkgPath] {
+			deps[imp.PkgPath] = true
+			addDeps(deps, imp)
+		}
+	}
+}
+
+// pkgFiles returns the files of pkg, including those that are excluded
+// by build constraints (or because cgo is disabled).
+func pkgFiles(pkg *packages.Package) []string {
+	var files []string
+	files = append(files, pkg.GoFiles...)
+	files = append(files, pkg.OtherFiles...)
+	files = append(files, pkg.IgnoredFiles...)
+	sort.Strings(files)
+	return files
+}
+
+func sortedImports(pkg *packages.Package) []string {
+	imports := make([]string, 0, len(pkg.Imports))
+	for imp := range pkg.Imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// hashConfig returns a hash of the srclib-go executable and of config,
+// both of which affect the output of the graph command.
+func hashConfig() (string, error) {
+	h := sha256.New()
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if err := json.NewEncoder(h).Encode(config); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileHasher computes (and caches) the SHA-256 hashes of the contents
+// of files.
+type fileHasher struct {
+	hashes map[string]string
+}
+
+func (h *fileHasher) hash(file string) (string, error) {
+	if fh, ok := h.hashes[file]; ok {
+		return fh, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hh := sha256.New()
+	if _, err := io.Copy(hh, f); err != nil {
+		return "", err
+	}
+	h.hashes[file] = hex.EncodeToString(hh.Sum(nil))
+	return h.hashes[file], nil
+}
+
+// readManifest reads the manifest in file. It returns nil if file does
+// not exist.
+func readManifest(file string) (*graphManifest, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m *graphManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %s", file, err)
+	}
+	return m, nil
+}
+
+func writeManifest(file string, m *graphManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0666)
+}
+
+// readGraphOutput reads the output of a previous run of the graph
+// command from file.
+func readGraphOutput(file string) (*graphOutput, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out graphOutput
+	if err := json.NewDecoder(f).Decode(&out); err != nil {
+		return nil, fmt.Errorf("reading previous graph output %s: %s", file, err)
+	}
+	return &out, nil
+}
+
+// GraphIncremental graphs units like Graph, but only graphs the units
+// whose entries in manifest differ from those in prevManifest (the
+// manifest of prev, the output of a previous run): those whose files,
+// or whose imports' files, have changed. The units whose types
+// implement, or are implemented by, the types of those units (or of
+// dependencies that changed) are graphed again too, because which
+// interfaces a type implements (or which types implement an interface)
+// is not only determined by its unit and its imports. The defs, refs
+// and docs of the other units are copied from prev, and only the units
+// that are graphed and the units that their types may implement, or be
+// implemented by, are loaded (see graphChanged). The result, whose file
+// paths are relative to the repository, is the same as that of a full
+// run.
+//
+// If prev and prevManifest are nil, or prevManifest has no Packages,
+// all of the units are graphed. GraphIncremental sets the Packages of
+// manifest.
+func GraphIncremental(units unit.SourceUnits, prev *graphOutput, prevManifest, manifest *graphManifest) (*graphOutput, error) {
+	if prev == nil || prevManifest == nil || prevManifest.Packages == nil {
+		prev, prevManifest = &graphOutput{}, &graphManifest{}
+	}
+	changed := make(map[string]bool)
+	dirs := make(map[string]bool)
+	unitDirs := make(map[string]string)
+	for _, u := range units {
+		mu := manifest.Units[u.Name]
+		if mu == nil {
+			continue
+		}
+		dirs[mu.Dir] = true
+		unitDirs[u.Name] = mu.Dir
+		if prevManifest.Config != manifest.Config || !reflect.DeepEqual(prevManifest.Units[u.Name], mu) {
+			changed[u.Name] = true
+		}
+	}
+
+	out, graphed, err := graphChanged(units, changed, prev, prevManifest, manifest)
+	if err != nil {
+		return nil, err
+	}
+	makeOutputPathsRelative(out)
+	unchangedDirs := make(map[string]bool)
+	for name, dir := range unitDirs {
+		if !graphed[name] {
+			unchangedDirs[dir] = true
+		}
+	}
+
+	// The file of a def, ref or doc is in the directory of the unit it
+	// belongs to, except that the file of a package def is the
+	// directory itself, and that the file of a file def can be in a
+	// subdirectory (if it is embedded with //go:embed).
+	unchanged := func(file string) bool {
+		if !dirs[file] {
+			file = path.Dir(file)
+		}
+		return unchangedDirs[file]
+	}
+	for _, d := range prev.Defs {
+		if d.Kind == definfo.File {
+			if unchangedDirs[fileDefDir(d)] {
+				out.Defs = append(out.Defs, d)
+			}
+		} else if unchanged(d.File) {
+			out.Defs = append(out.Defs, d)
+		}
+	}
+	for _, r := range prev.Refs {
+		if unchanged(r.File) {
+			out.Refs = append(out.Refs, r)
+		}
+	}
+	for _, d := range prev.Docs {
+		if unchanged(d.File) {
+			out.Docs = append(out.Docs, d)
+		}
+	}
+
+	// A full run sorts by file and then by position, and each file's
+	// defs, refs and docs all come from either prev or the units that
+	// were graphed, already sorted. So sorting stably by file alone
+	// yields the order of a full run.
+	sort.Stable(defsByFile(out.Defs))
+	sort.Stable(refsByFile(out.Refs))
+	sort.Stable(docsByFile(out.Docs))
+	return out, nil
+}
+
+// loadIncremental loads the packages of the units that graphChanged
+// needs. Tests replace it to check which units are loaded.
+var loadIncremental = loadPackages
+
+// graphChanged graphs the changed units (by name) and the unchanged
+// units whose types may implement, or be implemented by, the types of
+// a dirty package: a package of a changed unit, a dependency whose
+// method names changed, or a package that was removed. It returns the
+// output and the names of the units that it graphed, and sets the
+// Packages of manifest.
+//
+// The changed units are loaded first, to find the method names of
+// their types. The units that are graphed are then loaded along with
+// the packages that their types may implement, or be implemented by,
+// so that the same implementations are found as in a full run: for a
+// changed unit, all of the packages whose method names match; for an
+// unchanged unit, the packages that its types were linked to in prev
+// (as the links between unchanged packages can't change), and the
+// dirty packages whose method names match. Those packages are loaded
+// as the dependencies of the units that are loaded (or, if there are
+// none, of the units that import them). No other units are loaded.
+func graphChanged(units unit.SourceUnits, changed map[string]bool, prev *graphOutput, prevManifest, manifest *graphManifest) (*graphOutput, map[string]bool, error) {
+	names := make(map[string]string, len(units))
+	for _, u := range units {
+		if bpkg, err := UnitDataAsBuildPackage(u); err == nil {
+			names[bpkg.ImportPath] = u.Name
+		}
+	}
+	// unitOf returns the name of the unit of the package with the
+	// import path p, if it is in one. The external test package
+	// foo_test belongs to the unit of foo.
+	unitOf := func(p string) (string, bool) {
+		if name, ok := names[p]; ok {
+			return name, true
+		}
+		name, ok := names[strings.TrimSuffix(p, "_test")]
+		return name, ok
+	}
+	pkgs := make(map[string]*unitPackage, len(units))
+	for _, pkg := range unitsAsBuildPackages(units) {
+		pkgs[names[pkg.ImportPath]] = pkg
+	}
+	configs := config.BuildConfigs
+	if len(configs) == 0 {
+		configs = []gog.BuildConfig{{}}
+	}
+
+	// load loads the units in set under each build config, returning
+	// the packages that were loaded, their graphers and the merged
+	// method names of the packages.
+	load := func(set map[string]bool) ([][]*packages.Package, []*gog.Grapher, map[string]*gog.MethodNames, error) {
+		var loadPkgs []*unitPackage
+		for _, u := range units {
+			if pkg := pkgs[u.Name]; pkg != nil && set[u.Name] {
+				loadPkgs = append(loadPkgs, pkg)
+			}
+		}
+		methodNames := make(map[string]*gog.MethodNames)
+		if len(loadPkgs) == 0 {
+			return nil, nil, methodNames, nil
+		}
+		loaded := make([][]*packages.Package, len(configs))
+		graphers := make([]*gog.Grapher, len(configs))
+		for i, bc := range configs {
+			var err error
+			if loaded[i], err = loadIncremental(loadPkgs, bc); err != nil {
+				return nil, nil, nil, fmt.Errorf("build config %s: %s", bc, err)
+			}
+			graphers[i] = newGrapher(loaded[i])
+			for p, mn := range graphers[i].MethodNames() {
+				if methodNames[p] == nil {
+					methodNames[p] = &gog.MethodNames{}
+				}
+				methodNames[p].Merge(mn)
+			}
+		}
+		return loaded, graphers, methodNames, nil
+	}
+
+	loaded, graphers, methodNames, err := load(changed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The packages that a full run would load (and the dependencies
+	// that their method names are recorded for).
+	universe := make(map[string]bool)
+	for p := range names {
+		universe[p] = true
+	}
+	for _, deps := range manifest.deps {
+		for p := range deps {
+			universe[p] = true
+		}
+	}
+	methodNamesOf := func(p string) *gog.MethodNames {
+		if mn := methodNames[p]; mn != nil {
+			return mn
+		}
+		return prevManifest.Packages[p]
+	}
+
+	dirty := make(map[string]bool)
+	for p, mn := range methodNames {
+		if name, ok := unitOf(p); ok {
+			dirty[p] = changed[name]
+		} else {
+			dirty[p] = !reflect.DeepEqual(prevManifest.Packages[p], mn)
+		}
+	}
+
+	// The packages that the types of each unit were linked to in prev.
+	linked := make(map[string]map[string]bool)
+	for _, d := range prev.Defs {
+		if d.Kind != definfo.Type {
+			continue
+		}
+		var data struct{ Implements, ImplementedBy []graph.DefKey }
+		if err := json.Unmarshal(d.Data, &data); err != nil {
+			continue
+		}
+		for _, key := range append(data.Implements, data.ImplementedBy...) {
+			if linked[d.Unit] == nil {
+				linked[d.Unit] = make(map[string]bool)
+			}
+			linked[d.Unit][key.Unit] = true
+		}
+	}
+
+	// The packages whose method names are known, and the packages of
+	// each unit among them.
+	known := make(map[string]bool)
+	for p := range methodNames {
+		known[p] = true
+	}
+	for p := range prevManifest.Packages {
+		known[p] = true
+	}
+	unitPkgPaths := make(map[string][]string)
+	for p := range known {
+		if name, ok := unitOf(p); ok {
+			universe[p] = true
+			unitPkgPaths[name] = append(unitPkgPaths[name], p)
+		}
+	}
+	for p := range prevManifest.Packages {
+		if !universe[p] {
+			// A removed package.
+			dirty[p] = true
+		}
+	}
+
+	// mayImplement reports whether the types of the unit name may
+	// implement, or be implemented by, the types of the package p.
+	mayImplement := func(name, p string) bool {
+		other := methodNamesOf(p)
+		if other == nil || len(unitPkgPaths[name]) == 0 {
+			return true
+		}
+		for _, up := range unitPkgPaths[name] {
+			if mn := methodNamesOf(up); mn == nil || mn.MayImplement(other) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// If all of the units changed (as in a full run), they are all
+	// loaded anyway.
+	all := len(changed) >= len(pkgs)
+	graphed := make(map[string]bool, len(changed))
+	needed := make(map[string]bool)
+	for _, u := range units {
+		if changed[u.Name] {
+			graphed[u.Name] = true
+			if all {
+				continue
+			}
+			for p := range known {
+				if universe[p] && mayImplement(u.Name, p) {
+					needed[p] = true
+				}
+			}
+			continue
+		}
+		var dirtyLinked bool
+		for p := range linked[u.Name] {
+			if dirty[p] {
+				dirtyLinked = true
+			}
+		}
+		for p, d := range dirty {
+			if d && methodNames[p] != nil && mayImplement(u.Name, p) {
+				dirtyLinked = true
+			}
+		}
+		if !dirtyLinked {
+			continue
+		}
+		graphed[u.Name] = true
+		for p := range linked[u.Name] {
+			if universe[p] {
+				needed[p] = true
+			}
+		}
+	}
+
+	// Load the graphed units and the units whose packages (or whose
+	// dependencies) are needed.
+	loadSet := make(map[string]bool, len(graphed))
+	deps := make(map[string]bool)
+	add := func(name string) {
+		loadSet[name] = true
+		for p := range manifest.deps[name] {
+			deps[p] = true
+		}
+	}
+	for name := range graphed {
+		add(name)
+	}
+	var neededPaths []string
+	for p := range needed {
+		neededPaths = append(neededPaths, p)
+	}
+	sort.Strings(neededPaths)
+	var unitNames []string
+	for _, u := range units {
+		unitNames = append(unitNames, u.Name)
+	}
+	sort.Strings(unitNames)
+	for _, p := range neededPaths {
+		if name, ok := unitOf(p); ok {
+			if !loadSet[name] && !deps[p] {
+				add(name)
+			}
+			continue
+		}
+		if deps[p] {
+			continue
+		}
+		for _, name := range unitNames {
+			if manifest.deps[name][p] {
+				add(name)
+				break
+			}
+		}
+	}
+	if !reflect.DeepEqual(loadSet, changed) {
+		if loaded, graphers, methodNames, err = load(loadSet); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for p := range methodNames {
+		known[p] = true
+	}
+	manifest.Packages = make(map[string]*gog.MethodNames)
+	for p := range known {
+		if universe[p] {
+			manifest.Packages[p] = methodNamesOf(p)
+		}
+	}
+
+	outputs := make([]*gog.Output, len(graphers))
+	for i, g := range graphers {
+		var graphPkgs []*packages.Package
+		for _, pkg := range loaded[i] {
+			if graphed[names[unitImportPath(pkg)]] {
+				graphPkgs = append(graphPkgs, pkg)
+			}
+		}
+		for _, err := range g.GraphPackages(graphPkgs, config.GraphWorkers) {
+			log.Printf("Ignoring pkg %q due to error in gog.Graph: %s.", err.Pkg.Name, err.Err)
+		}
+		outputs[i] = &g.Output
+	}
+	if len(outputs) == 0 {
+		return &graphOutput{}, graphed, nil
+	}
+	o := outputs[0]
+	if len(config.BuildConfigs) > 0 {
+		o = gog.MergeOutputs(config.BuildConfigs, outputs)
+	}
+	return convertGoOutput(o), graphed, nil
+}
+
+// fileDefDir returns the directory of the unit that the file def d
+// belongs to. The def's path is the path of its file relative to that
+// directory (see gog.fileDefKey).
+func fileDefDir(d *graph.Def) string {
+	if d.File == d.Path {
+		return "."
+	}
+	return strings.TrimSuffix(d.File, "/"+d.Path)
+}
+
+// fileLess reports whether the defs, refs and docs in the file (or
+// package directory) a, relative to the repository, sort before those
+// in b. A full run sorts them by absolute path, in which the
+// repository's root directory sorts before everything in it.
+func fileLess(a, b string) bool {
+	if a == "." || b == "." {
+		return a == "." && b != "."
+	}
+	return a < b
+}
+
+type defsByFile []*graph.Def
+
+func (d defsByFile) Len() int           { return len(d) }
+func (d defsByFile) Less(i, j int) bool { return fileLess(d[i].File, d[j].File) }
+func (d defsByFile) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+type refsByFile []*goRef
+
+func (r refsByFile) Len() int           { return len(r) }
+func (r refsByFile) Less(i, j int) bool { return fileLess(r[i].File, r[j].File) }
+func (r refsByFile) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type docsByFile []*graph.Doc
+
+func (d docsByFile) Len() int           { return len(d) }
+func (d docsByFile) Less(i, j int) bool { return fileLess(d[i].File, d[j].File) }
+func (d docsByFile) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestGraphIncremental(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{}, map[string]string{
+		"go.mod":          "module example.com/r\n\ngo 1.21\n",
+		"a/a.go":          "package a\n\nimport _ \"embed\"\n\n//go:embed static/x.html\nvar X string\n\nfunc A() int { return 1 }\n",
+		"a/static/x.html": "<p>x</p>\n",
+		"b/b.go":          "package b\n\nfunc B() int { return 2 }\n",
+	})
+	prev, prevManifest := graphFull(t, units)
+
+	// Change b, so that a's output is copied from prev.
+	writeTestFiles(t, cwd, map[string]string{
+		"b/b.go": "package b\n\nfunc B() int { return 3 }\n\nfunc C() {}\n",
+	})
+	if _, _, loaded := checkIncremental(t, units, prev, prevManifest); !reflect.DeepEqual(loaded, []string{"example.com/r/b"}) {
+		t.Errorf("got units %v loaded, want only the changed unit b", loaded)
+	}
+}
+
+func TestGraphIncrementalImplements(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{}, map[string]string{
+		"go.mod": "module example.com/r\n\ngo 1.21\n",
+		"a/a.go": "package a\n\ntype I interface{ M() }\n",
+		"b/b.go": "package b\n\nimport _ \"example.com/r/a\"\n\ntype U struct{}\n",
+		"c/c.go": "package c\n\ntype V struct{}\n\nfunc (V) M() {}\n",
+		"d/d.go": "package d\n\ntype W struct{}\n\nfunc (W) N() {}\n",
+	})
+	prev, prevManifest := graphFull(t, units)
+
+	// Only the units that changed, and the units whose types may
+	// implement, or be implemented by, their types, are loaded. d's
+	// types implement nothing, so it is only loaded when it changes.
+	steps := []struct {
+		name       string
+		files      map[string]string
+		wantLoaded []string
+	}{
+		// a is unchanged, but b.U now implements a.I (and c.V stops
+		// implementing it), so a's ImplementedBy changes.
+		{"add and remove implementations", map[string]string{
+			"b/b.go": "package b\n\nimport _ \"example.com/r/a\"\n\ntype U struct{}\n\nfunc (*U) M() {}\n",
+			"c/c.go": "package c\n\ntype V struct{}\n",
+		}, []string{"example.com/r/a", "example.com/r/b", "example.com/r/c"}},
+		// c.V, in a package that does not import a, implements a.I
+		// again. a is loaded because its method names match, and b
+		// because b.U implemented a.I in the previous output.
+		{"implement without importing", map[string]string{
+			"c/c.go": "package c\n\ntype V struct{}\n\nfunc (V) M() {}\n",
+		}, []string{"example.com/r/a", "example.com/r/b", "example.com/r/c"}},
+		// b and c are unchanged, but b.U and c.V no longer implement
+		// a.I, so their Implements change. b imports a, so it changed
+		// too.
+		{"change interface", map[string]string{
+			"a/a.go": "package a\n\ntype I interface{ M(); N() }\n",
+		}, []string{"example.com/r/a", "example.com/r/b", "example.com/r/c"}},
+		// d.W gets a method that no interface has.
+		{"change unrelated unit", map[string]string{
+			"d/d.go": "package d\n\ntype W struct{}\n\nfunc (W) N() {}\n\nfunc (W) O() {}\n",
+		}, []string{"example.com/r/d"}},
+		// b.U implements a.I again, so a is loaded (and graphed). c.V
+		// lacks a.I's method N, so c is not.
+		{"implement with more methods", map[string]string{
+			"b/b.go": "package b\n\nimport _ \"example.com/r/a\"\n\ntype U struct{}\n\nfunc (*U) M() {}\n\nfunc (*U) N() {}\n",
+		}, []string{"example.com/r/a", "example.com/r/b"}},
+	}
+	for _, step := range steps {
+		writeTestFiles(t, cwd, step.files)
+		t.Run(step.name, func(t *testing.T) {
+			var loaded []string
+			prev, prevManifest, loaded = checkIncremental(t, units, prev, prevManifest)
+			if !reflect.DeepEqual(loaded, step.wantLoaded) {
+				t.Errorf("got units %v loaded, want %v", loaded, step.wantLoaded)
+			}
+		})
+	}
+}
+
+func TestGraphIncrementalDependencyInterfaces(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{}, map[string]string{
+		"go.mod": "module example.com/r\n\ngo 1.21\n",
+		"a/a.go": "package a\n\nimport \"fmt\"\n\nvar S fmt.Stringer\n",
+		"b/b.go": "package b\n\ntype T struct{}\n",
+	})
+	prev, prevManifest := graphFull(t, units)
+
+	// b.T now implements fmt.Stringer, which only a imports, so a is
+	// loaded (but not graphed) for fmt's types.
+	writeTestFiles(t, cwd, map[string]string{
+		"b/b.go": "package b\n\ntype T struct{}\n\nfunc (T) String() string { return \"\" }\n",
+	})
+	if _, _, loaded := checkIncremental(t, units, prev, prevManifest); !reflect.DeepEqual(loaded, []string{"example.com/r/a", "example.com/r/b"}) {
+		t.Errorf("got units %v loaded, want a and b", loaded)
+	}
+}
+
+// graphFull graphs units, returning the output (as a previous run of
+// the graph command would write it) and the manifest. It checks that
+// graphing them with a manifest yields the same output as Graph.
+func graphFull(t *testing.T, units unit.SourceUnits) (*graphOutput, *graphManifest) {
+	manifest, err := buildManifest(units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := GraphIncremental(units, nil, nil, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Graph(units)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeOutputPathsRelative(want)
+	if gotJSON, wantJSON := marshalOutput(t, out), marshalOutput(t, want); !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("output with a manifest differs from output of Graph\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+
+	// Read them back, as GraphIncremental gets them.
+	var prev graphOutput
+	if err := json.Unmarshal(marshalOutput(t, out), &prev); err != nil {
+		t.Fatal(err)
+	}
+	var prevManifest graphManifest
+	if err := json.Unmarshal(marshalManifest(t, manifest), &prevManifest); err != nil {
+		t.Fatal(err)
+	}
+	return &prev, &prevManifest
+}
+
+// checkIncremental checks that graphing units incrementally (given the
+// output and manifest of a previous run) yields the same output and
+// manifest as graphing them all. It returns the output and manifest of
+// the full run, and the import paths of the units that were loaded to
+// graph them incrementally.
+func checkIncremental(t *testing.T, units unit.SourceUnits, prev *graphOutput, prevManifest *graphManifest) (*graphOutput, *graphManifest, []string) {
+	manifest, err := buildManifest(units)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedUnits := make(map[string]bool)
+	defer func() { loadIncremental = loadPackages }()
+	loadIncremental = func(pkgs []*unitPackage, bc gog.BuildConfig) ([]*packages.Package, error) {
+		for _, pkg := range pkgs {
+			loadedUnits[pkg.ImportPath] = true
+		}
+		return loadPackages(pkgs, bc)
+	}
+	got, err := GraphIncremental(units, prev, prevManifest, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadIncremental = loadPackages
+
+	want, wantManifest := graphFull(t, units)
+	if gotJSON, wantJSON := marshalOutput(t, got), marshalOutput(t, want); !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("incremental output differs from full output\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+	if gotJSON, wantJSON := marshalManifest(t, manifest), marshalManifest(t, wantManifest); !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("incremental manifest differs from full manifest\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+
+	var loaded []string
+	for importPath := range loadedUnits {
+		loaded = append(loaded, importPath)
+	}
+	sort.Strings(loaded)
+	return want, wantManifest, loaded
+}
+
+func marshalManifest(t *testing.T, m *graphManifest) []byte {
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func marshalOutput(t *testing.T, out *graphOutput) []byte {
+	b, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
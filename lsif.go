@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func init() {
+	_, err := parser.AddCommand("lsif",
+		"export an LSIF index of Go packages",
+		"Graph Go packages like the graph command, and write the defs, refs and docs as an LSIF (Language Server Index Format) index.",
+		&lsifCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type LSIFCmd struct{}
+
+var lsifCmd LSIFCmd
+
+func (c *LSIFCmd) Execute(args []string) error {
+	units, err := readSourceUnits()
+	if err != nil {
+		return err
+	}
+	return LSIF(units, os.Stdout)
+}
+
+const (
+	// lsifVersion is the version of LSIF that is written.
+	lsifVersion = "0.4.3"
+
+	// lsifMonikerScheme is the scheme of the monikers of defs, whose
+	// identifiers are "UNIT:PATH" (the unit and path of the def key
+	// in the output of the graph command).
+	lsifMonikerScheme = "srclib-go"
+)
+
+// LSIF graphs units like Graph and writes the defs, refs and docs to w
+// as an LSIF index:
+//
+//   - each def becomes the definition of a result set;
+//   - each ref becomes a reference to its def's result set;
+//   - the doc of each def (along with the def formatted as for the lsp
+//     command) becomes the hover content of its result set;
+//   - each def that is not local gets an export moniker, and each def
+//     in another repository that is referred to gets an import moniker
+//     with the package information of the repository that ResolveDep
+//     resolves it to.
+func LSIF(units unit.SourceUnits, w io.Writer) error {
+	o, err := doGraph(unitsAsBuildPackages(units), nil)
+	if err != nil {
+		return err
+	}
+
+	root := evalSymlinks(cwd)
+	bw := bufio.NewWriter(w)
+	lw := &lsifWriter{
+		enc:      json.NewEncoder(bw),
+		defs:     make(map[string]*gog.Def),
+		results:  make(map[string]*lsifResult),
+		packages: make(map[string]int),
+	}
+	lw.vertex("metaData", lsifElement{
+		Version:          lsifVersion,
+		ProjectRoot:      pathToURI(root),
+		PositionEncoding: "utf-16",
+		ToolInfo:         &lsifToolInfo{Name: "srclib-go"},
+	})
+	project := lw.vertex("project", lsifElement{Kind: "go"})
+
+	docs := make(map[string]string)
+	for _, d := range o.Docs {
+		if d.DefKey != nil && d.Format == gog.DocText {
+			docs[lspDefKey(d.DefKey)] = d.Data
+		}
+	}
+
+	// Group the defs and refs by file.
+	type fileData struct {
+		defs []*gog.Def
+		refs []*gog.Ref
+	}
+	files := make(map[string]*fileData)
+	fileFor := func(file string) *fileData {
+		file = filepath.Join(root, relPath(cwd, file))
+		if files[file] == nil {
+			files[file] = &fileData{}
+		}
+		return files[file]
+	}
+	for _, d := range o.Defs {
+		lw.defs[lspDefKey(d.DefKey)] = d
+		// The file of a package def is the package's directory, so
+		// package defs have no range (but the package clauses that
+		// refer to them do).
+		if d.File != "" && d.Kind != definfo.Package {
+			fd := fileFor(d.File)
+			fd.defs = append(fd.defs, d)
+		}
+	}
+	for _, r := range o.Refs {
+		if r.File != "" {
+			fd := fileFor(r.File)
+			fd.refs = append(fd.refs, r)
+		}
+	}
+	var fileNames []string
+	for file := range files {
+		fileNames = append(fileNames, file)
+	}
+	sort.Strings(fileNames)
+
+	var documents []int
+	for _, file := range fileNames {
+		fd := files[file]
+		if err := lw.document(file, fd.defs, fd.refs); err != nil {
+			return err
+		}
+		documents = append(documents, lw.doc)
+	}
+	for _, key := range lw.resultKeys {
+		res := lw.results[key]
+		if err := lw.result(res, docs[key]); err != nil {
+			return err
+		}
+	}
+	if len(documents) > 0 {
+		lw.edge("contains", project, documents, lsifElement{})
+	}
+
+	if lw.err != nil {
+		return lw.err
+	}
+	return bw.Flush()
+}
+
+// lsifElement is an LSIF vertex or edge. Only the fields that apply to
+// its label are set.
+type lsifElement struct {
+	ID    int    `json:"id"`
+	Type  string `json:"type"`
+	Label string `json:"label"`
+
+	// Vertex properties.
+	Version          string          `json:"version,omitempty"` // of metaData or packageInformation
+	ProjectRoot      string          `json:"projectRoot,omitempty"`
+	PositionEncoding string          `json:"positionEncoding,omitempty"`
+	ToolInfo         *lsifToolInfo   `json:"toolInfo,omitempty"`
+	Kind             string          `json:"kind,omitempty"`
+	URI              string          `json:"uri,omitempty"`
+	LanguageID       string          `json:"languageId,omitempty"`
+	Start            *lspPosition    `json:"start,omitempty"`
+	End              *lspPosition    `json:"end,omitempty"`
+	Result           *lsifHover      `json:"result,omitempty"`
+	Scheme           string          `json:"scheme,omitempty"`
+	Identifier       string          `json:"identifier,omitempty"`
+	Name             string          `json:"name,omitempty"`
+	Manager          string          `json:"manager,omitempty"`
+	Repository       *lsifRepository `json:"repository,omitempty"`
+
+	// Edge properties.
+	OutV     int    `json:"outV,omitempty"`
+	InV      int    `json:"inV,omitempty"`
+	InVs     []int  `json:"inVs,omitempty"`
+	Document int    `json:"document,omitempty"`
+	Property string `json:"property,omitempty"`
+}
+
+type lsifToolInfo struct {
+	Name string `json:"name"`
+}
+
+type lsifHover struct {
+	Contents []interface{} `json:"contents"`
+}
+
+type lsifMarkedString struct {
+	Language string `json:"language"`
+	Value    string `json:"value"`
+}
+
+type lsifRepository struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// lsifResult is the result set of a def (keyed by lspDefKey), which
+// the ranges of the def and of the refs to it point to.
+type lsifResult struct {
+	id int
+
+	// def is the def, or nil if it was not graphed (for example,
+	// because it is in a dependency).
+	def *gog.Def
+
+	// key is the def key that the refs refer to.
+	key *gog.DefKey
+
+	// definitions and references are the ids of the ranges of the def
+	// and of the refs to it, by the id of their document.
+	definitions map[int][]int
+	references  map[int][]int
+	documents   []int
+}
+
+func (res *lsifResult) add(m map[int][]int, doc, rng int) {
+	if _, ok := res.definitions[doc]; !ok {
+		if _, ok := res.references[doc]; !ok {
+			res.documents = append(res.documents, doc)
+		}
+	}
+	m[doc] = append(m[doc], rng)
+}
+
+// lsifWriter writes the vertices and edges of an LSIF index, assigning
+// them ids.
+type lsifWriter struct {
+	enc *json.Encoder
+	id  int
+
+	// doc is the id of the document vertex that was last written.
+	doc int
+
+	// defs are the defs that were graphed, keyed by lspDefKey.
+	defs map[string]*gog.Def
+
+	// results are the result sets (keyed by lspDefKey), which were
+	// created in the order of resultKeys.
+	results    map[string]*lsifResult
+	resultKeys []string
+
+	// packages are the ids of the packageInformation vertices, keyed
+	// by repository clone URL and unit.
+	packages map[string]int
+
+	// err is the first error that occurred writing output. Once it is
+	// set, nothing more is written.
+	err error
+}
+
+func (w *lsifWriter) vertex(label string, e lsifElement) int {
+	w.id++
+	e.ID, e.Type, e.Label = w.id, "vertex", label
+	if w.err == nil {
+		w.err = w.enc.Encode(e)
+	}
+	return e.ID
+}
+
+// edge writes an edge from outV to inVs. The "contains" and "item"
+// edges may have several inVs, and the others have one.
+func (w *lsifWriter) edge(label string, outV int, inVs []int, e lsifElement) {
+	w.id++
+	e.ID, e.Type, e.Label, e.OutV = w.id, "edge", label, outV
+	if label == "contains" || label == "item" {
+		e.InVs = inVs
+	} else {
+		e.InV = inVs[0]
+	}
+	if w.err == nil {
+		w.err = w.enc.Encode(e)
+	}
+}
+
+// resultFor returns the result set of the def with key, creating it if
+// necessary.
+func (w *lsifWriter) resultFor(key *gog.DefKey) *lsifResult {
+	k := lspDefKey(key)
+	res := w.results[k]
+	if res == nil {
+		res = &lsifResult{
+			id:          w.vertex("resultSet", lsifElement{}),
+			def:         w.defs[k],
+			key:         key,
+			definitions: make(map[int][]int),
+			references:  make(map[int][]int),
+		}
+		w.results[k] = res
+		w.resultKeys = append(w.resultKeys, k)
+	}
+	return res
+}
+
+// document writes the document vertex of file and the ranges of the
+// defs and refs in it.
+func (w *lsifWriter) document(file string, defs []*gog.Def, refs []*gog.Ref) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	w.doc = w.vertex("document", lsifElement{URI: pathToURI(file), LanguageID: "go"})
+
+	// A def's ident and the ref that it is (the ref whose IsDef is
+	// true) have the same span, and share a range.
+	spans := make(map[[2]uint32]*lsifRange)
+	var ranges []*lsifRange
+	rangeFor := func(span [2]uint32) *lsifRange {
+		if spans[span] == nil {
+			spans[span] = &lsifRange{span: span}
+			ranges = append(ranges, spans[span])
+		}
+		return spans[span]
+	}
+	for _, d := range defs {
+		if rd := rangeFor(d.IdentSpan); rd.def == nil {
+			rd.def = d
+		}
+	}
+	for _, r := range refs {
+		if rd := rangeFor(r.Span); rd.ref == nil {
+			rd.ref = r
+		}
+	}
+	sort.Sort(rangesBySpan(ranges))
+
+	var rangeIDs []int
+	for _, rd := range ranges {
+		start, end := offsetPosition(content, int(rd.span[0])), offsetPosition(content, int(rd.span[1]))
+		rng := w.vertex("range", lsifElement{Start: &start, End: &end})
+		rangeIDs = append(rangeIDs, rng)
+
+		var res *lsifResult
+		if rd.def != nil {
+			res = w.resultFor(rd.def.DefKey)
+			res.add(res.definitions, w.doc, rng)
+		} else if rd.ref.IsDef {
+			res = w.resultFor(rd.ref.Def)
+			res.add(res.definitions, w.doc, rng)
+		} else {
+			res = w.resultFor(rd.ref.Def)
+			res.add(res.references, w.doc, rng)
+		}
+		w.edge("next", rng, []int{res.id}, lsifElement{})
+	}
+	if len(rangeIDs) > 0 {
+		w.edge("contains", w.doc, rangeIDs, lsifElement{})
+	}
+	return w.err
+}
+
+// result writes the definition, reference and hover results and the
+// moniker of res.
+func (w *lsifWriter) result(res *lsifResult, doc string) error {
+	if len(res.definitions) > 0 {
+		defResult := w.vertex("definitionResult", lsifElement{})
+		w.edge("textDocument/definition", res.id, []int{defResult}, lsifElement{})
+		for _, d := range res.documents {
+			if rngs := res.definitions[d]; len(rngs) > 0 {
+				w.edge("item", defResult, rngs, lsifElement{Document: d})
+			}
+		}
+	}
+
+	refResult := w.vertex("referenceResult", lsifElement{})
+	w.edge("textDocument/references", res.id, []int{refResult}, lsifElement{})
+	for _, d := range res.documents {
+		if rngs := res.definitions[d]; len(rngs) > 0 {
+			w.edge("item", refResult, rngs, lsifElement{Document: d, Property: "definitions"})
+		}
+		if rngs := res.references[d]; len(rngs) > 0 {
+			w.edge("item", refResult, rngs, lsifElement{Document: d, Property: "references"})
+		}
+	}
+
+	if res.def != nil {
+		contents := []interface{}{lsifMarkedString{Language: "go", Value: defDecl(res.def)}}
+		if doc = strings.TrimSpace(doc); doc != "" {
+			contents = append(contents, doc)
+		}
+		hover := w.vertex("hoverResult", lsifElement{Result: &lsifHover{Contents: contents}})
+		w.edge("textDocument/hover", res.id, []int{hover}, lsifElement{})
+	}
+
+	return w.moniker(res)
+}
+
+// moniker writes the moniker of res: an export moniker if its def was
+// graphed and is not local, or an import moniker (with package
+// information) if its def is in another repository.
+func (w *lsifWriter) moniker(res *lsifResult) error {
+	var kind string
+	switch {
+	case res.def != nil && (res.def.Exported || res.def.PkgScope):
+		kind = "export"
+	case res.def == nil:
+		kind = "import"
+	default:
+		return w.err
+	}
+
+	if res.key.UnitType != "" {
+		// The C declarations of cgo packages can't be referred to
+		// from other repositories.
+		return w.err
+	}
+
+	resolvedTarget, err := ResolveDep(res.key.PackageImportPath)
+	if err != nil {
+		log.Printf("Omitting moniker of %v due to error resolving its package: %s.", res.key, err)
+		return w.err
+	}
+	if resolvedTarget == nil {
+		return w.err
+	}
+	if kind == "import" && resolvedTarget.ToRepoCloneURL == "" {
+		// The def is in this repository but was not graphed.
+		return w.err
+	}
+
+	moniker := w.vertex("moniker", lsifElement{
+		Kind:       kind,
+		Scheme:     lsifMonikerScheme,
+		Identifier: resolvedTarget.ToUnit + ":" + filepath.ToSlash(pathOrDot(filepath.Join(res.key.Path...))),
+	})
+	w.edge("moniker", res.id, []int{moniker}, lsifElement{})
+
+	if resolvedTarget.ToRepoCloneURL != "" {
+		pkgKey := resolvedTarget.ToRepoCloneURL + "\x00" + resolvedTarget.ToUnit
+		pkg, ok := w.packages[pkgKey]
+		if !ok {
+			pkg = w.vertex("packageInformation", lsifElement{
+				Name:       resolvedTarget.ToUnit,
+				Manager:    "go",
+				Version:    resolvedTarget.ToVersionString,
+				Repository: &lsifRepository{Type: "git", URL: resolvedTarget.ToRepoCloneURL},
+			})
+			w.packages[pkgKey] = pkg
+		}
+		w.edge("packageInformation", moniker, []int{pkg}, lsifElement{})
+	}
+	return w.err
+}
+
+// lsifRange is a range in a document: the ident of a def, or a ref (or
+// both).
+type lsifRange struct {
+	span [2]uint32
+	def  *gog.Def
+	ref  *gog.Ref
+}
+
+type rangesBySpan []*lsifRange
+
+func (r rangesBySpan) Len() int      { return len(r) }
+func (r rangesBySpan) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rangesBySpan) Less(i, j int) bool {
+	if r[i].span[0] != r[j].span[0] {
+		return r[i].span[0] < r[j].span[0]
+	}
+	return r[i].span[1] < r[j].span[1]
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLSIF(t *testing.T) {
+	units := scanTestRepo(t, srcfileConfig{}, map[string]string{
+		"go.mod": "module example.com/p\n\ngo 1.21\n",
+		"p.go":   "package p\n\nimport \"strings\"\n\n// F returns A.\nfunc F() { x := strings.ToUpper(\"a\"); _ = x }\n",
+	})
+	var buf bytes.Buffer
+	if err := LSIF(units, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var e lsifElement
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, lsifElementString(t, e))
+	}
+
+	// The ranges of a document are followed by the results of the
+	// defs they are the first to refer to. Exported defs (and the
+	// package and file defs) get export monikers, defs in other
+	// repositories get import monikers with package information, and
+	// local defs (x) get none.
+	goRepo := "go " + runtime.Version() + " https://github.com/golang/go"
+	want := []string{
+		"1 metaData 0.4.3 .",
+		"2 project go",
+		"3 document p.go",
+		"4 range 0:0-0:0", // the file
+		"5 resultSet",
+		"6 next 4 -> 5",
+		"7 range 0:8-0:9", // package p
+		"8 resultSet",
+		"9 next 7 -> 8",
+		"10 range 2:7-2:16", // "strings"
+		"11 resultSet",
+		"12 next 10 -> 11",
+		"13 range 5:5-5:6", // F
+		"14 resultSet",
+		"15 next 13 -> 14",
+		"16 range 5:11-5:12", // x
+		"17 resultSet",
+		"18 next 16 -> 17",
+		"19 range 5:16-5:23", // strings
+		"20 next 19 -> 11",
+		"21 range 5:24-5:31", // ToUpper
+		"22 resultSet",
+		"23 next 21 -> 22",
+		"24 range 5:42-5:43", // x
+		"25 next 24 -> 17",
+		"26 contains 3 -> [4 7 10 13 16 19 21 24]",
+
+		// The file.
+		"27 definitionResult",
+		"28 textDocument/definition 5 -> 27",
+		"29 item 27 -> [4] in 3",
+		"30 referenceResult",
+		"31 textDocument/references 5 -> 30",
+		"32 item 30 -> [4] in 3 definitions",
+		`33 hoverResult [{"language":"go","value":"package p"}]`,
+		"34 textDocument/hover 5 -> 33",
+		"35 moniker export example.com/p:p.go",
+		"36 moniker 5 -> 35",
+
+		// The package.
+		"37 referenceResult",
+		"38 textDocument/references 8 -> 37",
+		"39 item 37 -> [7] in 3 references",
+		`40 hoverResult [{"language":"go","value":"package p"}]`,
+		"41 textDocument/hover 8 -> 40",
+		"42 moniker export example.com/p:.",
+		"43 moniker 8 -> 42",
+
+		// The strings package.
+		"44 referenceResult",
+		"45 textDocument/references 11 -> 44",
+		"46 item 44 -> [10 19] in 3 references",
+		"47 moniker import strings:.",
+		"48 moniker 11 -> 47",
+		"49 packageInformation strings " + goRepo,
+		"50 packageInformation 47 -> 49",
+
+		// F.
+		"51 definitionResult",
+		"52 textDocument/definition 14 -> 51",
+		"53 item 51 -> [13] in 3",
+		"54 referenceResult",
+		"55 textDocument/references 14 -> 54",
+		"56 item 54 -> [13] in 3 definitions",
+		`57 hoverResult [{"language":"go","value":"func F()"},"F returns A."]`,
+		"58 textDocument/hover 14 -> 57",
+		"59 moniker export example.com/p:F",
+		"60 moniker 14 -> 59",
+
+		// x.
+		"61 definitionResult",
+		"62 textDocument/definition 17 -> 61",
+		"63 item 61 -> [16] in 3",
+		"64 referenceResult",
+		"65 textDocument/references 17 -> 64",
+		"66 item 64 -> [16] in 3 definitions",
+		"67 item 64 -> [24] in 3 references",
+		`68 hoverResult [{"language":"go","value":"var x string"}]`,
+		"69 textDocument/hover 17 -> 68",
+
+		// strings.ToUpper, whose package information is shared with
+		// the strings package.
+		"70 referenceResult",
+		"71 textDocument/references 22 -> 70",
+		"72 item 70 -> [21] in 3 references",
+		"73 moniker import strings:ToUpper",
+		"74 moniker 22 -> 73",
+		"75 packageInformation 73 -> 49",
+
+		"76 contains 2 -> [3]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got LSIF:\n%s\n\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// lsifElementString returns a summary of e, with the URIs of documents
+// relative to the current directory.
+func lsifElementString(t *testing.T, e lsifElement) string {
+	s := fmt.Sprintf("%d %s", e.ID, e.Label)
+	if e.Type == "edge" {
+		if e.InVs != nil {
+			s += fmt.Sprintf(" %d -> %v", e.OutV, e.InVs)
+		} else {
+			s += fmt.Sprintf(" %d -> %d", e.OutV, e.InV)
+		}
+		if e.Document != 0 {
+			s += fmt.Sprintf(" in %d", e.Document)
+		}
+		if e.Property != "" {
+			s += " " + e.Property
+		}
+		return s
+	}
+
+	relURI := func(uri string) string {
+		file, err := uriToPath(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filepath.ToSlash(relPath(cwd, file))
+	}
+	switch e.Label {
+	case "metaData":
+		s += " " + e.Version + " " + relURI(e.ProjectRoot)
+	case "project":
+		s += " " + e.Kind
+	case "document":
+		s += " " + relURI(e.URI)
+	case "range":
+		s += fmt.Sprintf(" %d:%d-%d:%d", e.Start.Line, e.Start.Character, e.End.Line, e.End.Character)
+	case "hoverResult":
+		b, err := json.Marshal(e.Result.Contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s += " " + string(b)
+	case "moniker":
+		if e.Scheme != lsifMonikerScheme {
+			t.Errorf("got moniker scheme %q, want %q", e.Scheme, lsifMonikerScheme)
+		}
+		s += " " + e.Kind + " " + e.Identifier
+	case "packageInformation":
+		s += " " + e.Name + " " + e.Manager + " " + e.Version + " " + e.Repository.URL
+	}
+	return s
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib-go/gog/definfo"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func init() {
+	_, err := parser.AddCommand("lsp",
+		"serve the Language Server Protocol over stdio",
+		"Serve the Language Server Protocol over stdin and stdout, answering go-to-definition, find-references, hover and workspace symbol requests with the defs, refs and docs that the graph command produces.",
+		&lspCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type LSPCmd struct{}
+
+var lspCmd LSPCmd
+
+func (c *LSPCmd) Execute(args []string) error {
+	s := &lspServer{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	return s.serve()
+}
+
+// lspServer is a Language Server Protocol server that answers requests
+// from the grapher's output for the workspace.
+type lspServer struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// baseConfig is the config that the client sent in the
+	// initializationOptions of its initialize request (if any). The
+	// config of each source unit is applied on top of it.
+	baseConfig srcfileConfig
+
+	// index is the index of the grapher's output for the workspace,
+	// or nil if the workspace has not been graphed since it was last
+	// changed.
+	index *lspIndex
+
+	shutdown bool
+}
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+// lspError is a JSON-RPC error.
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string { return e.Message }
+
+// JSON-RPC error codes.
+const (
+	lspParseError     = -32700
+	lspInvalidParams  = -32602
+	lspMethodNotFound = -32601
+	lspInternalError  = -32603
+)
+
+// serve reads and answers requests until the client sends an exit
+// notification or closes stdin.
+func (s *lspServer) serve() error {
+	for {
+		req, err := s.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit notification received before shutdown request")
+			}
+			return nil
+		}
+
+		result, err := s.handle(req)
+		if req.ID == nil {
+			// Notifications have no response.
+			if err != nil {
+				log.Printf("Error handling %s notification: %s.", req.Method, err)
+			}
+			continue
+		}
+
+		resp := lspResponse{JSONRPC: "2.0", ID: req.ID}
+		if err == nil {
+			resp.Result, err = json.Marshal(result)
+		}
+		if err != nil {
+			lerr, ok := err.(*lspError)
+			if !ok {
+				lerr = &lspError{Code: lspInternalError, Message: err.Error()}
+			}
+			resp.Result, resp.Error = nil, lerr
+		}
+		if err := s.write(&resp); err != nil {
+			return err
+		}
+	}
+}
+
+// read reads a request (or notification) from the client.
+func (s *lspServer) read() (*lspRequest, error) {
+	header, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length header %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	var req lspRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		resp := lspResponse{JSONRPC: "2.0", ID: nil, Error: &lspError{Code: lspParseError, Message: err.Error()}}
+		if err := s.write(&resp); err != nil {
+			return nil, err
+		}
+		return s.read()
+	}
+	return &req, nil
+}
+
+func (s *lspServer) write(resp *lspResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// handle handles a request (or notification) and returns its result.
+func (s *lspServer) handle(req *lspRequest) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			RootURI               string          `json:"rootUri"`
+			RootPath              string          `json:"rootPath"`
+			InitializationOptions json.RawMessage `json:"initializationOptions"`
+		}
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		root := params.RootPath
+		if params.RootURI != "" {
+			var err error
+			if root, err = uriToPath(params.RootURI); err != nil {
+				return nil, err
+			}
+		}
+		if root != "" {
+			if err := os.Chdir(root); err != nil {
+				return nil, err
+			}
+			cwd = getCWD()
+		}
+		if len(params.InitializationOptions) > 0 && string(params.InitializationOptions) != "null" {
+			if err := json.Unmarshal(params.InitializationOptions, &s.baseConfig); err != nil {
+				return nil, &lspError{Code: lspInvalidParams, Message: fmt.Sprintf("initializationOptions: %s", err)}
+			}
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// Requests are answered from the files on disk,
+				// which are graphed again after they are saved.
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    0,
+					"save":      map[string]interface{}{},
+				},
+				"definitionProvider":      true,
+				"referencesProvider":      true,
+				"hoverProvider":           true,
+				"workspaceSymbolProvider": true,
+			},
+		}, nil
+
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didSave", "workspace/didChangeWatchedFiles":
+		s.index = nil
+		return nil, nil
+
+	case "textDocument/definition":
+		var params lspTextDocumentPositionParams
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		idx, ref, err := s.refAt(params)
+		if err != nil || ref == nil {
+			return nil, err
+		}
+		def := idx.defs[lspDefKey(ref.Def)]
+		if def == nil {
+			return nil, nil
+		}
+		loc, err := idx.location(def.File, def.IdentSpan)
+		if err != nil {
+			return nil, err
+		}
+		return []lspLocation{loc}, nil
+
+	case "textDocument/references":
+		var params struct {
+			lspTextDocumentPositionParams
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+		}
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		idx, ref, err := s.refAt(params.lspTextDocumentPositionParams)
+		if err != nil || ref == nil {
+			return nil, err
+		}
+		locs := []lspLocation{}
+		for _, r := range idx.refsByDef[lspDefKey(ref.Def)] {
+			if r.IsDef && !params.Context.IncludeDeclaration {
+				continue
+			}
+			loc, err := idx.location(r.File, r.Span)
+			if err != nil {
+				return nil, err
+			}
+			locs = append(locs, loc)
+		}
+		return locs, nil
+
+	case "textDocument/hover":
+		var params lspTextDocumentPositionParams
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		idx, ref, err := s.refAt(params)
+		if err != nil || ref == nil {
+			return nil, err
+		}
+		def := idx.defs[lspDefKey(ref.Def)]
+		if def == nil {
+			return nil, nil
+		}
+		rng, err := idx.span(ref.File, ref.Span)
+		if err != nil {
+			return nil, err
+		}
+		return &lspHover{
+			Contents: lspMarkupContent{Kind: "markdown", Value: hoverText(def, idx.docs[lspDefKey(def.DefKey)])},
+			Range:    &rng,
+		}, nil
+
+	case "workspace/symbol":
+		var params struct {
+			Query string `json:"query"`
+		}
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		idx, err := s.loadIndex()
+		if err != nil {
+			return nil, err
+		}
+		return idx.symbols(params.Query)
+
+	default:
+		if req.ID == nil || strings.HasPrefix(req.Method, "$/") {
+			// Notifications (and optional requests) that the server
+			// does not handle are ignored.
+			return nil, nil
+		}
+		return nil, &lspError{Code: lspMethodNotFound, Message: fmt.Sprintf("method not found: %s", req.Method)}
+	}
+}
+
+func unmarshalParams(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &lspError{Code: lspInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// refAt returns the ref at the position given by params (or nil if
+// there is none), along with the index it is in.
+func (s *lspServer) refAt(params lspTextDocumentPositionParams) (*lspIndex, *gog.Ref, error) {
+	idx, err := s.loadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return nil, nil, err
+	}
+	file = idx.normalize(file)
+	refs := idx.refsByFile[file]
+	if len(refs) == 0 {
+		return idx, nil, nil
+	}
+	content, err := idx.content(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	off := positionOffset(content, params.Position)
+	if off < 0 {
+		return idx, nil, nil
+	}
+	i := sort.Search(len(refs), func(i int) bool { return int(refs[i].Span[1]) >= off })
+	if i < len(refs) && int(refs[i].Span[0]) <= off {
+		return idx, refs[i], nil
+	}
+	return idx, nil, nil
+}
+
+// loadIndex graphs the workspace (if it has not been graphed since it
+// was last changed) and returns the index of the grapher's output.
+//
+// The source units are found as the scan command finds them, and are
+// graphed as the graph command graphs them, except that only the first
+// build configuration (if there are several) is graphed.
+func (s *lspServer) loadIndex() (*lspIndex, error) {
+	if s.index != nil {
+		return s.index, nil
+	}
+
+	c := s.baseConfig
+	config = &c
+	scanned, err := scanUnits()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(scanned)
+	if err != nil {
+		return nil, err
+	}
+	var units unit.SourceUnits
+	if err := json.Unmarshal(data, &units); err != nil {
+		return nil, err
+	}
+
+	// Units with different configs (such as units in different Go
+	// modules) are graphed separately, as the graph command would be
+	// run separately for them.
+	var groups []unit.SourceUnits
+	groupIndex := make(map[string]int)
+	for _, u := range units {
+		key, err := json.Marshal(u.Config)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := groupIndex[string(key)]
+		if !ok {
+			i = len(groups)
+			groupIndex[string(key)] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], u)
+	}
+
+	idx := &lspIndex{
+		defs:       make(map[string]*gog.Def),
+		refsByFile: make(map[string][]*gog.Ref),
+		refsByDef:  make(map[string][]*gog.Ref),
+		docs:       make(map[string]string),
+		files:      make(map[string][]byte),
+		paths:      make(map[string]string),
+	}
+	for _, group := range groups {
+		c := s.baseConfig
+		config = &c
+		if err := unmarshalTypedConfig(group[0].Config); err != nil {
+			return nil, err
+		}
+		bc := gog.BuildConfig{}
+		if len(config.BuildConfigs) > 0 {
+			bc = config.BuildConfigs[0]
+		}
+		pkgs, err := loadPackages(unitsAsBuildPackages(group), bc)
+		if err != nil {
+			return nil, err
+		}
+		g := gog.New(pkgs)
+		for _, err := range g.GraphPackages(pkgs, config.GraphWorkers) {
+			log.Printf("Ignoring pkg %q due to error in gog.Graph: %s.", err.Pkg.Name, err.Err)
+		}
+		idx.add(&g.Output)
+	}
+	for _, refs := range idx.refsByFile {
+		sort.Sort(refsBySpan(refs))
+	}
+
+	s.index = idx
+	return idx, nil
+}
+
+// lspIndex indexes the grapher's output for the workspace.
+type lspIndex struct {
+	// defs and docs (the plain text docs of defs) are keyed by
+	// lspDefKey.
+	defs map[string]*gog.Def
+	docs map[string]string
+
+	// refsByFile are the refs in each file, sorted by span, and
+	// refsByDef are the refs to each def (keyed by lspDefKey).
+	refsByFile map[string][]*gog.Ref
+	refsByDef  map[string][]*gog.Ref
+
+	// files caches the contents of files.
+	files map[string][]byte
+
+	// paths maps file paths to their normalized forms (see
+	// normalize).
+	paths map[string]string
+}
+
+func (idx *lspIndex) add(o *gog.Output) {
+	for _, d := range o.Defs {
+		d.File = idx.normalize(d.File)
+		idx.defs[lspDefKey(d.DefKey)] = d
+	}
+	for _, r := range o.Refs {
+		r.File = idx.normalize(r.File)
+		idx.refsByFile[r.File] = append(idx.refsByFile[r.File], r)
+		key := lspDefKey(r.Def)
+		idx.refsByDef[key] = append(idx.refsByDef[key], r)
+	}
+	for _, d := range o.Docs {
+		if d.DefKey != nil && d.Format == gog.DocText {
+			idx.docs[lspDefKey(d.DefKey)] = d.Data
+		}
+	}
+}
+
+// normalize returns the absolute path of file with symlinks evaluated,
+// so that the paths of files in the grapher's output and in the URIs
+// sent by the client can be compared.
+func (idx *lspIndex) normalize(file string) string {
+	if p, ok := idx.paths[file]; ok {
+		return p
+	}
+	p := file
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(cwd, p)
+	}
+	p = evalSymlinks(p)
+	idx.paths[file] = p
+	return p
+}
+
+func (idx *lspIndex) content(file string) ([]byte, error) {
+	if content, ok := idx.files[file]; ok {
+		return content, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	idx.files[file] = content
+	return content, nil
+}
+
+// span returns the range of the byte offsets in span in file.
+func (idx *lspIndex) span(file string, span [2]uint32) (lspRange, error) {
+	content, err := idx.content(file)
+	if err != nil {
+		return lspRange{}, err
+	}
+	return lspRange{
+		Start: offsetPosition(content, int(span[0])),
+		End:   offsetPosition(content, int(span[1])),
+	}, nil
+}
+
+func (idx *lspIndex) location(file string, span [2]uint32) (lspLocation, error) {
+	rng, err := idx.span(file, span)
+	if err != nil {
+		return lspLocation{}, err
+	}
+	return lspLocation{URI: pathToURI(file), Range: rng}, nil
+}
+
+// symbols returns the non-local defs whose names contain query
+// (ignoring case), sorted by name and then by location.
+func (idx *lspIndex) symbols(query string) ([]lspSymbolInformation, error) {
+	query = strings.ToLower(query)
+	var defs []*gog.Def
+	for _, d := range idx.defs {
+		if (d.Exported || d.PkgScope) && strings.Contains(strings.ToLower(d.Name), query) {
+			defs = append(defs, d)
+		}
+	}
+	sort.Sort(defsByName(defs))
+
+	symbols := []lspSymbolInformation{}
+	for _, d := range defs {
+		loc, err := idx.location(d.File, d.IdentSpan)
+		if err != nil {
+			return nil, err
+		}
+		container := d.PackageImportPath
+		if d.Receiver != "" {
+			container = d.Receiver
+		} else if d.FieldOfStruct != "" {
+			container = d.FieldOfStruct
+		}
+		symbols = append(symbols, lspSymbolInformation{
+			Name:          d.Name,
+			Kind:          lspSymbolKind(d),
+			Location:      loc,
+			ContainerName: container,
+		})
+	}
+	return symbols, nil
+}
+
+// lspDefKey returns a string that uniquely identifies the def key k.
+func lspDefKey(k *gog.DefKey) string {
+	return k.UnitType + "\x00" + k.PackageImportPath + "\x00" + strings.Join(k.Path, "\x00")
+}
+
+// hoverText returns the Markdown hover text of def: its declaration
+// (see defDecl) followed by its doc.
+func hoverText(def *gog.Def, doc string) string {
+	text := "```go\n" + defDecl(def) + "\n```"
+	if doc = strings.TrimSpace(doc); doc != "" {
+		text += "\n\n" + doc
+	}
+	return text
+}
+
+// defDecl returns the declaration of def, as golang_def formats it.
+func defDecl(def *gog.Def) string {
+	d, err := convertGoDef(def)
+	if err != nil {
+		log.Printf("Error converting def %v to format it: %s.", def.DefKey, err)
+		return def.Name
+	} else if d == nil {
+		return def.Name
+	}
+	return fmtDecl(d.Fmt())
+}
+
+// lspSymbolKind returns the LSP SymbolKind of def.
+func lspSymbolKind(def *gog.Def) int {
+	switch def.Kind {
+	case definfo.File:
+		return 1 // File
+	case definfo.Package:
+		return 4 // Package
+	case definfo.Field:
+		return 8 // Field
+	case definfo.Func:
+		return 12 // Function
+	case definfo.Method:
+		return 6 // Method
+	case definfo.Var:
+		return 13 // Variable
+	case definfo.Const:
+		return 14 // Constant
+	case definfo.Interface:
+		return 11 // Interface
+	case definfo.Type:
+		if strings.HasPrefix(def.UnderlyingTypeString, "struct") {
+			return 23 // Struct
+		}
+		return 5 // Class
+	}
+	return 13 // Variable
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspMarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type lspHover struct {
+	Contents lspMarkupContent `json:"contents"`
+	Range    *lspRange        `json:"range,omitempty"`
+}
+
+type lspSymbolInformation struct {
+	Name          string      `json:"name"`
+	Kind          int         `json:"kind"`
+	Location      lspLocation `json:"location"`
+	ContainerName string      `json:"containerName,omitempty"`
+}
+
+// offsetPosition returns the LSP position of the byte offset off in
+// content. LSP positions count characters in UTF-16 code units.
+func offsetPosition(content []byte, off int) lspPosition {
+	if off > len(content) {
+		off = len(content)
+	}
+	var pos lspPosition
+	for i := 0; i < off; {
+		r, size := utf8.DecodeRune(content[i:])
+		if r == '\n' {
+			pos.Line++
+			pos.Character = 0
+		} else if r >= 0x10000 {
+			pos.Character += 2
+		} else {
+			pos.Character++
+		}
+		i += size
+	}
+	return pos
+}
+
+// positionOffset returns the byte offset of the LSP position pos in
+// content, or -1 if pos is not in content.
+func positionOffset(content []byte, pos lspPosition) int {
+	var line, char int
+	for i := 0; i < len(content); {
+		if line == pos.Line && char >= pos.Character {
+			return i
+		}
+		r, size := utf8.DecodeRune(content[i:])
+		if r == '\n' {
+			if line == pos.Line {
+				// The position is past the end of the line.
+				return i
+			}
+			line++
+			char = 0
+		} else if r >= 0x10000 {
+			char += 2
+		} else {
+			char++
+		}
+		i += size
+	}
+	if line == pos.Line {
+		return len(content)
+	}
+	return -1
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", &lspError{Code: lspInvalidParams, Message: fmt.Sprintf("unsupported URI %q (only file URIs are supported)", uri)}
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+type refsBySpan []*gog.Ref
+
+func (r refsBySpan) Len() int      { return len(r) }
+func (r refsBySpan) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r refsBySpan) Less(i, j int) bool {
+	if r[i].Span[0] != r[j].Span[0] {
+		return r[i].Span[0] < r[j].Span[0]
+	}
+	return r[i].Span[1] < r[j].Span[1]
+}
+
+type defsByName []*gog.Def
+
+func (d defsByName) Len() int      { return len(d) }
+func (d defsByName) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d defsByName) Less(i, j int) bool {
+	if d[i].Name != d[j].Name {
+		return d[i].Name < d[j].Name
+	}
+	if d[i].File != d[j].File {
+		return d[i].File < d[j].File
+	}
+	return d[i].IdentSpan[0] < d[j].IdentSpan[0]
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+)
+
+func TestOffsetPosition(t *testing.T) {
+	// "é" is 2 bytes and 1 UTF-16 code unit, and "𝄞" is 4 bytes and
+	// 2 UTF-16 code units (a surrogate pair).
+	content := []byte("aé𝄞b\nx")
+	tests := []struct {
+		off int
+		pos lspPosition
+	}{
+		{0, lspPosition{0, 0}},
+		{1, lspPosition{0, 1}},
+		{3, lspPosition{0, 2}},
+		{7, lspPosition{0, 4}},
+		{8, lspPosition{0, 5}},
+		{9, lspPosition{1, 0}},
+		{10, lspPosition{1, 1}},
+	}
+	for _, test := range tests {
+		if pos := offsetPosition(content, test.off); pos != test.pos {
+			t.Errorf("offset %d: got position %v, want %v", test.off, pos, test.pos)
+		}
+		if off := positionOffset(content, test.pos); off != test.off {
+			t.Errorf("position %v: got offset %d, want %d", test.pos, off, test.off)
+		}
+	}
+
+	// Offsets past the end are clamped.
+	if pos := offsetPosition(content, 100); pos != (lspPosition{1, 1}) {
+		t.Errorf("offset past the end: got position %v", pos)
+	}
+
+	positions := []struct {
+		pos lspPosition
+		off int
+	}{
+		// A position in the middle of a surrogate pair is taken to be
+		// after it.
+		{lspPosition{0, 3}, 7},
+		// Positions past the end of a line are at the end of the line.
+		{lspPosition{0, 10}, 8},
+		{lspPosition{1, 10}, 10},
+		{lspPosition{2, 0}, -1},
+	}
+	for _, test := range positions {
+		if off := positionOffset(content, test.pos); off != test.off {
+			t.Errorf("position %v: got offset %d, want %d", test.pos, off, test.off)
+		}
+	}
+}
+
+func TestRefAt(t *testing.T) {
+	dir := evalSymlinks(t.TempDir())
+	file := filepath.Join(dir, "p.go")
+	writeTestFiles(t, dir, map[string]string{"p.go": "x := a.bc\n"})
+
+	a := &gog.Ref{File: file, Span: [2]uint32{5, 6}}
+	bc := &gog.Ref{File: file, Span: [2]uint32{7, 9}}
+	idx := &lspIndex{
+		refsByFile: map[string][]*gog.Ref{file: {a, bc}},
+		files:      make(map[string][]byte),
+		paths:      make(map[string]string),
+	}
+	s := &lspServer{index: idx}
+
+	tests := []struct {
+		pos  lspPosition
+		want *gog.Ref
+	}{
+		{lspPosition{0, 4}, nil},
+		// Refs include the positions at their start and end.
+		{lspPosition{0, 5}, a},
+		{lspPosition{0, 6}, a},
+		{lspPosition{0, 7}, bc},
+		{lspPosition{0, 8}, bc},
+		{lspPosition{0, 9}, bc},
+		{lspPosition{1, 0}, nil},
+		{lspPosition{2, 0}, nil},
+	}
+	for _, test := range tests {
+		var params lspTextDocumentPositionParams
+		params.TextDocument.URI = pathToURI(file)
+		params.Position = test.pos
+		_, ref, err := s.refAt(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref != test.want {
+			t.Errorf("position %v: got ref %v, want %v", test.pos, ref, test.want)
+		}
+	}
+
+	// Files without refs have no refs at any position.
+	var params lspTextDocumentPositionParams
+	params.TextDocument.URI = pathToURI(filepath.Join(dir, "q.go"))
+	if _, ref, err := s.refAt(params); ref != nil || err != nil {
+		t.Errorf("file without refs: got ref %v, error %v", ref, err)
+	}
+}
+
+func TestLSPServer(t *testing.T) {
+	scanTestRepo(t, srcfileConfig{}, map[string]string{
+		"go.mod": "module example.com/p\n\ngo 1.21\n",
+		"p.go":   "package p\n\n// F returns one.\nfunc F() int { return 1 }\n\nfunc G() int { _ = \"𝄞\"; return F() + F() }\n",
+	})
+	uri := pathToURI(filepath.Join(cwd, "p.go"))
+	// The first call of F is at character 32 of line 5 (after the
+	// surrogate pair).
+	position := map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     lspPosition{Line: 5, Character: 32},
+	}
+	references := map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     lspPosition{Line: 5, Character: 32},
+		"context":      map[string]bool{"includeDeclaration": false},
+	}
+
+	var in bytes.Buffer
+	for i, req := range []struct {
+		method string
+		params interface{}
+	}{
+		{"initialize", map[string]string{"rootUri": pathToURI(cwd)}},
+		{"initialized", nil},
+		{"textDocument/definition", position},
+		{"textDocument/references", references},
+		{"textDocument/hover", position},
+		{"shutdown", nil},
+		{"exit", nil},
+	} {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": req.method, "params": req.params}
+		if req.method != "initialized" && req.method != "exit" {
+			msg["id"] = i
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+
+	var out bytes.Buffer
+	s := &lspServer{in: bufio.NewReader(&in), out: &out}
+	if err := s.serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	resps := readLSPResponses(t, &out)
+	if len(resps) != 5 {
+		t.Fatalf("got %d responses, want 5", len(resps))
+	}
+	for i, id := range []string{"0", "2", "3", "4", "5"} {
+		if resps[i].ID == nil || string(*resps[i].ID) != id {
+			t.Errorf("response %d: got ID %v, want %s", i, resps[i].ID, id)
+		}
+		if resps[i].Error != nil {
+			t.Errorf("response %d: got error %v", i, resps[i].Error)
+		}
+	}
+
+	var init struct {
+		Capabilities map[string]interface{} `json:"capabilities"`
+	}
+	unmarshalResult(t, resps[0], &init)
+	for _, c := range []string{"definitionProvider", "referencesProvider", "hoverProvider"} {
+		if init.Capabilities[c] != true {
+			t.Errorf("got capability %s = %v, want true", c, init.Capabilities[c])
+		}
+	}
+
+	var defs []lspLocation
+	unmarshalResult(t, resps[1], &defs)
+	wantDefs := []lspLocation{{URI: uri, Range: lspRange{Start: lspPosition{3, 5}, End: lspPosition{3, 6}}}}
+	if !reflect.DeepEqual(defs, wantDefs) {
+		t.Errorf("got definition %+v, want %+v", defs, wantDefs)
+	}
+
+	var refs []lspLocation
+	unmarshalResult(t, resps[2], &refs)
+	wantRefs := []lspLocation{
+		{URI: uri, Range: lspRange{Start: lspPosition{5, 32}, End: lspPosition{5, 33}}},
+		{URI: uri, Range: lspRange{Start: lspPosition{5, 38}, End: lspPosition{5, 39}}},
+	}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("got references %+v, want %+v", refs, wantRefs)
+	}
+
+	var hover lspHover
+	unmarshalResult(t, resps[3], &hover)
+	wantHover := lspHover{
+		Contents: lspMarkupContent{Kind: "markdown", Value: "```go\nfunc F() int\n```\n\nF returns one."},
+		Range:    &lspRange{Start: lspPosition{5, 32}, End: lspPosition{5, 33}},
+	}
+	if !reflect.DeepEqual(hover, wantHover) {
+		t.Errorf("got hover %+v, want %+v", hover, wantHover)
+	}
+}
+
+// readLSPResponses reads the framed responses that an lspServer wrote
+// to r.
+func readLSPResponses(t *testing.T, r io.Reader) []*lspResponse {
+	br := bufio.NewReader(r)
+	var resps []*lspResponse
+	for {
+		header, err := textproto.NewReader(br).ReadMIMEHeader()
+		if err == io.EOF {
+			return resps
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(br, body); err != nil {
+			t.Fatal(err)
+		}
+		var resp lspResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		resps = append(resps, &resp)
+	}
+}
+
+func unmarshalResult(t *testing.T, resp *lspResponse, v interface{}) {
+	if err := json.Unmarshal(resp.Result, v); err != nil {
+		t.Fatalf("response %s: %s", *resp.ID, err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib/dep"
+)
+
+func init() {
+	_, err := parser.AddCommand("invalidate-resolve-cache",
+		"invalidate cached dep resolutions",
+		"Remove entries from the on-disk cache of resolved import paths (see the ResolveCacheDir config property). If import paths are given, only entries for those import paths (and the import paths underneath them) are removed.",
+		&invalidateResolveCacheCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// defaultResolveCacheTTL is how long entries in the on-disk resolve
+// cache are used if the ResolveCacheTTL config property is not set.
+const defaultResolveCacheTTL = 7 * 24 * time.Hour
+
+// defaultResolveCacheNegativeTTL is how long the entries of import
+// paths that could not be resolved are used if the
+// ResolveCacheNegativeTTL config property is not set.
+const defaultResolveCacheNegativeTTL = time.Hour
+
+// diskTargetCache is a persistent cache of the repositories (and
+// versions) that import paths resolve to. It stores one JSON file per
+// entry, named after a hash of the import path, its version and the
+// configuration of the resolvers that resolved it.
+type diskTargetCache struct {
+	dir string
+	ttl time.Duration
+
+	// negativeTTL is how long the entries of import paths that could
+	// not be resolved are used.
+	negativeTTL time.Duration
+
+	// configKey identifies the resolver configuration. Entries
+	// resolved with a different configuration are not used.
+	configKey string
+}
+
+// diskTargetCacheEntry is the contents of a file in a diskTargetCache.
+// The Target of an import path that could not be resolved is nil.
+type diskTargetCacheEntry struct {
+	ImportPath string
+	Version    string `json:",omitempty"`
+	Target     *dep.ResolvedTarget
+	Resolved   time.Time
+}
+
+func (e *diskTargetCacheEntry) expired(ttl time.Duration) bool {
+	return time.Since(e.Resolved) > ttl
+}
+
+var (
+	resolveDiskCacheOnce sync.Once
+	resolveDiskCacheVal  *diskTargetCache
+)
+
+// resolveDiskCache returns the on-disk resolve cache configured by the
+// Srcfile config, or nil if there is none.
+func resolveDiskCache() *diskTargetCache {
+	resolveDiskCacheOnce.Do(func() {
+		if config.ResolveCacheDir == "" {
+			return
+		}
+		ttl := parseTTL("ResolveCacheTTL", config.ResolveCacheTTL, defaultResolveCacheTTL)
+		negativeTTL := parseTTL("ResolveCacheNegativeTTL", config.ResolveCacheNegativeTTL, defaultResolveCacheNegativeTTL)
+		resolverConfig, err := json.Marshal(struct {
+			ImportPathRules []importPathRule
+			GoImportMetaDir string
+			ModuleProxyDir  string
+			NetworkResolve  bool
+		}{config.ImportPathRules, config.GoImportMetaDir, config.ModuleProxyDir, config.NetworkResolve})
+		if err != nil {
+			log.Printf("warning: not using resolve cache: %s", err)
+			return
+		}
+		resolveDiskCacheVal = &diskTargetCache{
+			dir:         config.ResolveCacheDir,
+			ttl:         ttl,
+			negativeTTL: negativeTTL,
+			configKey:   hashStrings(string(resolverConfig)),
+		}
+	})
+	return resolveDiskCacheVal
+}
+
+// parseTTL parses the duration s of the config property prop, or
+// returns def if s is empty or invalid.
+func parseTTL(prop, s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("warning: ignoring invalid %s %q: %s", prop, s, err)
+		return def
+	}
+	return ttl
+}
+
+func hashStrings(s ...string) string {
+	h := sha256.New()
+	for _, s := range s {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *diskTargetCache) file(importPath, version string) string {
+	key := hashStrings(importPath, version, c.configKey)
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// get fills in target's repository and version fields from the cache
+// entry for importPath at target's version. It returns found=false if
+// there is no unexpired entry, and ok=false if the entry records that
+// importPath could not be resolved. It is a no-op on a nil cache.
+func (c *diskTargetCache) get(importPath string, target *dep.ResolvedTarget) (found, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	data, err := ioutil.ReadFile(c.file(importPath, target.ToVersionString))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: reading resolve cache entry for %q: %s", importPath, err)
+		}
+		return false, false
+	}
+	var e diskTargetCacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		log.Printf("warning: ignoring invalid resolve cache entry for %q: %s", importPath, err)
+		return false, false
+	}
+	if e.Target == nil {
+		return !e.expired(c.negativeTTL), false
+	}
+	if e.expired(c.ttl) {
+		return false, false
+	}
+	target.ToRepoCloneURL = e.Target.ToRepoCloneURL
+	target.ToVersionString = e.Target.ToVersionString
+	target.ToRevSpec = e.Target.ToRevSpec
+	return true, true
+}
+
+// put saves target as the resolution of importPath at version, or, if
+// target is nil, that importPath could not be resolved. It is a no-op
+// on a nil cache.
+func (c *diskTargetCache) put(importPath, version string, target *dep.ResolvedTarget) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(diskTargetCacheEntry{
+		ImportPath: importPath,
+		Version:    version,
+		Target:     target,
+		Resolved:   time.Now(),
+	})
+	if err != nil {
+		log.Printf("warning: not caching resolution of %q: %s", importPath, err)
+		return
+	}
+	if err := writeFileAtomic(c.file(importPath, version), data); err != nil {
+		log.Printf("warning: not caching resolution of %q: %s", importPath, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to
+// filename, so that concurrent readers never see a partial file.
+func writeFileAtomic(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-"+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+type InvalidateResolveCacheCmd struct {
+	Dir     string `long:"dir" description:"resolve cache dir (the ResolveCacheDir config property)" required:"yes"`
+	Expired bool   `long:"expired" description:"only remove entries that are older than --ttl"`
+	TTL     string `long:"ttl" description:"max age of entries when --expired is set" default:"168h"`
+}
+
+var invalidateResolveCacheCmd InvalidateResolveCacheCmd
+
+func (c *InvalidateResolveCacheCmd) Execute(args []string) error {
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	err = filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == c.Dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		var e diskTargetCacheEntry
+		if data, err := ioutil.ReadFile(path); err != nil {
+			return err
+		} else if err := json.Unmarshal(data, &e); err != nil {
+			// Remove corrupt entries regardless of the other options.
+			log.Printf("Removing invalid resolve cache entry %s: %s.", path, err)
+			removed++
+			return os.Remove(path)
+		}
+
+		if c.Expired && !e.expired(ttl) {
+			return nil
+		}
+		if len(args) > 0 {
+			var match bool
+			for _, importPath := range args {
+				if gog.ImportPathInModule(e.ImportPath, strings.TrimSuffix(importPath, "/")) {
+					match = true
+					break
+				}
+			}
+			if !match {
+				return nil
+			}
+		}
+		removed++
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d resolve cache entries.", removed)
+	return nil
+}
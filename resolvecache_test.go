@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/dep"
+)
+
+func TestDiskTargetCache(t *testing.T) {
+	c := &diskTargetCache{dir: t.TempDir(), ttl: time.Hour, negativeTTL: time.Minute, configKey: "k"}
+	target := &dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a", ToVersionString: "v1.0.0", ToRevSpec: "abc"}
+	c.put("example.com/a", "v1.0.0", target)
+
+	// A hit fills in the repository and version fields, but not the
+	// others.
+	got := dep.ResolvedTarget{ToUnit: "example.com/a", ToUnitType: "GoPackage", ToVersionString: "v1.0.0"}
+	if found, ok := c.get("example.com/a", &got); !found || !ok {
+		t.Fatalf("got found=%v ok=%v, want a cache hit", found, ok)
+	}
+	want := dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a", ToUnit: "example.com/a", ToUnitType: "GoPackage", ToVersionString: "v1.0.0", ToRevSpec: "abc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Entries are keyed by import path, version and resolver config.
+	misses := []struct {
+		name       string
+		cache      *diskTargetCache
+		importPath string
+		version    string
+	}{
+		{"other import path", c, "example.com/b", "v1.0.0"},
+		{"other version", c, "example.com/a", "v1.1.0"},
+		{"no version", c, "example.com/a", ""},
+		{"other resolver config", &diskTargetCache{dir: c.dir, ttl: c.ttl, negativeTTL: c.negativeTTL, configKey: "other"}, "example.com/a", "v1.0.0"},
+		{"nil cache", nil, "example.com/a", "v1.0.0"},
+	}
+	for _, m := range misses {
+		if found, _ := m.cache.get(m.importPath, &dep.ResolvedTarget{ToVersionString: m.version}); found {
+			t.Errorf("%s: got a cache hit, want a miss", m.name)
+		}
+	}
+
+	// Expired entries are not used.
+	writeCacheEntry(t, c, diskTargetCacheEntry{ImportPath: "example.com/old", Target: target, Resolved: time.Now().Add(-2 * time.Hour)})
+	if found, _ := c.get("example.com/old", &dep.ResolvedTarget{}); found {
+		t.Error("got a cache hit for an expired entry")
+	}
+	longTTL := &diskTargetCache{dir: c.dir, ttl: 3 * time.Hour, negativeTTL: c.negativeTTL, configKey: c.configKey}
+	if found, ok := longTTL.get("example.com/old", &dep.ResolvedTarget{}); !found || !ok {
+		t.Error("got no cache hit for an entry within the TTL")
+	}
+
+	// Import paths that could not be resolved are cached for
+	// negativeTTL.
+	c.put("example.com/none", "", nil)
+	if found, ok := c.get("example.com/none", &dep.ResolvedTarget{}); !found || ok {
+		t.Errorf("got found=%v ok=%v for an unresolved import path, want found=true ok=false", found, ok)
+	}
+	writeCacheEntry(t, c, diskTargetCacheEntry{ImportPath: "example.com/none-old", Resolved: time.Now().Add(-2 * time.Minute)})
+	if found, _ := c.get("example.com/none-old", &dep.ResolvedTarget{}); found {
+		t.Error("got a cache hit for an unresolved import path older than the negative TTL")
+	}
+	if found, ok := longTTL.get("example.com/none-old", &dep.ResolvedTarget{}); found || ok {
+		t.Error("got a cache hit for an unresolved import path within the TTL but not the negative TTL")
+	}
+
+	// So are invalid ones.
+	if err := writeFileAtomic(c.file("example.com/bad", ""), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := c.get("example.com/bad", &dep.ResolvedTarget{}); found {
+		t.Error("got a cache hit for an invalid entry")
+	}
+}
+
+// countingResolver resolves the import paths in urls to their clone
+// URLs, and counts how many times it is called.
+type countingResolver struct {
+	urls  map[string]string
+	calls int
+}
+
+func (r *countingResolver) resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error) {
+	r.calls++
+	url, ok := r.urls[importPath]
+	if ok {
+		target.ToRepoCloneURL = url
+	}
+	return ok, nil
+}
+
+func TestResolveRepoCache(t *testing.T) {
+	r := &countingResolver{urls: map[string]string{"example.com/a": "https://git.example.com/a"}}
+	c := &diskTargetCache{dir: t.TempDir(), ttl: time.Hour, negativeTTL: time.Hour, configKey: "k"}
+
+	oldConfig := config
+	defer func() {
+		config = oldConfig
+		repoResolversOnce, repoResolversList = sync.Once{}, nil
+		resolveDiskCacheOnce, resolveDiskCacheVal = sync.Once{}, nil
+	}()
+	config = &srcfileConfig{}
+	repoResolversOnce, repoResolversList = sync.Once{}, []repoResolver{r}
+	repoResolversOnce.Do(func() {})
+	resolveDiskCacheOnce, resolveDiskCacheVal = sync.Once{}, c
+	resolveDiskCacheOnce.Do(func() {})
+
+	tests := []struct {
+		importPath string
+		wantOK     bool
+		wantCalls  int
+	}{
+		{"example.com/a", true, 1},
+		{"example.com/a", true, 1},
+
+		// Failures are cached too, so the resolvers are not tried
+		// again.
+		{"example.com/none", false, 2},
+		{"example.com/none", false, 2},
+	}
+	for _, test := range tests {
+		var target dep.ResolvedTarget
+		ok, err := resolveRepo(test.importPath, &target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.wantOK || r.calls != test.wantCalls {
+			t.Errorf("%s: got ok=%v after %d resolver calls, want ok=%v after %d", test.importPath, ok, r.calls, test.wantOK, test.wantCalls)
+		}
+	}
+
+	// Once the negative TTL has passed, the import path is resolved
+	// again.
+	c.negativeTTL = 0
+	if ok, err := resolveRepo("example.com/none", &dep.ResolvedTarget{}); ok || err != nil || r.calls != 3 {
+		t.Errorf("got ok=%v err=%v after %d resolver calls, want ok=false after 3", ok, err, r.calls)
+	}
+}
+
+func TestInvalidateResolveCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      InvalidateResolveCacheCmd
+		args     []string
+		wantLeft []string
+	}{
+		{"all", InvalidateResolveCacheCmd{TTL: "168h"}, nil, nil},
+		{"import paths", InvalidateResolveCacheCmd{TTL: "168h"}, []string{"example.com/a/", "example.com/c"}, []string{"example.com/ab", "example.com/old"}},
+		{"expired", InvalidateResolveCacheCmd{Expired: true, TTL: "1h"}, nil, []string{"example.com/a", "example.com/a/sub", "example.com/ab"}},
+		{"expired import paths", InvalidateResolveCacheCmd{Expired: true, TTL: "1h"}, []string{"example.com/a"}, []string{"example.com/a", "example.com/a/sub", "example.com/ab", "example.com/old"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &diskTargetCache{dir: t.TempDir(), ttl: time.Hour, configKey: "k"}
+			target := &dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a"}
+			for _, importPath := range []string{"example.com/a", "example.com/a/sub", "example.com/ab"} {
+				c.put(importPath, "", target)
+			}
+			writeCacheEntry(t, c, diskTargetCacheEntry{ImportPath: "example.com/old", Target: target, Resolved: time.Now().Add(-2 * time.Hour)})
+			// Invalid entries are always removed.
+			if err := writeFileAtomic(c.file("example.com/bad", ""), []byte("{")); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := test.cmd
+			cmd.Dir = c.dir
+			if err := cmd.Execute(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if left := cacheEntries(t, c.dir); !reflect.DeepEqual(left, test.wantLeft) {
+				t.Errorf("got entries %v left, want %v", left, test.wantLeft)
+			}
+		})
+	}
+
+	// A cache dir that doesn't exist yet is empty.
+	cmd := InvalidateResolveCacheCmd{Dir: filepath.Join(t.TempDir(), "none"), TTL: "168h"}
+	if err := cmd.Execute(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func writeCacheEntry(t *testing.T, c *diskTargetCache, e diskTargetCacheEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(c.file(e.ImportPath, e.Version), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cacheEntries returns the sorted import paths of the entries in the
+// resolve cache dir.
+func cacheEntries(t *testing.T, dir string) []string {
+	var importPaths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var e diskTargetCacheEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			importPaths = append(importPaths, "invalid: "+path)
+			return nil
+		}
+		importPaths = append(importPaths, e.ImportPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(importPaths)
+	return importPaths
+}
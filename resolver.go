@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/golang/gddo/gosrc"
+
+	"sourcegraph.com/sourcegraph/srclib-go/gog"
+	"sourcegraph.com/sourcegraph/srclib/dep"
+)
+
+// repoResolver resolves an import path to the repository that contains
+// it. It is used for import paths that are not on a well-known
+// repository host (see ResolveDep).
+type repoResolver interface {
+	// resolveRepo sets target.ToRepoCloneURL (and the version fields,
+	// if it knows better than target does) for importPath. It returns
+	// false if it can't resolve importPath.
+	resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error)
+}
+
+var (
+	repoResolversOnce sync.Once
+	repoResolversList []repoResolver
+)
+
+// repoResolvers returns the chain of resolvers configured by the
+// Srcfile config, in the order they should be tried.
+func repoResolvers() []repoResolver {
+	repoResolversOnce.Do(func() {
+		var rs []repoResolver
+		if len(config.ImportPathRules) > 0 {
+			rs = append(rs, importPathRules(config.ImportPathRules))
+		}
+		if config.GoImportMetaDir != "" {
+			rs = append(rs, goImportMetaDir(config.GoImportMetaDir))
+		}
+		if config.ModuleProxyDir != "" {
+			rs = append(rs, moduleProxyDir(config.ModuleProxyDir))
+		}
+		if config.NetworkResolve {
+			rs = append(rs, networkResolver{})
+		}
+		repoResolversList = rs
+	})
+	return repoResolversList
+}
+
+// resolveRepo tries each configured resolver in turn. Resolutions,
+// and import paths that no resolver can resolve, are saved in the
+// on-disk resolve cache, if configured.
+func resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error) {
+	cache := resolveDiskCache()
+	if found, ok := cache.get(importPath, target); found {
+		return ok, nil
+	}
+
+	version := target.ToVersionString
+	for _, r := range repoResolvers() {
+		ok, err := r.resolveRepo(importPath, target)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			cache.put(importPath, version, target)
+			return true, nil
+		}
+	}
+	cache.put(importPath, version, nil)
+	return false, nil
+}
+
+// importPathRule maps import paths under Prefix to the clone URL
+// given by the CloneURL template.
+type importPathRule struct {
+	// Prefix is an import path prefix, like "go.example.com/tools". It
+	// only matches whole path elements.
+	Prefix string
+
+	// CloneURL is a clone URL template. "{1}", "{2}", etc., are
+	// replaced by the 1st, 2nd, etc., path elements after Prefix. For
+	// example, "https://git.example.com/{1}.git" maps the import path
+	// "go.example.com/tools/foo/bar" to the clone URL
+	// "https://git.example.com/foo.git" when Prefix is
+	// "go.example.com/tools".
+	CloneURL string
+}
+
+var cloneURLTemplateVar = regexp.MustCompile(`\{([1-9][0-9]*)\}`)
+
+// cloneURL returns the clone URL for importPath, or false if the rule
+// does not match importPath.
+func (r importPathRule) cloneURL(importPath string) (string, bool) {
+	prefix := strings.TrimSuffix(r.Prefix, "/")
+	if !gog.ImportPathInModule(importPath, prefix) {
+		return "", false
+	}
+	var elems []string
+	if rest := strings.TrimPrefix(strings.TrimPrefix(importPath, prefix), "/"); rest != "" {
+		elems = strings.Split(rest, "/")
+	}
+	ok := true
+	cloneURL := cloneURLTemplateVar.ReplaceAllStringFunc(r.CloneURL, func(v string) string {
+		i, _ := strconv.Atoi(v[1 : len(v)-1])
+		if i > len(elems) {
+			ok = false
+			return ""
+		}
+		return elems[i-1]
+	})
+	return cloneURL, ok
+}
+
+// importPathRules resolves import paths using static rules from the
+// Srcfile config. When more than one rule matches, the one with the
+// longest prefix wins.
+type importPathRules []importPathRule
+
+func (rules importPathRules) resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error) {
+	var best string
+	bestPrefixLen := -1
+	for _, r := range rules {
+		if cloneURL, ok := r.cloneURL(importPath); ok && len(r.Prefix) > bestPrefixLen {
+			best, bestPrefixLen = cloneURL, len(r.Prefix)
+		}
+	}
+	if bestPrefixLen == -1 {
+		return false, nil
+	}
+	target.ToRepoCloneURL = best
+	return true, nil
+}
+
+// goImportMetaDir resolves import paths using cached HTML pages (as
+// served at https://IMPORTPATH?go-get=1) that contain <meta
+// name="go-import"> tags. The page for the import path "a/b/c" is
+// looked up at "a/b/c.html" or "a/b/c/index.html" in the directory,
+// and then at the same locations for "a/b" and "a".
+type goImportMetaDir string
+
+func (dir goImportMetaDir) resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error) {
+	for p := importPath; p != "." && p != "/"; p = filepath.ToSlash(filepath.Dir(p)) {
+		for _, name := range []string{p + ".html", p + "/index.html"} {
+			f, err := os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			imports, err := parseMetaGoImports(f)
+			f.Close()
+			if err != nil {
+				log.Printf("warning: unable to parse go-import meta tags in %s: %s", f.Name(), err)
+				continue
+			}
+			for _, imp := range imports {
+				if imp.VCS != "mod" && gog.ImportPathInModule(importPath, imp.Prefix) {
+					target.ToRepoCloneURL = imp.RepoRoot
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// metaImport is the content of a <meta name="go-import"> tag.
+type metaImport struct {
+	Prefix, VCS, RepoRoot string
+}
+
+// parseMetaGoImports returns the go-import meta tags in the <head> of
+// an HTML document. It is adapted from the go command's
+// cmd/go/internal/get/discovery.go.
+func parseMetaGoImports(r io.Reader) (imports []metaImport, err error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "utf-8", "ascii":
+			return input, nil
+		}
+		return nil, fmt.Errorf("can't decode XML document using charset %q", charset)
+	}
+	d.Strict = false
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(imports) > 0 {
+				err = nil
+			}
+			return imports, err
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			return imports, nil
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			return imports, nil
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") {
+			continue
+		}
+		if metaAttr(e, "name") != "go-import" {
+			continue
+		}
+		if f := strings.FieldsFunc(metaAttr(e, "content"), unicode.IsSpace); len(f) == 3 {
+			imports = append(imports, metaImport{Prefix: f[0], VCS: f[1], RepoRoot: f[2]})
+		}
+	}
+}
+
+func metaAttr(s xml.StartElement, name string) string {
+	for _, a := range s.Attr {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// moduleProxyDir resolves import paths using a local module cache laid
+// out like a GOPROXY (such as $GOPATH/pkg/mod/cache/download). The
+// repository is taken from the "Origin" recorded in the .info file of
+// the module version, which the go command writes when it downloads a
+// module directly from its repository.
+type moduleProxyDir string
+
+// moduleInfo is the contents of a module proxy .info file.
+type moduleInfo struct {
+	Version string
+	Origin  *struct {
+		VCS  string
+		URL  string
+		Hash string
+	}
+}
+
+func (dir moduleProxyDir) resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error) {
+	for modPath := importPath; modPath != "." && modPath != "/"; modPath = filepath.ToSlash(filepath.Dir(modPath)) {
+		vdir := filepath.Join(string(dir), filepath.FromSlash(escapeModulePath(modPath)), "@v")
+		var infoFile string
+		if target.ToVersionString != "" {
+			infoFile = filepath.Join(vdir, target.ToVersionString+".info")
+		}
+		if _, err := os.Stat(infoFile); infoFile == "" || os.IsNotExist(err) {
+			// Any version will do to find the repository.
+			infoFile = latestModuleInfoFile(vdir)
+		}
+		if infoFile == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(infoFile)
+		if err != nil {
+			return false, err
+		}
+		var info moduleInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			log.Printf("warning: unable to parse module info %s: %s", infoFile, err)
+			continue
+		}
+		if info.Origin == nil || info.Origin.URL == "" {
+			// Downloaded from a proxy, which doesn't say where the
+			// module came from.
+			continue
+		}
+		target.ToRepoCloneURL = info.Origin.URL
+		if target.ToVersionString == "" {
+			target.ToVersionString = info.Version
+		}
+		if info.Version == target.ToVersionString && info.Origin.Hash != "" {
+			target.ToRevSpec = info.Origin.Hash
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// latestModuleInfoFile returns the .info file of the highest version in
+// the module proxy version dir vdir, or "" if there is none.
+func latestModuleInfoFile(vdir string) string {
+	infos, err := ioutil.ReadDir(vdir)
+	if err != nil {
+		return ""
+	}
+	var latest string
+	for _, fi := range infos {
+		if v := strings.TrimSuffix(fi.Name(), ".info"); v != fi.Name() && (latest == "" || gog.CompareModuleVersions(v, latest) > 0) {
+			latest = v
+		}
+	}
+	if latest == "" {
+		return ""
+	}
+	return filepath.Join(vdir, latest+".info")
+}
+
+// escapeModulePath escapes upper-case letters in a module path the
+// way module proxies do ("!" followed by the lower-case letter).
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// networkResolver resolves import paths by fetching information about
+// them over the network (using the same logic as godoc.org).
+type networkResolver struct{}
+
+func (networkResolver) resolveRepo(importPath string, target *dep.ResolvedTarget) (bool, error) {
+	log.Printf("Resolving Go dep: %s", importPath)
+	dir, err := gosrc.Get(http.DefaultClient, string(importPath), "")
+	if err != nil {
+		log.Printf("warning: unable to fetch information about Go package %q: %s", importPath, err)
+		return false, nil
+	}
+	if strings.HasPrefix(dir.ResolvedPath, "github.com/") {
+		cloneURL, err := standardRepoHostImportPathToCloneURL(dir.ResolvedPath)
+		if err != nil {
+			return false, err
+		}
+		target.ToRepoCloneURL = cloneURL
+	} else {
+		target.ToRepoCloneURL = strings.TrimSuffix(dir.ProjectURL, "/")
+	}
+	return true, nil
+}
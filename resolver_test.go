@@ -0,0 +1,291 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/dep"
+)
+
+func TestImportPathRuleCloneURL(t *testing.T) {
+	tests := []struct {
+		rule       importPathRule
+		importPath string
+		want       string
+		wantOK     bool
+	}{
+		{importPathRule{"go.example.com/tools", "https://git.example.com/{1}.git"}, "go.example.com/tools/foo/bar", "https://git.example.com/foo.git", true},
+		{importPathRule{"go.example.com/tools/", "https://git.example.com/{1}.git"}, "go.example.com/tools/foo", "https://git.example.com/foo.git", true},
+		{importPathRule{"go.example.com", "https://git.example.com/{1}/{2}"}, "go.example.com/a/b/c", "https://git.example.com/a/b", true},
+		{importPathRule{"go.example.com/tools", "https://git.example.com/tools.git"}, "go.example.com/tools", "https://git.example.com/tools.git", true},
+
+		// Too few path elements for the template.
+		{importPathRule{"go.example.com", "https://git.example.com/{1}/{2}"}, "go.example.com/a", "", false},
+		{importPathRule{"go.example.com/tools", "https://git.example.com/{1}.git"}, "go.example.com/tools", "", false},
+
+		// Prefixes only match whole path elements.
+		{importPathRule{"go.example.com/tools", "https://git.example.com/{1}.git"}, "go.example.com/toolsx/foo", "", false},
+		{importPathRule{"go.example.com/tools", "https://git.example.com/{1}.git"}, "other.com/foo", "", false},
+	}
+	for _, test := range tests {
+		got, ok := test.rule.cloneURL(test.importPath)
+		if ok != test.wantOK || (ok && got != test.want) {
+			t.Errorf("%+v: %s: got %q (ok=%v), want %q (ok=%v)", test.rule, test.importPath, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestImportPathRules(t *testing.T) {
+	rules := importPathRules{
+		{"go.example.com", "https://git.example.com/{1}"},
+		{"go.example.com/tools", "https://tools.example.com/{1}"},
+		{"go.example.com/x", "https://git.example.com/x/{1}/{2}"},
+	}
+	tests := []struct {
+		importPath string
+		want       string
+		wantOK     bool
+	}{
+		{"go.example.com/foo/bar", "https://git.example.com/foo", true},
+		{"go.example.com/tools/foo", "https://tools.example.com/foo", true},
+
+		// The longest matching prefix whose template can be filled in
+		// wins.
+		{"go.example.com/x/a/b", "https://git.example.com/x/a/b", true},
+		{"go.example.com/x/a", "https://git.example.com/x", true},
+
+		{"other.com/foo", "", false},
+	}
+	for _, test := range tests {
+		var target dep.ResolvedTarget
+		ok, err := rules.resolveRepo(test.importPath, &target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target.ToRepoCloneURL != test.want || ok != test.wantOK {
+			t.Errorf("%s: got %q (ok=%v), want %q (ok=%v)", test.importPath, target.ToRepoCloneURL, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestParseMetaGoImports(t *testing.T) {
+	tests := []struct {
+		html string
+		want []metaImport
+	}{
+		{
+			`<html><head><meta name="go-import" content="example.com/a git https://git.example.com/a"></head></html>`,
+			[]metaImport{{"example.com/a", "git", "https://git.example.com/a"}},
+		},
+		{
+			// Several tags, other meta tags and unquoted, upper-case
+			// attributes.
+			`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<META NAME=go-import CONTENT="example.com/a git https://git.example.com/a">
+<meta name="go-source" content="example.com/a _ https://git.example.com/a/tree{/dir}">
+<meta name="go-import" content="example.com/a mod https://proxy.example.com">
+</head>
+</html>`,
+			[]metaImport{
+				{"example.com/a", "git", "https://git.example.com/a"},
+				{"example.com/a", "mod", "https://proxy.example.com"},
+			},
+		},
+		{
+			// Tags in the body are ignored.
+			`<html><head></head><body><meta name="go-import" content="example.com/a git https://git.example.com/a"></body></html>`,
+			nil,
+		},
+		{
+			// Malformed contents are ignored.
+			`<html><head><meta name="go-import" content="example.com/a git"></head></html>`,
+			nil,
+		},
+		{
+			`<?xml version="1.0" encoding="utf-8"?><html><head><meta name="go-import" content="example.com/a hg https://hg.example.com/a"></head></html>`,
+			[]metaImport{{"example.com/a", "hg", "https://hg.example.com/a"}},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseMetaGoImports(strings.NewReader(test.html))
+		if err != nil {
+			t.Errorf("%s: %s", test.html, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.html, got, test.want)
+		}
+	}
+
+	if _, err := parseMetaGoImports(strings.NewReader(`<?xml version="1.0" encoding="latin1"?><html>`)); err == nil {
+		t.Error("got no error for an unsupported charset")
+	}
+}
+
+func TestGoImportMetaDir(t *testing.T) {
+	dir := t.TempDir()
+	meta := func(content string) string {
+		return `<html><head><meta name="go-import" content="` + content + `"></head></html>`
+	}
+	writeTestFiles(t, dir, map[string]string{
+		"example.com/a.html":       meta("example.com/a git https://git.example.com/a"),
+		"example.com/b/index.html": meta("example.com/b git https://git.example.com/b"),
+		"example.com/m.html":       meta("example.com/m mod https://proxy.example.com"),
+		"example.com/bad.html":     `<html><head><meta name="go-import" content="example.com/bad git https://git.example.com/bad">`,
+		"example.com/other.html":   meta("example.com/elsewhere git https://git.example.com/elsewhere"),
+	})
+
+	tests := []struct {
+		importPath string
+		want       string
+		wantOK     bool
+	}{
+		{"example.com/a", "https://git.example.com/a", true},
+		{"example.com/b", "https://git.example.com/b", true},
+
+		// The pages of the parent paths are used.
+		{"example.com/a/x/y", "https://git.example.com/a", true},
+		{"example.com/b/x", "https://git.example.com/b", true},
+
+		// A page that is cut off after the tag still counts.
+		{"example.com/bad/x", "https://git.example.com/bad", true},
+
+		// Module proxies don't say where the repository is.
+		{"example.com/m", "", false},
+
+		// The tag's prefix must contain the import path.
+		{"example.com/other", "", false},
+
+		{"example.com/c", "", false},
+	}
+	for _, test := range tests {
+		var target dep.ResolvedTarget
+		ok, err := goImportMetaDir(dir).resolveRepo(test.importPath, &target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target.ToRepoCloneURL != test.want || ok != test.wantOK {
+			t.Errorf("%s: got %q (ok=%v), want %q (ok=%v)", test.importPath, target.ToRepoCloneURL, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestModuleProxyDir(t *testing.T) {
+	dir := t.TempDir()
+	info := func(version, url, hash string) string {
+		if url == "" {
+			return `{"Version":"` + version + `","Time":"2020-01-01T00:00:00Z"}`
+		}
+		return `{"Version":"` + version + `","Time":"2020-01-01T00:00:00Z","Origin":{"VCS":"git","URL":"` + url + `","Hash":"` + hash + `"}}`
+	}
+	writeTestFiles(t, dir, map[string]string{
+		"example.com/a/@v/v1.0.0.info":       info("v1.0.0", "https://git.example.com/a", "aaa100"),
+		"example.com/a/@v/v1.0.0.mod":        "module example.com/a\n",
+		"example.com/a/@v/v1.2.0.info":       info("v1.2.0", "https://git.example.com/a", "aaa120"),
+		"example.com/a/@v/v1.10.0.info":      info("v1.10.0", "https://git.example.com/a", "aaa1100"),
+		"example.com/!upper/@v/v0.1.0.info":  info("v0.1.0", "https://git.example.com/Upper", "uuu"),
+		"example.com/proxied/@v/v1.0.0.info": info("v1.0.0", "", ""),
+		"example.com/broken/@v/v1.0.0.info":  "{",
+	})
+
+	tests := []struct {
+		importPath string
+		version    string
+		want       dep.ResolvedTarget
+		wantOK     bool
+	}{
+		// The .info file of the version is used, and its hash is the
+		// revision.
+		{"example.com/a", "v1.2.0", dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a", ToVersionString: "v1.2.0", ToRevSpec: "aaa120"}, true},
+
+		// Without a version (or with one that is not in the cache),
+		// the highest version's .info file is used to find the
+		// repository, but only sets the version if there was none.
+		{"example.com/a", "", dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a", ToVersionString: "v1.10.0", ToRevSpec: "aaa1100"}, true},
+		{"example.com/a", "v2.0.0", dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a", ToVersionString: "v2.0.0"}, true},
+
+		// Packages in the module.
+		{"example.com/a/b/c", "v1.0.0", dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/a", ToVersionString: "v1.0.0", ToRevSpec: "aaa100"}, true},
+
+		// Upper-case letters are escaped in the cache.
+		{"example.com/Upper/x", "", dep.ResolvedTarget{ToRepoCloneURL: "https://git.example.com/Upper", ToVersionString: "v0.1.0", ToRevSpec: "uuu"}, true},
+
+		// Modules downloaded from a proxy have no origin.
+		{"example.com/proxied", "v1.0.0", dep.ResolvedTarget{ToVersionString: "v1.0.0"}, false},
+
+		{"example.com/broken", "", dep.ResolvedTarget{}, false},
+		{"example.com/c", "", dep.ResolvedTarget{}, false},
+	}
+	for _, test := range tests {
+		target := dep.ResolvedTarget{ToVersionString: test.version}
+		ok, err := moduleProxyDir(dir).resolveRepo(test.importPath, &target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(target, test.want) || ok != test.wantOK {
+			t.Errorf("%s@%s: got %+v (ok=%v), want %+v (ok=%v)", test.importPath, test.version, target, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestEscapeModulePath(t *testing.T) {
+	tests := map[string]string{
+		"example.com/a":              "example.com/a",
+		"github.com/Azure/azure-sdk": "github.com/!azure/azure-sdk",
+		"example.com/ABc":            "example.com/!a!bc",
+	}
+	for path, want := range tests {
+		if got := escapeModulePath(path); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRepoResolvers(t *testing.T) {
+	// The go command's module cache is not used unless it is
+	// configured.
+	modCache := t.TempDir()
+	writeTestFiles(t, modCache, map[string]string{
+		"cache/download/example.com/a/@v/v1.0.0.info": `{"Version":"v1.0.0","Origin":{"VCS":"git","URL":"https://git.example.com/a"}}`,
+	})
+	t.Setenv("GOMODCACHE", modCache)
+
+	oldConfig := config
+	defer func() {
+		config = oldConfig
+		repoResolversOnce, repoResolversList = sync.Once{}, nil
+		resolveDiskCacheOnce, resolveDiskCacheVal = sync.Once{}, nil
+	}()
+
+	tests := []struct {
+		config srcfileConfig
+		want   []repoResolver
+	}{
+		{srcfileConfig{}, nil},
+		{srcfileConfig{ModuleProxyDir: "/proxy"}, []repoResolver{moduleProxyDir("/proxy")}},
+		{
+			srcfileConfig{ImportPathRules: []importPathRule{{"example.com", "https://git.example.com/{1}"}}, GoImportMetaDir: "/meta", ModuleProxyDir: "/proxy", NetworkResolve: true},
+			[]repoResolver{importPathRules{{"example.com", "https://git.example.com/{1}"}}, goImportMetaDir("/meta"), moduleProxyDir("/proxy"), networkResolver{}},
+		},
+	}
+	for _, test := range tests {
+		config = &test.config
+		repoResolversOnce, repoResolversList = sync.Once{}, nil
+		if got := repoResolvers(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: got resolvers %#v, want %#v", test.config, got, test.want)
+		}
+	}
+
+	config = &srcfileConfig{}
+	repoResolversOnce, repoResolversList = sync.Once{}, nil
+	resolveDiskCacheOnce, resolveDiskCacheVal = sync.Once{}, nil
+	var target dep.ResolvedTarget
+	if ok, err := resolveRepo("example.com/a", &target); ok || err != nil {
+		t.Errorf("got %+v (ok=%v, err=%v) without a configured module cache, want no resolution", target, ok, err)
+	}
+}
@@ -42,6 +42,24 @@ func (c *ScanCmd) Execute(args []string) error {
 		return err
 	}
 
+	units, err := scanUnits()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(units, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stdout.Write(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// scanUnits applies config and scans the current directory for source
+// units, as the scan command does.
+func scanUnits() ([]*SourceUnit, error) {
 	// Automatically detect vendored dirs (check for vendor/src and
 	// Godeps/_workspace/src) and set up GOPATH pointing to them if
 	// they exist.
@@ -65,17 +83,17 @@ func (c *ScanCmd) Execute(args []string) error {
 	}
 
 	if err := config.apply(); err != nil {
-		return err
+		return nil, err
 	}
 
 	scanDir, err := filepath.EvalSymlinks(getCWD())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	units, err := scan(scanDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(config.PkgPatterns) != 0 {
@@ -103,7 +121,7 @@ func (c *ScanCmd) Execute(args []string) error {
 		for _, dir := range dirs {
 			relDir, err := filepath.Rel(cwd, dir)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			srcDir := filepath.Join(relDir, "src")
 			for _, u := range units {
@@ -111,7 +129,7 @@ func (c *ScanCmd) Execute(args []string) error {
 				if strings.HasPrefix(pkg.Dir, srcDir) {
 					relImport, err := filepath.Rel(srcDir, pkg.Dir)
 					if err != nil {
-						return err
+						return nil, err
 					}
 					pkg.ImportPath = relImport
 					u.Name = pkg.ImportPath
@@ -150,7 +168,7 @@ func (c *ScanCmd) Execute(args []string) error {
 			for i, dir := range dirs {
 				relDir, err := filepath.Rel(cwd, dir)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				dirs[i] = relDir
 			}
@@ -188,14 +206,7 @@ func (c *ScanCmd) Execute(args []string) error {
 		}
 	}
 
-	b, err := json.MarshalIndent(units, "", "  ")
-	if err != nil {
-		return err
-	}
-	if _, err := os.Stdout.Write(b); err != nil {
-		return err
-	}
-	return nil
+	return units, nil
 }
 
 // findVendor from golang/go/cmd/go/pkg.go
@@ -259,16 +270,42 @@ func isInGopath(path string) bool {
 }
 
 func scan(scanDir string) ([]*SourceUnit, error) {
-	// TODO(sqs): include xtest, but we'll have to make them have a distinctly
-	// namespaced def path from the non-xtest pkg.
+	// The files of xtest packages (package foo_test) are included in the
+	// unit of the package they test (foo). The grapher puts their defs
+	// underneath the def path "foo_test" in foo's unit.
 
 	pkgs, err := scanForPackages(scanDir, scanDir)
 	if err != nil {
 		return nil, err
 	}
 
+	mods, err := findGoModules(scanDir)
+	if err != nil {
+		return nil, err
+	}
+
 	var units []*SourceUnit
 	for _, pkg := range pkgs {
+		// Packages in a Go module get their import path from the
+		// module path in go.mod, not from their location in GOPATH.
+		var unitConfig map[string]interface{}
+		var goModPath string
+		if mod := mods.forDir(pkg.Dir); mod != nil {
+			pkg.ImportPath, err = mod.importPath(pkg.Dir)
+			if err != nil {
+				return nil, err
+			}
+			moduleRoot, err := filepath.Rel(scanDir, mod.Dir)
+			if err != nil {
+				return nil, err
+			}
+			unitConfig = map[string]interface{}{
+				"ModuleRoot": filepath.ToSlash(moduleRoot),
+				"ModulePath": mod.Module,
+			}
+			goModPath = filepath.ToSlash(filepath.Join(moduleRoot, "go.mod"))
+		}
+
 		// Collect all files
 		var files []string
 		files = append(files, pkg.GoFiles...)
@@ -318,6 +355,11 @@ func scan(scanDir string) ([]*SourceUnit, error) {
 		pkg.TestImportPos = nil
 		pkg.XTestImportPos = nil
 
+		paths := []string{pkg.Dir}
+		if goModPath != "" {
+			paths = append(paths, goModPath)
+		}
+
 		units = append(units, &SourceUnit{
 			Name:         pkg.ImportPath,
 			Type:         "GoPackage",
@@ -325,8 +367,9 @@ func scan(scanDir string) ([]*SourceUnit, error) {
 			Files:        files,
 			Data:         pkg,
 			Dependencies: deps,
+			Config:       unitConfig,
 			Ops:          map[string]*srclib.ToolRef{"depresolve": nil, "graph-all": nil},
-			Paths:				[]string{pkg.Dir},
+			Paths:        paths,
 		})
 	}
 
@@ -334,6 +377,7 @@ func scan(scanDir string) ([]*SourceUnit, error) {
 	assignGodepsCommits(scanDir, units)
 	assignGovendorCommits(scanDir, units)
 	assignRevisionsToDependencies(units)
+	assignModuleVersionsToDependencies(scanDir, units, mods)
 	units = filterVendorizedDependencies(units)
 
 	return units, nil
@@ -457,6 +501,30 @@ func assignRevisionsToDependencies(units []*SourceUnit) {
 	}
 }
 
+// assignModuleVersionsToDependencies sets the version of each
+// dependency that is provided by a module required in the go.mod file
+// (or recorded in the go.sum file) of the unit's module. Dependencies
+// that already have a version (because they are in this repository)
+// are left alone.
+func assignModuleVersionsToDependencies(dir string, units []*SourceUnit, mods goModules) {
+	for _, unit := range units {
+		mod := mods.forDir(filepath.Join(dir, unit.Dir))
+		if mod == nil {
+			continue
+		}
+		for index, rawDep := range unit.Dependencies {
+			dep := rawDep.(gog.Dep)
+			if dep.Version != "" {
+				continue
+			}
+			if _, version, ok := mod.requirement(dep.Name); ok {
+				dep.Version = version
+				unit.Dependencies[index] = dep
+			}
+		}
+	}
+}
+
 func scanForPackages(srcdir string, dir string) ([]*build.Package, error) {
 	var pkgs []*build.Package
 
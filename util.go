@@ -28,3 +28,16 @@ func evalSymlinks(path string) string {
 	}
 	return newPath
 }
+
+// sameDir reports whether the paths a and b refer to the same
+// directory, after making them absolute and evaluating symlinks.
+func sameDir(a, b string) bool {
+	return canonicalDir(a) == canonicalDir(b)
+}
+
+func canonicalDir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return filepath.Clean(evalSymlinks(dir))
+}
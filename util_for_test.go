@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// scanTestRepo writes files (keyed by their slash-separated paths) to
+// a new directory, makes it the current directory, and scans it under
+// the config c, returning the units as the graph command reads them.
+// The globals that this changes are restored when the test ends.
+func scanTestRepo(t *testing.T, c srcfileConfig, files map[string]string) unit.SourceUnits {
+	dir := evalSymlinks(t.TempDir())
+	writeTestFiles(t, dir, files)
+
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	oldCwd, oldConfig, oldBuildContext := cwd, config, buildContext
+	t.Cleanup(func() {
+		os.Chdir(oldWd)
+		cwd, config, buildContext = oldCwd, oldConfig, oldBuildContext
+	})
+	cwd = dir
+	config = &c
+
+	scanned, err := scanUnits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(scanned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var units unit.SourceUnits
+	if err := json.Unmarshal(b, &units); err != nil {
+		t.Fatal(err)
+	}
+	if err := unmarshalTypedConfig(units[0].Config); err != nil {
+		t.Fatal(err)
+	}
+	return units
+}
+
+// writeTestFiles writes files (keyed by their slash-separated paths)
+// to dir.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}